@@ -8,16 +8,9 @@ import (
 	"time"
 )
 
-func forbidden(c echo.Context) error {
-	return c.JSON(http.StatusForbidden, common.FromKeysAndValues("error", "forbidden"))
-}
-
 // getBalance renders current balance of user
 func (svc *accSvc) getBalance(c echo.Context) error {
-	userIsAllowed, userId := svc.checkAuth(c, []schema.UserRole{schema.RoleUser})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
+	userId := common.CurrentUser(c).ID
 
 	var account Account
 	svc.accDb.Preload("User").Where("user_id = ?", userId).First(&account)
@@ -27,10 +20,7 @@ func (svc *accSvc) getBalance(c echo.Context) error {
 
 // getLog renders log of operations on user's account for unfinished billing cycle
 func (svc *accSvc) getLog(c echo.Context) error {
-	userIsAllowed, userId := svc.checkAuth(c, []schema.UserRole{schema.RoleUser})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
+	userId := common.CurrentUser(c).ID
 
 	log := svc.queryLogOnDay(userId, "")
 	return c.JSON(http.StatusOK, log)
@@ -38,10 +28,7 @@ func (svc *accSvc) getLog(c echo.Context) error {
 
 // getLog renders log of operations on user's account for billing cycle of certain day
 func (svc *accSvc) getLogOnDay(c echo.Context) error {
-	userIsAllowed, userId := svc.checkAuth(c, []schema.UserRole{schema.RoleUser})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
+	userId := common.CurrentUser(c).ID
 
 	dayParam := c.Param("day") // must be YYYY-MM-DD
 	_, err := time.Parse("2006-01-02", dayParam)
@@ -55,22 +42,12 @@ func (svc *accSvc) getLogOnDay(c echo.Context) error {
 
 // getLog renders log of operations on user's account for unfinished billing cycle
 func (svc *accSvc) getIncome(c echo.Context) error {
-	userIsAllowed, _ := svc.checkAuth(c, []schema.UserRole{schema.RoleAdmin, schema.RoleAccountant})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
-
 	income, _ := svc.queryIncomeOnDay("")
 	return c.JSON(http.StatusOK, common.FromKeysAndValues("income", income))
 }
 
 // getLog renders log of operations on user's account for billing cycle of certain day
 func (svc *accSvc) getIncomeOnDay(c echo.Context) error {
-	userIsAllowed, _ := svc.checkAuth(c, []schema.UserRole{schema.RoleAdmin, schema.RoleAccountant})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
-
 	dayParam := c.Param("day") // must be YYYY-MM-DD
 	_, err := time.Parse("2006-01-02", dayParam)
 	if err != nil {
@@ -160,12 +137,7 @@ func (svc *accSvc) queryIncomeOnDay(day string) (int, error) {
 
 // closeDay creates billing cycle, sets today as the day of BC, and creates WagePayment operations
 func (svc *accSvc) closeDay(c echo.Context) error {
-	userIsAllowed, _ := svc.checkAuth(c, []schema.UserRole{schema.RoleAdmin})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
-
-	err := svc.createBillingCycle()
+	err := svc.createBillingCycle(c.Request().Context())
 	if err == nil {
 		return c.JSON(http.StatusOK, nil)
 	}
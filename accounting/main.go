@@ -2,28 +2,36 @@ package main
 
 import (
 	"ates/common"
+	"ates/schema"
+	"context"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/hamba/avro/v2"
 	"github.com/labstack/echo/v4/middleware"
 	"go.uber.org/zap"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type accSvc struct {
-	logger         *zap.SugaredLogger
-	accDb          *gorm.DB
-	authServer     string
-	authHttpClient *http.Client
-	kafkaProducer  *kafka.Producer
-	kafkaConsumer  *kafka.Consumer
+	logger        *zap.SugaredLogger
+	accDb         *gorm.DB
+	kafkaProducer *kafka.Producer
+	eventConsumer *common.EventConsumer
 }
 
+// version is set on build with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	zapLogger := zap.New(common.GetZapCore(true))
 	logger := zapLogger.Sugar()
 	logger.Info("Starting aTES.Accounting service")
+	common.SetProducer("Accounting", version)
 
 	webAddress := os.Getenv("ATES_ACC_SERVER")
 	if webAddress == "" {
@@ -45,23 +53,35 @@ func main() {
 		os.Exit(-1)
 	}
 
-	kafkaConsumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": "localhost",
-		"group.id":          "Accounting",
-		"auto.offset.reset": "earliest",
-	})
-	if err != nil {
-		logger.Fatalf("Failed to initialize Kafka Consumer")
+	// service is OAuth client of Auth, it introspects access tokens when local verification is not enough
+	clientID := os.Getenv("ATES_ACC_CLIENT_ID")
+	clientSecret := os.Getenv("ATES_ACC_CLIENT_SECRET")
+	if clientID == "" || clientSecret == "" {
+		logger.Fatalf("Missing client credentials in ATES_ACC_CLIENT_ID and ATES_ACC_CLIENT_SECRET env")
 		os.Exit(-1)
 	}
 
-	err = kafkaConsumer.SubscribeTopics([]string{"user.lifecycle", "task.lifecycle"}, nil)
+	schemaRegistryUrl := os.Getenv("ATES_SCHEMA_REGISTRY")
+	if schemaRegistryUrl == "" {
+		logger.Fatalf("Missing schema registry url in ATES_SCHEMA_REGISTRY env, use mock:// for in-process registry")
+		os.Exit(-1)
+	}
+
+	kafkaConsumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  "localhost",
+		"group.id":           "Accounting",
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": false,
+	})
 	if err != nil {
-		logger.Fatalf("Failed to subscribe to necessary Kafka topics")
+		logger.Fatalf("Failed to initialize Kafka Consumer")
 		os.Exit(-1)
 	}
 
-	kafkaProducer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": "localhost"})
+	kafkaProducer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers":  "localhost",
+		"enable.idempotence": true, // keeps order of events with the same key on retries
+	})
 	if err != nil {
 		logger.Fatalf("Failed to initialize Kafka Producer")
 		os.Exit(-1)
@@ -89,40 +109,89 @@ func main() {
 	}
 
 	// Ensure tables
-	_ = db.AutoMigrate(&User{}, &Task{}, &BillingCycle{}, &Account{}, &OperationType{})
+	_ = db.AutoMigrate(&User{}, &Task{}, &BillingCycle{}, &Account{}, &OperationType{}, &common.OutboxMessage{}, &common.OutboxLease{}, &common.DeadLetter{}, &common.ProcessedEvent{})
 	//_ = db.AutoMigrate(&AccountLog{})
 	//createDefaultOperations(db)
 
+	err = schema.UseRegistry(schemaRegistryUrl)
+	if err != nil {
+		logger.Fatalf("Failed to connect to schema registry: %s", err.Error())
+		os.Exit(-1)
+	}
+	// producer registers its schemas at start, so incompatible change fails before any event is sent
+	for _, s := range []avro.Schema{schema.AccountLog} {
+		err = schema.Register(s)
+		if err != nil {
+			logger.Fatalf("Failed to register avro schema: %s", err.Error())
+			os.Exit(-1)
+		}
+	}
+
 	// todo: find a way to create GORM table without key and constraint
 	// alter table account_logs drop constraint fk_account_logs_task
 	// alter table account_logs drop key fk_account_logs_task;
 
 	app := accSvc{
-		logger:     logger,
-		accDb:      db,
-		authServer: common.EnsureServerProtocol(authServer),
-		authHttpClient: &http.Client{
-			Transport: &http.Transport{
-				//TLSClientConfig: tlsConfig,
-			},
-		},
+		logger:        logger,
+		accDb:         db,
 		kafkaProducer: kafkaProducer,
-		kafkaConsumer: kafkaConsumer,
+		eventConsumer: common.NewEventConsumer("Accounting", kafkaConsumer, db, logger),
 	}
+	app.registerEventHandlers(app.eventConsumer)
 
-	e.GET("/log/my", app.getLog)
-	e.GET("/log/:day", app.getLogOnDay)
-	e.GET("/balance/my", app.getBalance)
+	retryPolicy, err := common.RetryPolicyFromEnv("ATES_ACC")
+	if err != nil {
+		logger.Fatalf("Failed to read retry policy: %s", err.Error())
+		os.Exit(-1)
+	}
+	app.eventConsumer.SetRetryPolicy(retryPolicy)
 
-	e.GET("/income/today", app.getIncome)
-	e.GET("/income/:day", app.getIncomeOnDay)
+	err = app.eventConsumer.Subscribe([]string{"user.lifecycle", "task.lifecycle"})
+	if err != nil {
+		logger.Fatalf("Failed to subscribe to necessary Kafka topics")
+		os.Exit(-1)
+	}
 
-	e.POST("/closeday", app.closeDay)
+	// permission matrix maps actions to roles and scopes, ATES_PERMISSIONS is path of JSON file
+	permissions, err := common.LoadPermissions(os.Getenv("ATES_PERMISSIONS"))
+	if err != nil {
+		logger.Fatalf("Failed to load permissions: %s", err.Error())
+		os.Exit(-1)
+	}
 
-	abortReadCh := make(chan bool)
-	go app.startReadingNotification(abortReadCh)
+	// access tokens are verified locally with keys of Auth, so requests are served while Auth is down;
+	// verified tokens are cached for TTL. Auth introspects tokens of users not synced yet and of AllowFresh routes.
+	authClient := &http.Client{
+		Transport: &http.Transport{
+			//TLSClientConfig: tlsConfig,
+		},
+	}
+	auth := common.NewAuthenticator(common.NewJWTVerifier(authServer, authClient),
+		common.NewUserLookup(db, app.createAccount, logger), permissions, 30*time.Second, logger)
+	auth.SetIntrospector(common.NewIntrospectionVerifier(authServer, clientID, clientSecret, authClient))
+
+	e.GET("/log/my", app.getLog, auth.Allow("accounting.log.read"))
+	e.GET("/log/:day", app.getLogOnDay, auth.Allow("accounting.log.read"))
+	e.GET("/balance/my", app.getBalance, auth.Allow("accounting.balance.read"))
+
+	e.GET("/income/today", app.getIncome, auth.Allow("accounting.income.read"))
+	e.GET("/income/:day", app.getIncomeOnDay, auth.Allow("accounting.income.read"))
+
+	e.POST("/closeday", app.closeDay, auth.AllowFresh("day.close")) // pays out money, revoked token must not do it
 
-	e.Logger.Fatal(e.Start(webAddress))
+	e.GET("/admin/dlq", app.eventConsumer.ListDeadLettersHandler(), auth.Allow("dlq.manage"))
+	e.POST("/admin/dlq/:id/redrive", app.eventConsumer.RedriveDeadLetterHandler(), auth.AllowFresh("dlq.manage"))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go common.NewOutboxRelay(db, kafkaProducer, logger).Run(ctx)
+
+	consumerDone := make(chan struct{})
+	go func() {
+		app.eventConsumer.Run(ctx)
+		close(consumerDone)
+	}()
 
-	abortReadCh <- true
+	common.StartEcho(ctx, e, webAddress, logger)
+	<-consumerDone
 }
@@ -1,17 +1,14 @@
 package main
 
 import (
+	"ates/common"
 	"ates/schema"
+	"ates/schema/events"
 	"github.com/go-oauth2/oauth2/v4/errors"
-	"github.com/hamba/avro/v2"
 	"gorm.io/gorm"
 	"time"
 )
 
-type AuthVerification struct {
-	PublicId string `json:"sub"`
-}
-
 type BillingCycle struct {
 	gorm.Model `json:"-"`
 	Day        time.Time
@@ -24,17 +21,18 @@ type Account struct {
 	Balance    int
 }
 
-func (a *Account) load(svc *accSvc) error {
-	result := svc.accDb.
+// load finds Account of user, or creates new one within transaction tx
+func (a *Account) load(tx *gorm.DB, svc *accSvc) error {
+	result := tx.
 		Preload("User").
 		Where("user_id = ?", a.UserID).
 		Find(&a)
 	if result.RowsAffected == 1 {
 		return nil
 	}
-	result = svc.accDb.Create(&a)
+	result = tx.Create(&a)
 	if result.RowsAffected == 1 {
-		svc.logger.Infof("Created account for user %s", a.UserID)
+		svc.logger.Infof("Created account for user %d", a.UserID)
 		return nil
 	}
 	svc.logger.Errorf("Failed to create account for user")
@@ -43,22 +41,30 @@ func (a *Account) load(svc *accSvc) error {
 
 type AccountLog struct {
 	gorm.Model      `json:"-"`
-	LogID           int                         `gorm:"-" avro:"logId" json:"-"`
-	UserID          int                         `json:"-" avro:"userId"`
-	User            User                        `json:"-" avro:"-"`
-	TaskID          int                         `json:"-" avro:"taskId"`
-	Task            *Task                       `avro:"-"`
-	BillingCycleID  int                         `json:"-" avro:"billingCycleId"`
-	OperationTypeID schema.AccountOperationType `avro:"operationId"`
-	Debit           int                         `avro:"debit"`
-	Credit          int                         `avro:"credit"`
-	Message         string                      `avro:"-"`
-	Balance         int                         `avro:"balance"`
+	UserID          int  `json:"-"`
+	User            User `json:"-"`
+	TaskID          int  `json:"-"`
+	Task            *Task
+	BillingCycleID  int `json:"-"`
+	OperationTypeID schema.AccountOperationType
+	Debit           int
+	Credit          int
+	Message         string
+	Balance         int
 }
 
-func (a *AccountLog) marshal() ([]byte, error) {
-	a.LogID = int(a.ID)
-	return avro.Marshal(schema.AccountLog, a)
+// toEvent maps AccountLog to event, logId is identifier of the log record
+func (a *AccountLog) toEvent() events.AccountLog {
+	return events.AccountLog{
+		LogId:          int(a.ID),
+		TaskId:         a.TaskID,
+		UserId:         a.UserID,
+		BillingCycleId: a.BillingCycleID,
+		OperationId:    int(a.OperationTypeID),
+		Debit:          a.Debit,
+		Credit:         a.Credit,
+		Balance:        a.Balance,
+	}
 }
 
 type OperationType struct {
@@ -88,41 +94,38 @@ func createDefaultOperations(db *gorm.DB) {
 }
 
 // User is synced, source is "auth"
-type User struct {
-	gorm.Model `json:"-"`
-	PublicId   string          `json:"uid" avro:"uid"`
-	Login      string          `json:"login" avro:"login"`
-	RoleID     schema.UserRole `json:"roleId" avro:"roleId"`
-}
-
-func (u *User) load(svc *accSvc) {
-	svc.accDb.Where("id = ?", u.ID).Find(&u)
-}
-
-func (u *User) loadWithPublicId(svc *accSvc, publicId string) error {
-	result := svc.accDb.Where("public_id = ?", publicId).Find(&u)
-	if result.RowsAffected == 1 {
-		return nil
-	}
-	return errors.New("user not found")
-}
+type User = common.User
 
 // Task is synced, source is "taskmanager", additional fields here
 type Task struct {
 	gorm.Model       `json:"-"`
-	PublicId         string            `gorm:"default:(uuid());unique" json:"tid" avro:"tid"`
-	JiraId           string            `json:"jira_id" avro:"jira_id"`
-	Title            string            `json:"title" avro:"title"`
-	Description      string            `json:"description" avro:"description"`
-	StatusID         schema.TaskStatus `json:"statusId" avro:"statusId"`
+	PublicId         string            `gorm:"default:(uuid());unique" json:"tid"`
+	JiraId           string            `json:"jira_id"`
+	Title            string            `json:"title"`
+	Description      string            `json:"description"`
+	StatusID         schema.TaskStatus `json:"statusId"`
 	AssignedToID     int               `json:"-"`
-	AssignedTo       User              `gorm:"-" json:"-" avro:"assignedTo"`
+	AssignedTo       User              `gorm:"-" json:"-"`
 	CostOfAssignment int               // set in Accounting
 	CompletionReward int               // set in Accounting
 }
 
-func (t *Task) loadWithPublicId(svc *accSvc, publicId string) error {
-	result := svc.accDb.
+// taskFromEvent maps Task event to local copy of task, assignee is set by public identifier only
+func taskFromEvent(e events.Task) Task {
+	return Task{
+		PublicId:    e.Tid,
+		JiraId:      e.JiraId,
+		Title:       e.Title,
+		Description: e.Description,
+		StatusID:    schema.TaskStatus(e.StatusId),
+		AssignedTo: User{
+			PublicId: e.AssignedTo.Uid,
+		},
+	}
+}
+
+func (t *Task) loadWithPublicId(db *gorm.DB, publicId string) error {
+	result := db.
 		Where("public_id = ?", publicId).Find(&t)
 	if result.RowsAffected == 1 {
 		return nil
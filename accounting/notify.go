@@ -2,122 +2,75 @@ package main
 
 import (
 	"ates/common"
-	"ates/schema"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"github.com/hamba/avro/v2"
-	"sync"
-	"time"
+	"ates/schema/events"
+	"context"
+	"fmt"
+	"gorm.io/gorm"
 )
 
-// notifyAsync sends notification to Kafka
-func (svc *accSvc) notifyAsync(eventType string, e interface{}) {
+// notify stores notification in outbox within transaction tx, it is sent to Kafka by OutboxRelay
+func (svc *accSvc) notify(ctx context.Context, tx *gorm.DB, eventType string, e interface{}) error {
 
 	switch e.(type) {
 	case AccountLog:
 
 		topic := "accountlog.lifecycle"
-		msg := kafka.Message{
-			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-			Key:            []byte(common.GenerateRandomString(10)),
-			Value:          nil,
-		}
-
-		common.AppendKafkaHeader(&msg, "event", eventType)
-		common.AppendKafkaHeader(&msg, "producer", "Accounting")
 
 		switch eventType {
 		case "AccountLog.Created", "AccountLog.Updated":
-			common.AppendKafkaHeader(&msg, "eventVersion", "v1")
 			a := e.(AccountLog)
-			b, err := a.marshal()
+			ae := a.toEvent()
+			b, err := ae.Marshal()
 			if err != nil {
-				svc.logger.Errorf("failed to marshal AccountLog#%d to avro: %s", a.ID, err.Error())
-				return
+				return fmt.Errorf("failed to marshal AccountLog#%d to avro: %w", a.ID, err)
 			}
-			msg.Value = b
-		}
-
-		if msg.Value != nil {
-			err := svc.kafkaProducer.Produce(&msg, nil)
+			// log records of the account go to the same partition, keyed by user who owns the account
+			var u User
+			err = tx.Limit(1).Find(&u, a.UserID).Error
 			if err != nil {
-				svc.logger.Errorf("Failed to send event notification on %s", eventType)
-				svc.logger.Error(err)
+				return fmt.Errorf("failed to find owner of AccountLog#%d: %w", a.ID, err)
+			}
+			if u.PublicId == "" {
+				return fmt.Errorf("owner of AccountLog#%d not found", a.ID)
 			}
+			event := common.NewEvent(ctx, eventType, "v1", b)
+			event.Key = []byte(u.PublicId)
+			return common.StoreInOutbox(tx, event.Message(topic))
 		}
 	}
 
+	return fmt.Errorf("no notification for %s", eventType)
 }
 
-// startReadingNotification reads topics from Kafka
-func (svc *accSvc) startReadingNotification(abortCh <-chan bool) {
-	defer func() {
-		_ = svc.kafkaConsumer.Close()
-	}()
-
-	run := true
-	runMx := &sync.Mutex{}
-
-	go func() {
-		for run {
-			msg, err := svc.kafkaConsumer.ReadMessage(time.Second)
-			if err != nil {
-				if err.(kafka.Error).IsTimeout() {
-					continue
-				}
-				svc.logger.Error(err)
-				continue
-				//return
-			}
-
-			eventType, err := common.GetKafkaHeader(msg, "event")
-			if err != nil {
-				svc.logger.Infof("missing event header in the message %s, skipping", msg.Key)
-				continue
-			}
-			eventVersion, _ := common.GetKafkaHeader(msg, "eventVersion")
-
-			switch eventType {
-			case "User.Created":
-				err := svc.createUser(msg.Value)
-				if err != nil {
-					svc.logger.Errorf("Failed to process notification on %s: %s", eventType, err.Error())
-					continue
-				}
-
-			case "Task.Created", "Task.Completed", "Task.Reassigned":
-				var t Task
-				err := avro.Unmarshal(schema.TaskSchema, msg.Value, &t)
-
-				if err != nil {
-					svc.logger.Errorf("Failed to process notification on %s: bad payload, %s", eventType, err.Error())
-					continue
-				}
+// registerEventHandlers binds consumed events to service functions
+func (svc *accSvc) registerEventHandlers(c *common.EventConsumer) {
+	// every User event carries the whole user, older versions are upcasted to the latest one
+	for _, name := range []string{"User.Created", "User.Updated", "User.Deleted"} {
+		c.Handle(name, "", func(_ context.Context, tx *gorm.DB, e *common.Event) error {
+			return svc.saveUser(tx, e.Payload)
+		})
+	}
 
-				switch eventType {
-				case "Task.Created":
-					err = svc.createTask(msg.Value, eventVersion)
-				case "Task.Completed":
-					err = svc.completeTask(t.PublicId, t.AssignedTo.PublicId)
-				case "Task.Reassigned":
-					err = svc.reassignTask(t.PublicId, t.AssignedTo.PublicId)
-				}
+	// payloads of older versions are upcasted to the latest Task schema, so handlers accept any version
+	c.Handle("Task.Created", "", func(ctx context.Context, tx *gorm.DB, e *common.Event) error {
+		return svc.createTask(ctx, tx, e.Payload)
+	})
 
-				if err != nil {
-					svc.logger.Errorf("Failed to process notification on %s: %s", eventType, err.Error())
-					continue
-				}
-			}
+	c.Handle("Task.Completed", "", func(ctx context.Context, tx *gorm.DB, e *common.Event) error {
+		var te events.Task
+		err := te.Unmarshal(e.Payload)
+		if err != nil {
+			return fmt.Errorf("bad payload: %w", err)
 		}
-	}()
-
-	for {
-		select {
-		case _ = <-abortCh:
-			runMx.Lock()
-			run = false
-			runMx.Unlock()
-			return
+		return svc.completeTask(ctx, tx, te.Tid, te.AssignedTo.Uid)
+	})
+
+	c.Handle("Task.Reassigned", "", func(ctx context.Context, tx *gorm.DB, e *common.Event) error {
+		var te events.Task
+		err := te.Unmarshal(e.Payload)
+		if err != nil {
+			return fmt.Errorf("bad payload: %w", err)
 		}
-	}
-
+		return svc.reassignTask(ctx, tx, te.Tid, te.AssignedTo.Uid)
+	})
 }
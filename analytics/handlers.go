@@ -1,28 +1,18 @@
 package main
 
 import (
-	"ates/common"
 	"ates/schema"
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"time"
 )
 
-func forbidden(c echo.Context) error {
-	return c.JSON(http.StatusForbidden, common.FromKeysAndValues("error", "forbidden"))
-}
-
 type NResult struct {
 	N int64 //or int ,or some else
 }
 
 // getToday renders today's metrics
 func (svc *anSvc) getToday(c echo.Context) error {
-	userIsAllowed, _ := svc.checkAuth(c, []schema.UserRole{schema.RoleAdmin})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
-
 	var metrics TodayMetrics
 	var n NResult
 
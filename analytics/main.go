@@ -2,6 +2,8 @@ package main
 
 import (
 	"ates/common"
+	"ates/schema"
+	"context"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/labstack/echo/v4/middleware"
 	"go.uber.org/zap"
@@ -9,20 +11,25 @@ import (
 	"gorm.io/gorm"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type anSvc struct {
-	logger         *zap.SugaredLogger
-	anDb           *gorm.DB
-	authServer     string
-	authHttpClient *http.Client
-	kafkaConsumer  *kafka.Consumer
+	logger        *zap.SugaredLogger
+	anDb          *gorm.DB
+	eventConsumer *common.EventConsumer
 }
 
+// version is set on build with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	zapLogger := zap.New(common.GetZapCore(true))
 	logger := zapLogger.Sugar()
 	logger.Info("Starting aTES.Analytics service")
+	common.SetProducer("Analytics", version)
 
 	webAddress := os.Getenv("ATES_AN_SERVER")
 	if webAddress == "" {
@@ -44,21 +51,53 @@ func main() {
 		os.Exit(-1)
 	}
 
+	// service is OAuth client of Auth, it introspects access tokens when local verification is not enough
+	clientID := os.Getenv("ATES_AN_CLIENT_ID")
+	clientSecret := os.Getenv("ATES_AN_CLIENT_SECRET")
+	if clientID == "" || clientSecret == "" {
+		logger.Fatalf("Missing client credentials in ATES_AN_CLIENT_ID and ATES_AN_CLIENT_SECRET env")
+		os.Exit(-1)
+	}
+
+	schemaRegistryUrl := os.Getenv("ATES_SCHEMA_REGISTRY")
+	if schemaRegistryUrl == "" {
+		logger.Fatalf("Missing schema registry url in ATES_SCHEMA_REGISTRY env, use mock:// for in-process registry")
+		os.Exit(-1)
+	}
+
 	kafkaConsumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": "localhost",
-		"group.id":          "Analytics",
-		"auto.offset.reset": "earliest",
+		"bootstrap.servers":  "localhost",
+		"group.id":           "Analytics",
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": false,
 	})
 	if err != nil {
 		logger.Fatalf("Failed to initialize Kafka Consumer")
 		os.Exit(-1)
 	}
 
-	err = kafkaConsumer.SubscribeTopics([]string{"user.lifecycle", "accountlog.lifecycle"}, nil)
+	// Analytics produces only messages to its dead-letter topic
+	kafkaProducer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers":  "localhost",
+		"enable.idempotence": true, // keeps order of events with the same key on retries
+	})
 	if err != nil {
-		logger.Fatalf("Failed to subscribe to necessary Kafka topics")
+		logger.Fatalf("Failed to initialize Kafka Producer")
 		os.Exit(-1)
 	}
+	defer kafkaProducer.Close()
+	go func() {
+		for e := range kafkaProducer.Events() {
+			switch ev := e.(type) {
+			case *kafka.Message:
+				if ev.TopicPartition.Error != nil {
+					logger.Errorf("Delivery failed: %v\n", ev.TopicPartition)
+				} else {
+					logger.Debugf("Delivered message to %v\n", ev.TopicPartition)
+				}
+			}
+		}
+	}()
 
 	e := common.GetNewEcho(logger)
 	e.Use(middleware.Recover())
@@ -70,28 +109,69 @@ func main() {
 	}
 
 	// Ensure tables
-	_ = db.AutoMigrate(&User{}, &AccountLog{})
+	_ = db.AutoMigrate(&User{}, &AccountLog{}, &common.OutboxMessage{}, &common.OutboxLease{}, &common.DeadLetter{}, &common.ProcessedEvent{})
+
+	err = schema.UseRegistry(schemaRegistryUrl)
+	if err != nil {
+		logger.Fatalf("Failed to connect to schema registry: %s", err.Error())
+		os.Exit(-1)
+	}
 
 	app := anSvc{
-		logger:     logger,
-		anDb:       db,
-		authServer: common.EnsureServerProtocol(authServer),
-		authHttpClient: &http.Client{
-			Transport: &http.Transport{
-				//TLSClientConfig: tlsConfig,
-			},
+		logger:        logger,
+		anDb:          db,
+		eventConsumer: common.NewEventConsumer("Analytics", kafkaConsumer, db, logger),
+	}
+	app.registerEventHandlers(app.eventConsumer)
+
+	retryPolicy, err := common.RetryPolicyFromEnv("ATES_AN")
+	if err != nil {
+		logger.Fatalf("Failed to read retry policy: %s", err.Error())
+		os.Exit(-1)
+	}
+	app.eventConsumer.SetRetryPolicy(retryPolicy)
+
+	err = app.eventConsumer.Subscribe([]string{"user.lifecycle", "accountlog.lifecycle"})
+	if err != nil {
+		logger.Fatalf("Failed to subscribe to necessary Kafka topics")
+		os.Exit(-1)
+	}
+
+	// permission matrix maps actions to roles and scopes, ATES_PERMISSIONS is path of JSON file
+	permissions, err := common.LoadPermissions(os.Getenv("ATES_PERMISSIONS"))
+	if err != nil {
+		logger.Fatalf("Failed to load permissions: %s", err.Error())
+		os.Exit(-1)
+	}
+
+	// access tokens are verified locally with keys of Auth, so requests are served while Auth is down;
+	// verified tokens are cached for TTL. Auth introspects tokens of users not synced yet and of AllowFresh routes.
+	authClient := &http.Client{
+		Transport: &http.Transport{
+			//TLSClientConfig: tlsConfig,
 		},
-		kafkaConsumer: kafkaConsumer,
 	}
+	auth := common.NewAuthenticator(common.NewJWTVerifier(authServer, authClient),
+		common.NewUserLookup(db, nil, logger), permissions, 30*time.Second, logger)
+	auth.SetIntrospector(common.NewIntrospectionVerifier(authServer, clientID, clientSecret, authClient))
+
+	e.GET("/analytics/today", app.getToday, auth.Allow("analytics.read"))
+	e.GET("/analytics/expensive/:dayFrom", app.getExpensive, auth.Allow("analytics.read"))
+	e.GET("/analytics/expensive/:dayFrom/:dayTo", app.getExpensive, auth.Allow("analytics.read"))
 
-	e.GET("/analytics/today", app.getToday)
-	e.GET("/analytics/expensive/:dayFrom", app.getExpensive)
-	e.GET("/analytics/expensive/:dayFrom/:dayTo", app.getExpensive)
+	e.GET("/admin/dlq", app.eventConsumer.ListDeadLettersHandler(), auth.Allow("dlq.manage"))
+	e.POST("/admin/dlq/:id/redrive", app.eventConsumer.RedriveDeadLetterHandler(), auth.AllowFresh("dlq.manage"))
 
-	abortReadCh := make(chan bool)
-	go app.startReadingNotification(abortReadCh)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go common.NewOutboxRelay(db, kafkaProducer, logger).Run(ctx)
 
-	e.Logger.Fatal(e.Start(webAddress))
+	consumerDone := make(chan struct{})
+	go func() {
+		app.eventConsumer.Run(ctx)
+		close(consumerDone)
+	}()
 
-	abortReadCh <- true
+	common.StartEcho(ctx, e, webAddress, logger)
+	<-consumerDone
 }
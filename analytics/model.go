@@ -1,34 +1,39 @@
 package main
 
 import (
+	"ates/common"
 	"ates/schema"
+	"ates/schema/events"
 	"gorm.io/gorm"
 )
 
-type AuthVerification struct {
-	PublicId string `json:"sub"`
-}
-
 type AccountLog struct {
 	gorm.Model
-	LogID           int                         `gorm:"logId" avro:"logId"`
-	UserID          int                         `avro:"userId"`
-	TaskID          int                         `avro:"taskId"`
-	BillingCycleID  int                         `avro:"billingCycleId"`
-	OperationTypeID schema.AccountOperationType `avro:"operationId"`
-	Debit           int                         `avro:"debit"`
-	Credit          int                         `avro:"credit"`
-	Balance         int                         `avro:"balance"`
+	LogID           int
+	UserID          int
+	TaskID          int
+	BillingCycleID  int
+	OperationTypeID schema.AccountOperationType
+	Debit           int
+	Credit          int
+	Balance         int
 }
 
-// User is synced, source is "auth"
-type User struct {
-	gorm.Model `json:"-"`
-	PublicId   string          `json:"uid" avro:"uid"`
-	Login      string          `json:"login" avro:"login"`
-	RoleID     schema.UserRole `json:"roleId" avro:"roleId"`
+// fromEvent sets attributes of AccountLog from event, local identifier is kept
+func (a *AccountLog) fromEvent(e events.AccountLog) {
+	a.LogID = e.LogId
+	a.UserID = e.UserId
+	a.TaskID = e.TaskId
+	a.BillingCycleID = e.BillingCycleId
+	a.OperationTypeID = schema.AccountOperationType(e.OperationId)
+	a.Debit = e.Debit
+	a.Credit = e.Credit
+	a.Balance = e.Balance
 }
 
+// User is synced, source is "auth"
+type User = common.User
+
 type TodayMetrics struct {
 	ManagementProfit         int `json:"managementProfit"`
 	UsersWithNegativeBalance int `json:"usersWithNegativeBalance"`
@@ -2,62 +2,23 @@ package main
 
 import (
 	"ates/common"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"sync"
-	"time"
+	"context"
+	"gorm.io/gorm"
 )
 
-// startReadingNotification reads topics from Kafka
-func (svc *anSvc) startReadingNotification(abortCh <-chan bool) {
-	defer func() {
-		_ = svc.kafkaConsumer.Close()
-	}()
-
-	run := true
-	runMx := &sync.Mutex{}
-
-	go func() {
-		for run {
-			msg, err := svc.kafkaConsumer.ReadMessage(time.Second)
-			if err != nil {
-				if err.(kafka.Error).IsTimeout() {
-					continue
-				}
-				svc.logger.Error(err)
-				continue
-				//return
-			}
-
-			eventType, err := common.GetKafkaHeader(msg, "event")
-			if err != nil {
-				svc.logger.Infof("missing event header in the message %s, skipping", msg.Key)
-				continue
-			}
-
-			switch eventType {
-			case "User.Created":
-				err = svc.createUser(msg.Value)
-			case "AccountLog.Created":
-				err = svc.createAccountLog(msg.Value)
-			case "AccountLog.Updated":
-				err = svc.updateAccountLog(msg.Value)
-			}
-			if err != nil {
-				svc.logger.Errorf("Failed to process notification on %s: %s", eventType, err.Error())
-				continue
-			}
-
-		}
-	}()
-
-	for {
-		select {
-		case _ = <-abortCh:
-			runMx.Lock()
-			run = false
-			runMx.Unlock()
-			return
-		}
+// registerEventHandlers binds consumed events to service functions
+func (svc *anSvc) registerEventHandlers(c *common.EventConsumer) {
+	// every User event carries the whole user, older versions are upcasted to the latest one
+	for _, name := range []string{"User.Created", "User.Updated", "User.Deleted"} {
+		c.Handle(name, "", func(_ context.Context, tx *gorm.DB, e *common.Event) error {
+			return svc.saveUser(tx, e.Payload)
+		})
 	}
-
+	// handlers take any version of AccountLog, payload is read with the latest schema
+	c.Handle("AccountLog.Created", "", func(_ context.Context, tx *gorm.DB, e *common.Event) error {
+		return svc.createAccountLog(tx, e.Payload)
+	})
+	c.Handle("AccountLog.Updated", "", func(_ context.Context, tx *gorm.DB, e *common.Event) error {
+		return svc.updateAccountLog(tx, e.Payload)
+	})
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-oauth2/oauth2/v4"
+	oauthErrors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/go-oauth2/oauth2/v4/server"
+	"github.com/labstack/echo/v4"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// authorizeParams are parameters of authorization request, login page passes them back in hidden fields
+var authorizeParams = []string{"response_type", "client_id", "redirect_uri", "state", "scope",
+	"code_challenge", "code_challenge_method"}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>aTES - Sign in</title></head>
+<body>
+<h1>Sign in to aTES</h1>
+<p>Application <b>{{.ClientID}}</b> requests access to your account.</p>
+{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<p><label>Login <input name="login" autocomplete="username" required autofocus></label></p>
+<p><label>Password <input name="password" type="password" autocomplete="current-password" required></label></p>
+<p><label>One-time code <input name="otp" inputmode="numeric" autocomplete="one-time-code"></label> (if two-factor authentication is on)</p>
+<p><button name="consent" value="allow">Allow</button> <button name="consent" value="deny" formnovalidate>Deny</button></p>
+</form>
+</body>
+</html>
+`))
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>aTES - Authorization error</title></head>
+<body>
+<h1>Authorization error</h1>
+<p>{{.}}</p>
+</body>
+</html>
+`))
+
+// authorize handles authorization code flow with PKCE:
+// GET /oauth/authorize?response_type=code&client_id=web&redirect_uri=...&state=...&code_challenge=...&code_challenge_method=S256
+// renders login and consent page, which posts credentials back. Then user agent is redirected to redirect_uri
+// with code, and client exchanges it with code_verifier:
+// POST /oauth/token grant_type=authorization_code&code=CODE&redirect_uri=...&client_id=web&code_verifier=...
+func (svc *authSvc) authorize(c echo.Context) error {
+	r := c.Request()
+	w := c.Response().Writer
+	// login page must not be framed by other sites
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+
+	err := r.ParseForm()
+	if err != nil {
+		return renderAuthorizeError(w, "Bad request")
+	}
+	r = r.WithContext(withClientIP(r.Context(), c.RealIP()))
+
+	// errors are redirected to redirect_uri of the client, so client and redirect_uri are checked first,
+	// and the user sees the error page if they are wrong
+	client, err := svc.oauthServer.Manager.GetClient(r.Context(), r.Form.Get("client_id"))
+	if err != nil || client == nil || client.GetID() == "" {
+		return renderAuthorizeError(w, "Unknown client")
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	if redirectURI == "" {
+		redirectURI = client.GetDomain()
+		r.Form.Set("redirect_uri", redirectURI)
+	}
+	err = validateRedirectURI(client.GetDomain(), redirectURI)
+	if err != nil {
+		svc.logger.Warnf("Client %s requested authorization with bad redirect uri %s", client.GetID(), redirectURI)
+		return renderAuthorizeError(w, "Redirect URI is not registered for the client")
+	}
+
+	err = svc.oauthServer.HandleAuthorizeRequest(w, r)
+	if err != nil {
+		svc.logger.Error(err)
+		return renderAuthorizeError(w, "Bad authorization request")
+	}
+	return nil
+}
+
+// authorizeUser returns user who has signed in on the login page and allowed access to the client.
+// Login page is rendered, and empty user is returned, if user hasn't signed in yet.
+func (svc *authSvc) authorizeUser(w http.ResponseWriter, r *http.Request) (string, error) {
+	if r.Method != http.MethodPost {
+		svc.renderLogin(w, r, "")
+		return "", nil
+	}
+	if r.PostFormValue("consent") != "allow" {
+		return "", oauthErrors.ErrAccessDenied
+	}
+
+	ctx := withSecondFactor(r.Context(), r.PostFormValue("otp"))
+	userID, err := svc.checkPassword(ctx, r.FormValue("client_id"),
+		r.PostFormValue("login"), r.PostFormValue("password"))
+	var te *throttledError
+	if errors.As(err, &te) {
+		svc.renderLogin(w, r, "Too many failed attempts, try again in "+te.retryAfter.Round(time.Second).String())
+		return "", nil
+	}
+	var tfe *twoFactorError
+	if errors.As(err, &tfe) {
+		svc.renderLogin(w, r, tfe.description)
+		return "", nil
+	}
+	if err != nil {
+		svc.renderLogin(w, r, "Invalid login or password")
+		return "", nil
+	}
+	return userID, nil
+}
+
+// requirePKCE lets browser clients use only authorization code flow, and they must prove it with PKCE S256.
+// Missing code_challenge_method means plain, so it is refused too.
+func requirePKCE(srv *server.Server) {
+	srv.Config.ForcePKCE = true
+	srv.Config.AllowedResponseTypes = []oauth2.ResponseType{oauth2.Code}
+	srv.Config.AllowedCodeChallengeMethods = []oauth2.CodeChallengeMethod{oauth2.CodeChallengeS256}
+}
+
+// validateRedirectURI checks that redirect URI is the URI registered in Domain of the client, or is under its path
+func validateRedirectURI(baseURI string, redirectURI string) error {
+	base, err := url.Parse(baseURI)
+	if err != nil {
+		return err
+	}
+	redirect, err := url.Parse(redirectURI)
+	if err != nil {
+		return err
+	}
+	if !redirect.IsAbs() || redirect.Fragment != "" || redirect.User != nil {
+		return oauthErrors.ErrInvalidRedirectURI
+	}
+	if !strings.EqualFold(redirect.Scheme, base.Scheme) || !strings.EqualFold(redirect.Host, base.Host) {
+		return oauthErrors.ErrInvalidRedirectURI
+	}
+	basePath := strings.TrimSuffix(base.Path, "/")
+	if redirect.Path != basePath && !strings.HasPrefix(redirect.Path, basePath+"/") {
+		return oauthErrors.ErrInvalidRedirectURI
+	}
+	// dot segments are resolved by browsers, also after percent-decoding, and backslash is taken as slash
+	if strings.Contains(redirect.Path, `\`) {
+		return oauthErrors.ErrInvalidRedirectURI
+	}
+	for _, segment := range strings.Split(redirect.Path, "/") {
+		if segment == "." || segment == ".." {
+			return oauthErrors.ErrInvalidRedirectURI
+		}
+	}
+	return nil
+}
+
+// renderLogin renders login and consent page with parameters of authorization request
+func (svc *authSvc) renderLogin(w http.ResponseWriter, r *http.Request, errorText string) {
+	params := map[string]string{}
+	for _, name := range authorizeParams {
+		if v := r.Form.Get(name); v != "" {
+			params[name] = v
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if errorText != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	err := loginPage.Execute(w, struct {
+		ClientID string
+		Error    string
+		Params   map[string]string
+	}{r.Form.Get("client_id"), errorText, params})
+	if err != nil {
+		svc.logger.Error(err)
+	}
+}
+
+func renderAuthorizeError(w http.ResponseWriter, text string) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	return errorPage.Execute(w, text)
+}
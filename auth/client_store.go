@@ -5,23 +5,115 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/go-oauth2/oauth2/v4"
-	"github.com/go-oauth2/oauth2/v4/models"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type ClientStoreItem struct {
 	ID        string
-	Secret    string `gorm:"type:varchar(512)"`
-	Domain    string `gorm:"type:varchar(512)"`
-	Data      string `gorm:"type:text"`
+	Secret    string `gorm:"type:varchar(512)"` // bcrypt hash of secret, empty for public client
+	Domain    string `gorm:"type:varchar(512)"` // registered redirect URI
+	Data      string `gorm:"type:text"`         // json-encoded ClientData
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
+// ClientData is settings of client, which are kept in ClientStoreItem.Data
+type ClientData struct {
+	GrantTypes []oauth2.GrantType `json:"grantTypes"`
+	Scopes     []string           `json:"scopes"`
+}
+
+// defaultGrantTypes are allowed for clients which were registered without grant types
+var defaultGrantTypes = []oauth2.GrantType{oauth2.AuthorizationCode, oauth2.PasswordCredentials, oauth2.Refreshing}
+
+// Client is OAuth client, its secret is checked against bcrypt hash
+type Client struct {
+	ID         string
+	SecretHash string
+	Domain     string
+	ClientData
+}
+
+func (c *Client) GetID() string {
+	return c.ID
+}
+
+// GetSecret returns nothing: only hash of secret is known, use VerifyPassword
+func (c *Client) GetSecret() string {
+	return ""
+}
+
+func (c *Client) GetDomain() string {
+	return c.Domain
+}
+
+// IsPublic is true for client without secret, e.g. browser application
+func (c *Client) IsPublic() bool {
+	return c.SecretHash == ""
+}
+
+func (c *Client) GetUserID() string {
+	return ""
+}
+
+// VerifyPassword checks client secret
+func (c *Client) VerifyPassword(secret string) bool {
+	if c.SecretHash == "" {
+		return secret == ""
+	}
+	return bcrypt.CompareHashAndPassword([]byte(c.SecretHash), []byte(secret)) == nil
+}
+
+// AllowsGrant checks that client can get tokens with grant type. Public client never gets
+// password and client_credentials grants, even if they are set in its data by hand
+func (c *Client) AllowsGrant(grant oauth2.GrantType) bool {
+	if c.IsPublic() && (grant == oauth2.PasswordCredentials || grant == oauth2.ClientCredentials) {
+		return false
+	}
+	grantTypes := c.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = defaultGrantTypes
+	}
+	for _, g := range grantTypes {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsScope checks that every scope of space-delimited list is allowed for client
+func (c *Client) AllowsScope(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		allowed := false
+		for _, cs := range c.Scopes {
+			if cs == s {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// hashClientSecret returns bcrypt hash of secret, or empty string for public client
+func hashClientSecret(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
 func NewClientStore(db *gorm.DB) *ClientStore {
 	s, err := db.DB()
 	if err != nil {
@@ -41,6 +133,9 @@ func NewClientStore(db *gorm.DB) *ClientStore {
 			panic(err)
 		}
 	}
+	if err := store.hashPlainSecrets(); err != nil {
+		panic(err)
+	}
 
 	return store
 }
@@ -51,34 +146,152 @@ type ClientStore struct {
 	stdout    io.Writer
 }
 
-func (s *ClientStore) GetByID(ctx context.Context, id string) (oauth2.ClientInfo, error) {
+// hashPlainSecrets replaces plaintext secrets of clients inserted by hand with hashes,
+// and drops copy of secret from Data of clients created with models.Client. Public clients have
+// no secret, they are left as they are
+func (s *ClientStore) hashPlainSecrets() error {
+	var items []ClientStoreItem
+	err := s.db.Table(s.tableName).Unscoped().Where("secret <> '' and secret not like ?", "$2%").
+		Find(&items).Error
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		hash, err := hashClientSecret(item.Secret)
+		if err != nil {
+			return err
+		}
+		var data ClientData
+		_ = json.Unmarshal([]byte(item.Data), &data)
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		err = s.db.Table(s.tableName).Unscoped().Where("id = ?", item.ID).
+			Updates(map[string]interface{}{"secret": hash, "data": string(b)}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ClientStore) toClient(item ClientStoreItem) (*Client, error) {
+	c := &Client{
+		ID:         item.ID,
+		SecretHash: item.Secret,
+		Domain:     item.Domain,
+	}
+	if item.Data != "" {
+		err := json.Unmarshal([]byte(item.Data), &c.ClientData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Get returns not deleted client, or nil if it is not found
+func (s *ClientStore) Get(ctx context.Context, id string) (*Client, error) {
 	if id == "" {
 		return nil, nil
 	}
 	var item ClientStoreItem
-	err := s.db.WithContext(ctx).Table(s.tableName).Limit(1).Find(&item, "id = ?", id).Error
-	if err != nil {
+	result := s.db.WithContext(ctx).Table(s.tableName).Limit(1).Find(&item, "id = ?", id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return s.toClient(item)
+}
+
+func (s *ClientStore) GetByID(ctx context.Context, id string) (oauth2.ClientInfo, error) {
+	c, err := s.Get(ctx, id)
+	if err != nil || c == nil {
+		// manager expects nil interface for unknown client
 		return nil, err
 	}
+	return c, nil
+}
 
-	return &models.Client{
-		ID:     item.ID,
-		Secret: item.Secret,
-		Domain: item.Domain,
-	}, nil
+// Exists checks that client id is taken, by deleted client too
+func (s *ClientStore) Exists(ctx context.Context, id string) (bool, error) {
+	var n int64
+	err := s.db.WithContext(ctx).Table(s.tableName).Unscoped().Where("id = ?", id).Count(&n).Error
+	return n > 0, err
 }
 
-func (s *ClientStore) Create(ctx context.Context, info oauth2.ClientInfo) error {
-	data, err := json.Marshal(info)
+// List returns all not deleted clients
+func (s *ClientStore) List(ctx context.Context) ([]*Client, error) {
+	var items []ClientStoreItem
+	err := s.db.WithContext(ctx).Table(s.tableName).Order("created_at").Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	clients := make([]*Client, 0, len(items))
+	for _, item := range items {
+		c, err := s.toClient(item)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// Create saves new client, secret must be already hashed
+func (s *ClientStore) Create(ctx context.Context, c *Client) error {
+	data, err := json.Marshal(c.ClientData)
 	if err != nil {
 		return err
 	}
 	item := &ClientStoreItem{
-		ID:     info.GetID(),
-		Secret: info.GetSecret(),
-		Domain: info.GetDomain(),
+		ID:     c.ID,
+		Secret: c.SecretHash,
+		Domain: c.Domain,
 		Data:   string(data),
 	}
 
 	return s.db.WithContext(ctx).Table(s.tableName).Create(item).Error
 }
+
+// Update saves domain and settings of client
+func (s *ClientStore) Update(ctx context.Context, c *Client) error {
+	data, err := json.Marshal(c.ClientData)
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Table(s.tableName).Where("id = ?", c.ID).
+		Updates(map[string]interface{}{"domain": c.Domain, "data": string(data), "updated_at": time.Now()}).Error
+}
+
+// SetSecret replaces hash of client secret
+func (s *ClientStore) SetSecret(ctx context.Context, id, secretHash string) error {
+	return s.db.WithContext(ctx).Table(s.tableName).Where("id = ?", id).
+		Updates(map[string]interface{}{"secret": secretHash, "updated_at": time.Now()}).Error
+}
+
+// Delete soft-deletes client within transaction tx
+func (s *ClientStore) Delete(tx *gorm.DB, id string) error {
+	return tx.Table(s.tableName).Where("id = ?", id).Delete(&ClientStoreItem{}).Error
+}
+
+// AllowsGrant is ClientAuthorizedHandler of server, it checks grant types of client
+func (s *ClientStore) AllowsGrant(clientID string, grant oauth2.GrantType) (bool, error) {
+	c, err := s.Get(context.Background(), clientID)
+	if err != nil || c == nil {
+		return false, err
+	}
+	return c.AllowsGrant(grant), nil
+}
+
+// AllowsScope is ClientScopeHandler of server, it checks requested scope against scopes of client
+func (s *ClientStore) AllowsScope(tgr *oauth2.TokenGenerateRequest) (bool, error) {
+	c, err := s.Get(context.Background(), tgr.ClientID)
+	if err != nil || c == nil {
+		return false, err
+	}
+	return c.AllowsScope(tgr.Scope), nil
+}
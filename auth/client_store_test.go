@@ -0,0 +1,124 @@
+package main
+
+import (
+	"ates/common/testutil"
+	"ates/schema"
+	"context"
+	"github.com/go-oauth2/oauth2/v4"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestClientRequestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		req  clientRequest
+		ok   bool
+	}{
+		{"confidential", clientRequest{GrantTypes: []oauth2.GrantType{oauth2.PasswordCredentials,
+			oauth2.ClientCredentials, oauth2.Refreshing}}, true},
+		{"public with code", clientRequest{Domain: "https://app.example.com/cb", Public: true,
+			GrantTypes: []oauth2.GrantType{oauth2.AuthorizationCode, oauth2.Refreshing}}, true},
+		{"public with password", clientRequest{Public: true,
+			GrantTypes: []oauth2.GrantType{oauth2.PasswordCredentials}}, false},
+		{"public with client_credentials", clientRequest{Public: true,
+			GrantTypes: []oauth2.GrantType{oauth2.ClientCredentials}}, false},
+		{"no grant types", clientRequest{}, false},
+		{"unknown grant type", clientRequest{GrantTypes: []oauth2.GrantType{"implicit"}}, false},
+		{"code without domain", clientRequest{GrantTypes: []oauth2.GrantType{oauth2.AuthorizationCode}}, false},
+		{"relative domain", clientRequest{Domain: "/cb", GrantTypes: []oauth2.GrantType{oauth2.AuthorizationCode}}, false},
+		{"unknown scope", clientRequest{GrantTypes: []oauth2.GrantType{oauth2.ClientCredentials},
+			Scopes: []string{"tasks:delete"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.req.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestClientAllowsGrant(t *testing.T) {
+	public := &Client{ID: "spa", ClientData: ClientData{GrantTypes: []oauth2.GrantType{oauth2.AuthorizationCode,
+		oauth2.PasswordCredentials, oauth2.ClientCredentials}}}
+	legacy := &Client{ID: "old"} // public client without grant types gets the default ones
+	confidential := &Client{ID: "web", SecretHash: "$2a$10$hash"}
+	tests := []struct {
+		client *Client
+		grant  oauth2.GrantType
+		want   bool
+	}{
+		{public, oauth2.AuthorizationCode, true},
+		{public, oauth2.PasswordCredentials, false},
+		{public, oauth2.ClientCredentials, false},
+		{legacy, oauth2.AuthorizationCode, true},
+		{legacy, oauth2.PasswordCredentials, false},
+		{confidential, oauth2.PasswordCredentials, true},
+		{confidential, oauth2.ClientCredentials, false},
+	}
+	for _, tt := range tests {
+		if got := tt.client.AllowsGrant(tt.grant); got != tt.want {
+			t.Errorf("client %s AllowsGrant(%s) = %v, want %v", tt.client.ID, tt.grant, got, tt.want)
+		}
+	}
+}
+
+func TestHashPlainSecrets(t *testing.T) {
+	db := testutil.OpenDB(t)
+	store := NewClientStore(db)
+	// client store widens the pool, but every connection has its own in-memory database
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	hashed, err := hashClientSecret("hashed-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []ClientStoreItem{
+		{ID: "plain", Secret: "plain-secret", Data: `{"ID":"plain","Secret":"plain-secret","grantTypes":["password"]}`},
+		{ID: "hashed", Secret: hashed, Data: `{"grantTypes":["password"]}`},
+		{ID: "public", Data: `{"grantTypes":["authorization_code"],"note":"kept"}`},
+	}
+	for _, item := range items {
+		if err = db.Table(store.tableName).Create(&item).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = store.hashPlainSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	plain, _ := store.Get(ctx, "plain")
+	if plain == nil || plain.SecretHash == "plain-secret" || !plain.VerifyPassword("plain-secret") {
+		t.Errorf("plaintext secret is not hashed: %+v", plain)
+	}
+	var item ClientStoreItem
+	db.Table(store.tableName).First(&item, "id = ?", "plain")
+	if strings.Contains(item.Data, "plain-secret") {
+		t.Errorf("copy of secret is left in data: %s", item.Data)
+	}
+	if c, _ := store.Get(ctx, "hashed"); c == nil || c.SecretHash != hashed {
+		t.Errorf("hashed secret is changed: %+v", c)
+	}
+	item = ClientStoreItem{}
+	db.Table(store.tableName).First(&item, "id = ?", "public")
+	if item.Secret != "" || item.Data != items[2].Data {
+		t.Errorf("public client is rewritten: %+v", item)
+	}
+}
+
+func TestPasswordGrantOfPublicClient(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "spa", "", oauth2.PasswordCredentials, oauth2.Refreshing)
+
+	code, res := requestToken(t, e, url.Values{"grant_type": {"password"}, "client_id": {"spa"},
+		"username": {"popug"}, "password": {"secret"}})
+	if code == http.StatusOK || res.AccessToken != "" {
+		t.Errorf("public client got token with password grant: %d %+v", code, res)
+	}
+}
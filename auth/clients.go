@@ -0,0 +1,274 @@
+package main
+
+import (
+	"ates/common"
+	"ates/schema"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"net/http"
+	"net/url"
+)
+
+// clientRequest is body of create and update requests of OAuth client
+type clientRequest struct {
+	ID         string             `json:"id"`
+	Domain     string             `json:"domain"`
+	GrantTypes []oauth2.GrantType `json:"grantTypes"`
+	Scopes     []string           `json:"scopes"`
+	Public     bool               `json:"public"` // public client has no secret, e.g. browser application with PKCE
+}
+
+// clientResponse shows client to admin, secret is shown only once, on creation and rotation
+type clientResponse struct {
+	ID         string             `json:"id"`
+	Domain     string             `json:"domain"`
+	GrantTypes []oauth2.GrantType `json:"grantTypes"`
+	Scopes     []string           `json:"scopes"`
+	Public     bool               `json:"public"`
+	Secret     string             `json:"secret,omitempty"`
+}
+
+func toClientResponse(c *Client, secret string) clientResponse {
+	return clientResponse{
+		ID:         c.ID,
+		Domain:     c.Domain,
+		GrantTypes: c.GrantTypes,
+		Scopes:     c.Scopes,
+		Public:     c.IsPublic(),
+		Secret:     secret,
+	}
+}
+
+var knownGrantTypes = map[oauth2.GrantType]bool{
+	oauth2.AuthorizationCode:   true,
+	oauth2.PasswordCredentials: true,
+	oauth2.ClientCredentials:   true,
+	oauth2.Refreshing:          true,
+}
+
+// knownScopes are permissions, which services check for service accounts
+var knownScopes = map[string]bool{
+	schema.ScopeCloseDay:      true,
+	schema.ScopeReassignTasks: true,
+}
+
+// validate checks settings of client
+func (r *clientRequest) validate() error {
+	if len(r.GrantTypes) == 0 {
+		return errors.New("grant types must be set")
+	}
+	for _, g := range r.GrantTypes {
+		if !knownGrantTypes[g] {
+			return fmt.Errorf("unknown grant type %s", g)
+		}
+		if (g == oauth2.ClientCredentials || g == oauth2.PasswordCredentials) && r.Public {
+			return fmt.Errorf("public client can't use %s", g)
+		}
+		if g == oauth2.AuthorizationCode && r.Domain == "" {
+			return errors.New("domain (redirect URI) must be set for authorization_code")
+		}
+	}
+	for _, s := range r.Scopes {
+		if !knownScopes[s] {
+			return fmt.Errorf("unknown scope %s", s)
+		}
+	}
+	if r.Domain != "" {
+		u, err := url.Parse(r.Domain)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			return errors.New("domain must be absolute URI without fragment")
+		}
+	}
+	return nil
+}
+
+// newClientSecret generates random secret of client
+func newClientSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// listClients renders all OAuth clients
+func (svc *authSvc) listClients(c echo.Context) error {
+	clients, err := svc.clients.List(c.Request().Context())
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	res := make([]clientResponse, 0, len(clients))
+	for _, client := range clients {
+		res = append(res, toClientResponse(client, ""))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// getClient renders OAuth client with id from path
+func (svc *authSvc) getClient(c echo.Context) error {
+	client, err := svc.clients.Get(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if client == nil {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "client not found"))
+	}
+	return c.JSON(http.StatusOK, toClientResponse(client, ""))
+}
+
+// createClient registers OAuth client, generated secret is returned only in this response
+func (svc *authSvc) createClient(c echo.Context) error {
+	var req clientRequest
+	err := c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "bad request"))
+	}
+	err = req.validate()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", err.Error()))
+	}
+	if req.ID == "" {
+		req.ID = uuid.NewString()
+	}
+
+	client := &Client{
+		ID:     req.ID,
+		Domain: req.Domain,
+		ClientData: ClientData{
+			GrantTypes: req.GrantTypes,
+			Scopes:     req.Scopes,
+		},
+	}
+	secret := ""
+	if !req.Public {
+		secret, err = newClientSecret()
+		if err == nil {
+			client.SecretHash, err = hashClientSecret(secret)
+		}
+		if err != nil {
+			svc.logger.Error(err)
+			return c.JSON(http.StatusInternalServerError, nil)
+		}
+	}
+
+	ctx := c.Request().Context()
+	exists, err := svc.clients.Exists(ctx, req.ID)
+	if err == nil && exists {
+		return c.JSON(http.StatusConflict, common.FromKeysAndValues("error", "client id is taken"))
+	}
+	if err == nil {
+		err = svc.clients.Create(ctx, client)
+	}
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError,
+			common.FromKeysAndValues("error", "failed to create client"))
+	}
+	svc.logger.Infof("Client %s is created by %s", client.ID, common.CurrentUser(c).PublicId)
+	return c.JSON(http.StatusOK, toClientResponse(client, secret))
+}
+
+// updateClient changes domain, grant types and scopes of client. Secret is changed by rotateClientSecret.
+func (svc *authSvc) updateClient(c echo.Context) error {
+	ctx := c.Request().Context()
+	client, err := svc.clients.Get(ctx, c.Param("id"))
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if client == nil {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "client not found"))
+	}
+
+	var req clientRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "bad request"))
+	}
+	req.Public = client.IsPublic()
+	err = req.validate()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", err.Error()))
+	}
+
+	client.Domain = req.Domain
+	client.GrantTypes = req.GrantTypes
+	client.Scopes = req.Scopes
+	err = svc.clients.Update(ctx, client)
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	svc.logger.Infof("Client %s is updated by %s", client.ID, common.CurrentUser(c).PublicId)
+	return c.JSON(http.StatusOK, toClientResponse(client, ""))
+}
+
+// rotateClientSecret generates new secret of confidential client, the old one stops working at once
+func (svc *authSvc) rotateClientSecret(c echo.Context) error {
+	ctx := c.Request().Context()
+	client, err := svc.clients.Get(ctx, c.Param("id"))
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if client == nil {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "client not found"))
+	}
+	if client.IsPublic() {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "public client has no secret"))
+	}
+
+	secret, err := newClientSecret()
+	if err == nil {
+		client.SecretHash, err = hashClientSecret(secret)
+	}
+	if err == nil {
+		err = svc.clients.SetSecret(ctx, client.ID, client.SecretHash)
+	}
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	svc.logger.Infof("Secret of client %s is rotated by %s", client.ID, common.CurrentUser(c).PublicId)
+	return c.JSON(http.StatusOK, toClientResponse(client, secret))
+}
+
+// deleteClient soft-deletes client and revokes its tokens
+func (svc *authSvc) deleteClient(c echo.Context) error {
+	ctx := c.Request().Context()
+	client, err := svc.clients.Get(ctx, c.Param("id"))
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if client == nil {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "client not found"))
+	}
+
+	err = svc.userDb.Transaction(func(tx *gorm.DB) error {
+		err := svc.clients.Delete(tx, client.ID)
+		if err != nil {
+			return err
+		}
+		items, err := svc.tokens.revokeClient(tx, client.ID)
+		if err != nil {
+			return err
+		}
+		return svc.notifyLogout(ctx, tx, items, "client_deleted")
+	})
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	svc.logger.Infof("Client %s is deleted by %s", client.ID, common.CurrentUser(c).PublicId)
+	return c.NoContent(http.StatusOK)
+}
@@ -2,85 +2,519 @@ package main
 
 import (
 	"ates/common"
+	"ates/schema"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/go-oauth2/oauth2/v4"
+	oauthErrors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4/server"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
-// registerUser reads user data from request body and registers new user
+// registerUser reads user data from request body and registers new user.
+// Everybody can register as User: kind of self-registration. Other roles are provisioned by admin, see provisionUser.
 func (svc *authSvc) registerUser(c echo.Context) error {
+	u, err := readNewUser(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", err.Error()))
+	}
+	if u.RoleID != 0 && u.RoleID != schema.RoleUser {
+		return c.JSON(http.StatusForbidden,
+			common.FromKeysAndValues("error", "only role User can self-register, ask admin for other roles"))
+	}
+	u.RoleID = schema.RoleUser
 
-	// Everybody can add User: kind of self-registration
-	// todo: only users can self-register, need AuthZ for adding another roles
-
-	body, err := io.ReadAll(c.Request().Body)
+	userFromDb, err := svc.createUser(c.Request().Context(), u)
 	if err != nil {
 		svc.logger.Error(err)
-		return c.JSON(http.StatusBadRequest, nil)
+		return c.JSON(http.StatusInternalServerError,
+			common.FromKeysAndValues("error", "failed to create user"))
 	}
+	return c.JSON(http.StatusOK, userFromDb)
+}
 
-	var u User
-	err = json.Unmarshal(body, &u)
+// provisionUser registers new user with any role, admin only
+func (svc *authSvc) provisionUser(c echo.Context) error {
+	u, err := readNewUser(c)
 	if err != nil {
-		svc.logger.Error(err)
-		return c.JSON(http.StatusBadRequest, nil)
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", err.Error()))
+	}
+	if u.RoleID == 0 {
+		u.RoleID = schema.RoleUser
+	}
+	var n int64
+	svc.userDb.Model(&Role{}).Where("id = ?", u.RoleID).Count(&n)
+	if n == 0 {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "unknown role"))
 	}
 
-	if u.Login == "" || u.Password == "" {
+	userFromDb, err := svc.createUser(c.Request().Context(), u)
+	if err != nil {
+		svc.logger.Error(err)
 		return c.JSON(http.StatusInternalServerError,
-			common.FromKeysAndValues("error", "must provide both login and password"))
+			common.FromKeysAndValues("error", "failed to create user"))
 	}
+	svc.logger.Infof("User %s with role %d is created by %s", userFromDb.PublicId, userFromDb.RoleID,
+		common.CurrentUser(c).PublicId)
+	return c.JSON(http.StatusOK, userFromDb)
+}
 
-	if u.RoleID == 0 {
-		u.RoleID = 2 // User
-	}
+// newUserRequest is body of registration and provisioning requests. Public id, activity and hash are
+// not accepted from client, they are set by server
+type newUserRequest struct {
+	Login    string          `json:"login"`
+	Password string          `json:"password"`
+	RoleID   schema.UserRole `json:"roleId"`
+}
 
+// readNewUser reads login, password and role of new user from request body, and calculates hash of password
+func readNewUser(c echo.Context) (User, error) {
+	var u User
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return u, errors.New("failed to read request")
+	}
+	var req newUserRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return u, errors.New("bad request")
+	}
+	if req.Login == "" || req.Password == "" {
+		return u, errors.New("must provide both login and password")
+	}
+	u = User{Login: req.Login, Password: req.Password, RoleID: req.RoleID}
 	err = u.calculatePasswordHash()
 	if err != nil {
-		svc.logger.Error(err)
-		return c.JSON(http.StatusInternalServerError, nil)
+		return u, err
 	}
+	return u, nil
+}
 
-	result := svc.userDb.Create(&u)
-	if result.RowsAffected == 1 {
+// createUser saves new active user with generated public id and notifies about it
+func (svc *authSvc) createUser(ctx context.Context, u User) (User, error) {
+	u.PublicId = uuid.NewString()
+	u.Active = true
+	var userFromDb User
+	err := svc.userDb.Transaction(func(tx *gorm.DB) error {
 		// User creating could be failed if login is not unique (database constraint)
-		var userFromDb User
-		result = svc.userDb.First(&userFromDb, "login = ?", u.Login)
-
-		if result.RowsAffected == 1 {
-			go svc.notifyAsync("User.Created", userFromDb)
-			return c.JSON(http.StatusOK, userFromDb)
+		result := tx.Create(&u)
+		if result.RowsAffected != 1 {
+			return errors.New("failed to create user")
+		}
+		result = tx.First(&userFromDb, "login = ?", u.Login)
+		if result.RowsAffected != 1 {
+			return errors.New("failed to read created user")
 		}
+		return svc.notify(ctx, tx, "User.Created", userFromDb)
+	})
+	return userFromDb, err
+}
+
+// bootstrapAdmin creates the first admin on empty database, so there is somebody to provision other admins
+func (svc *authSvc) bootstrapAdmin(login, password string) error {
+	var n int64
+	err := svc.userDb.Unscoped().Model(&User{}).Count(&n).Error
+	if err != nil || n > 0 {
+		return err
+	}
+	if login == "" || password == "" {
+		svc.logger.Warn("There are no users, set ATES_AUTH_ADMIN_LOGIN and ATES_AUTH_ADMIN_PASSWORD to create admin")
+		return nil
 	}
 
-	return c.JSON(http.StatusInternalServerError,
-		common.FromKeysAndValues("error", "failed to create user"))
+	u := User{Login: login, Password: password, RoleID: schema.RoleAdmin}
+	err = u.calculatePasswordHash()
+	if err != nil {
+		return err
+	}
+	created, err := svc.createUser(context.Background(), u)
+	if err != nil {
+		// another replica could create admin at the same time
+		if svc.userDb.Model(&User{}).Where("login = ?", login).Count(&n); n > 0 {
+			return nil
+		}
+		return err
+	}
+	svc.logger.Infof("Admin %s is created from configuration", created.PublicId)
+	if !svc.twoFactorRoles[schema.RoleAdmin] {
+		return nil
+	}
+	// nobody else can issue enrollment token of the first admin, it is shown to operator once
+	token, expiresAt, err := issueEnrollmentToken(svc.userDb, created.PublicId, "")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(svc.console, "Enrollment token of two-factor authentication of admin %s, valid until %s: %s\n",
+		login, expiresAt.Format(time.RFC3339), token)
+	return err
 }
 
-func (svc *authSvc) deleteUser(c echo.Context) error {
-	panic("Not implemented")
+// userUpdate is body of user update request, only provided fields are changed
+type userUpdate struct {
+	Login           *string          `json:"login"`
+	Password        *string          `json:"password"`
+	CurrentPassword string           `json:"currentPassword"` // required when user changes own password
+	RoleID          *schema.UserRole `json:"roleId"`
+	Active          *bool            `json:"active"`
 }
 
+// updateUser changes login, password, role or activity of user with public id from path.
+// User can change own login and password, admin can change everything of other users.
+// Change of password and deactivation revoke all sessions of user.
 func (svc *authSvc) updateUser(c echo.Context) error {
-	panic("Not implemented")
+	me := common.CurrentUser(c)
+	uid := c.Param("uid")
+	isAdmin := svc.permissions.Allows("user.manage", me)
+	self := me.PublicId == uid
+	if !isAdmin && !self {
+		return c.JSON(http.StatusForbidden, common.FromKeysAndValues("error", "forbidden"))
+	}
+
+	var req userUpdate
+	err := c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "bad request"))
+	}
+	if !isAdmin && (req.RoleID != nil || req.Active != nil) {
+		return c.JSON(http.StatusForbidden, common.FromKeysAndValues("error", "only admin can change role and activity"))
+	}
+	if self && req.Active != nil && !*req.Active {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "can't deactivate yourself"))
+	}
+
+	var u User
+	result := svc.userDb.Where("public_id = ?", uid).Limit(1).Find(&u)
+	if result.RowsAffected != 1 {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "user not found"))
+	}
+
+	changes := map[string]interface{}{}
+	if req.Login != nil && *req.Login != u.Login {
+		if *req.Login == "" {
+			return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "login must not be empty"))
+		}
+		var n int64
+		svc.userDb.Unscoped().Model(&User{}).Where("login = ?", *req.Login).Count(&n)
+		if n > 0 {
+			return c.JSON(http.StatusConflict, common.FromKeysAndValues("error", "login is taken"))
+		}
+		u.Login = *req.Login
+		changes["login"] = u.Login
+	}
+	passwordChanged := false
+	if req.Password != nil {
+		if self {
+			if ok, _ := u.checkPassword(req.CurrentPassword); !ok {
+				return c.JSON(http.StatusForbidden, common.FromKeysAndValues("error", "current password is wrong"))
+			}
+		}
+		u.Password = *req.Password
+		err = u.calculatePasswordHash()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", err.Error()))
+		}
+		changes["password_hash"] = u.PasswordHash
+		changes["password_salt"] = u.PasswordSalt
+		changes["hash_version"] = u.HashVersion
+		passwordChanged = true
+	}
+	if req.RoleID != nil && *req.RoleID != u.RoleID {
+		var n int64
+		svc.userDb.Model(&Role{}).Where("id = ?", *req.RoleID).Count(&n)
+		if n == 0 {
+			return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "unknown role"))
+		}
+		u.RoleID = *req.RoleID
+		changes["role_id"] = u.RoleID
+	}
+	deactivated := false
+	if req.Active != nil && *req.Active != u.Active {
+		u.Active = *req.Active
+		changes["active"] = u.Active
+		deactivated = !u.Active
+	}
+	if len(changes) == 0 {
+		return c.JSON(http.StatusOK, u)
+	}
+
+	ctx := c.Request().Context()
+	err = svc.userDb.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&u).Updates(changes).Error
+		if err != nil {
+			return err
+		}
+		err = svc.notify(ctx, tx, "User.Updated", u)
+		if err != nil {
+			return err
+		}
+		if !passwordChanged && !deactivated {
+			return nil
+		}
+		reason := "password_changed"
+		if deactivated {
+			reason = "user_deactivated"
+		}
+		items, err := svc.tokens.revokeUser(tx, u.PublicId)
+		if err != nil {
+			return err
+		}
+		return svc.notifyLogout(ctx, tx, items, reason)
+	})
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError,
+			common.FromKeysAndValues("error", "failed to update user"))
+	}
+	svc.logger.Infof("User %s is updated by %s", u.PublicId, me.PublicId)
+	return c.JSON(http.StatusOK, u)
 }
 
-// verify validates access token from request header
-func (svc *authSvc) verify(c echo.Context) error {
-	tokenInfo, err := svc.oauthServer.ValidationBearerToken(c.Request())
+// deleteUser deletes user with public id from path and revokes all sessions.
+// Other services keep their copies of deleted user as inactive, for history of tasks and payments.
+func (svc *authSvc) deleteUser(c echo.Context) error {
+	me := common.CurrentUser(c)
+	uid := c.Param("uid")
+	if me.PublicId == uid {
+		return c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "can't delete yourself"))
+	}
+
+	var u User
+	result := svc.userDb.Where("public_id = ?", uid).Limit(1).Find(&u)
+	if result.RowsAffected != 1 {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "user not found"))
+	}
+
+	ctx := c.Request().Context()
+	err := svc.userDb.Transaction(func(tx *gorm.DB) error {
+		u.Active = false
+		err := tx.Model(&u).Update("active", false).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Delete(&u).Error
+		if err != nil {
+			return err
+		}
+		err = svc.notify(ctx, tx, "User.Deleted", u)
+		if err != nil {
+			return err
+		}
+		items, err := svc.tokens.revokeUser(tx, u.PublicId)
+		if err != nil {
+			return err
+		}
+		return svc.notifyLogout(ctx, tx, items, "user_deleted")
+	})
 	if err != nil {
 		svc.logger.Error(err)
-		return c.String(http.StatusBadRequest, err.Error())
+		return c.JSON(http.StatusInternalServerError,
+			common.FromKeysAndValues("error", "failed to delete user"))
+	}
+	svc.logger.Infof("User %s is deleted by %s", u.PublicId, me.PublicId)
+	return c.NoContent(http.StatusOK)
+}
+
+// jwks renders public keys, which verify access tokens
+func (svc *authSvc) jwks(c echo.Context) error {
+	return c.JSON(http.StatusOK, svc.keys.jwks())
+}
+
+// findUser returns active user with public identifier
+func (svc *authSvc) findUser(publicId string) (User, error) {
+	var u User
+	result := svc.userDb.Where("public_id = ? and active = ?", publicId, true).Limit(1).Find(&u)
+	if result.RowsAffected != 1 {
+		return u, errors.New("user not found")
 	}
-	return c.JSON(http.StatusOK, AuthVerification{PublicId: tokenInfo.GetUserID()})
+	return u, nil
+}
+
+// lookupUser returns authenticated user for admin endpoints of Auth
+func (svc *authSvc) lookupUser(id common.Identity) (common.AuthUser, error) {
+	u, err := svc.findUser(id.PublicId)
+	if err != nil {
+		return common.AuthUser{}, err
+	}
+	return common.AuthUser{
+		ID:       u.ID,
+		PublicId: u.PublicId,
+		Role:     u.RoleID,
+	}, nil
+}
+
+// introspect tells state of access or refresh token to confidential client (RFC 7662), with role of user.
+// POST /oauth/introspect token=TOKEN&token_type_hint=access_token, client credentials in basic auth or form
+func (svc *authSvc) introspect(c echo.Context) error {
+	r := c.Request()
+	clientID, err := svc.authenticateClient(r)
+	if err == nil {
+		client, _ := svc.clients.Get(r.Context(), clientID)
+		if client == nil || client.IsPublic() {
+			err = errors.New("public client can't introspect tokens")
+		}
+	}
+	if err != nil {
+		svc.logger.Info(err)
+		c.Response().Header().Set("WWW-Authenticate", `Basic realm="ates"`)
+		return c.JSON(http.StatusUnauthorized, oauthError("invalid_client"))
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, oauthError("invalid_request"))
+	}
+	columns := []string{"access_hash", "refresh_hash"}
+	if r.PostFormValue("token_type_hint") == "refresh_token" {
+		columns = []string{"refresh_hash", "access_hash"}
+	}
+
+	ctx := r.Context()
+	inactive := common.Introspection{Active: false}
+	for _, column := range columns {
+		item, err := svc.tokens.item(ctx, column, token)
+		if err != nil {
+			svc.logger.Error(err)
+			return c.JSON(http.StatusServiceUnavailable, oauthError("server_error"))
+		}
+		if item == nil {
+			continue
+		}
+		var info models.Token
+		err = json.Unmarshal([]byte(item.Data), &info)
+		if err != nil {
+			svc.logger.Error(err)
+			return c.JSON(http.StatusOK, inactive)
+		}
+
+		res := common.Introspection{
+			Active:    true,
+			Scope:     info.GetScope(),
+			ClientID:  info.GetClientID(),
+			TokenType: "Bearer",
+			Iat:       info.GetAccessCreateAt().Unix(),
+			Exp:       info.GetAccessCreateAt().Add(info.GetAccessExpiresIn()).Unix(),
+		}
+		if column == "refresh_hash" {
+			res.TokenType = "refresh_token"
+			res.Iat = info.GetRefreshCreateAt().Unix()
+			res.Exp = 0
+			if info.GetRefreshExpiresIn() > 0 {
+				res.Exp = info.GetRefreshCreateAt().Add(info.GetRefreshExpiresIn()).Unix()
+			}
+		}
+		if res.Exp != 0 && res.Exp <= time.Now().Unix() {
+			return c.JSON(http.StatusOK, inactive)
+		}
+		if userID := info.GetUserID(); userID != "" {
+			// token of deleted or deactivated user is not active
+			u, err := svc.findUser(userID)
+			if err != nil {
+				return c.JSON(http.StatusOK, inactive)
+			}
+			res.Sub = u.PublicId
+			res.Username = u.Login
+			res.Role = u.RoleID
+		}
+		if column == "access_hash" {
+			// services introspect access token when it is used
+			if err = svc.tokens.markSeen(ctx, token); err != nil {
+				svc.logger.Error(err)
+			}
+		}
+		return c.JSON(http.StatusOK, res)
+	}
+	return c.JSON(http.StatusOK, inactive)
 }
 
 // token exchanges user and password to access and refresh tokens
 // /oauth/token?grant_type=password&username=USER&password=PASSWORD&client_id=default&client_secret=secret
+// Refresh token is rotated: /oauth/token?grant_type=refresh_token&refresh_token=TOKEN&client_id=...&client_secret=...
+// returns new pair, and the old refresh token can't be used again. Reuse of the old one means it is stolen,
+// the whole session is revoked then.
 func (svc *authSvc) token(c echo.Context) error {
+	// address of client is used for throttling of password attempts, otp is second factor of password grant
+	ctx := withSecondFactor(withClientIP(c.Request().Context(), c.RealIP()), c.Request().FormValue("otp"))
+	r := c.Request().WithContext(ctx)
+	c.SetRequest(r)
+	if r.FormValue("grant_type") == string(oauth2.AuthorizationCode) {
+		// code is exchanged by client, the session is started by user on the login page, from their address.
+		// There is no password to throttle here.
+		item, err := svc.tokens.item(ctx, "code_hash", r.FormValue("code"))
+		if err != nil {
+			svc.logger.Error(err)
+			return c.JSON(http.StatusInternalServerError, oauthError("server_error"))
+		}
+		if item != nil && item.IP != "" {
+			r = r.WithContext(withClientIP(ctx, item.IP))
+			c.SetRequest(r)
+		}
+	}
+	if r.FormValue("grant_type") == "refresh_token" {
+		ctx := r.Context()
+		refresh := r.FormValue("refresh_token")
+		item, err := svc.tokens.item(ctx, "refresh_hash", refresh)
+		if err != nil {
+			svc.logger.Error(err)
+			return c.JSON(http.StatusInternalServerError, oauthError("server_error"))
+		}
+		if item == nil {
+			revoked, err := svc.tokens.revokedRefresh(ctx, refresh)
+			if err != nil {
+				svc.logger.Error(err)
+				return c.JSON(http.StatusInternalServerError, oauthError("server_error"))
+			}
+			if revoked != nil {
+				svc.logger.Warnf("Reuse of refresh token of session %s, user %s: session is revoked",
+					revoked.FamilyID, revoked.UserID)
+				err = svc.userDb.Transaction(func(tx *gorm.DB) error {
+					items, err := svc.tokens.revokeFamily(tx, revoked.FamilyID)
+					if err != nil {
+						return err
+					}
+					return svc.notifyLogout(ctx, tx, items, "refresh_token_reuse")
+				})
+				if err != nil {
+					svc.logger.Error(err)
+				}
+			}
+			return c.JSON(http.StatusBadRequest, oauthError("invalid_grant"))
+		}
+		// manager takes client from the refresh token and doesn't check its secret, so the client is checked here
+		clientID, err := svc.authenticateClient(r)
+		if err != nil {
+			svc.logger.Info(err)
+			return c.JSON(http.StatusUnauthorized, oauthError("invalid_client"))
+		}
+		if clientID != item.ClientID {
+			svc.logger.Warnf("Refresh token of client %s is presented by client %s", item.ClientID, clientID)
+			return c.JSON(http.StatusBadRequest, oauthError("invalid_grant"))
+		}
+		// new tokens continue the session of the refreshed ones
+		c.SetRequest(r.WithContext(withTokenFamily(ctx, item.FamilyID)))
+	}
+	if r.FormValue("grant_type") == string(oauth2.ClientCredentials) && r.FormValue("scope") == "" {
+		// service account gets all its scopes by default, client is authenticated by server later
+		client, err := svc.clients.Get(r.Context(), r.FormValue("client_id"))
+		if err != nil {
+			svc.logger.Error(err)
+			return c.JSON(http.StatusInternalServerError, oauthError("server_error"))
+		}
+		if client != nil {
+			r.Form.Set("scope", strings.Join(client.Scopes, " "))
+		}
+	}
+
 	err := svc.oauthServer.HandleTokenRequest(c.Response().Writer, c.Request())
 	if err != nil {
 		svc.logger.Error(err)
@@ -88,17 +522,259 @@ func (svc *authSvc) token(c echo.Context) error {
 	return err
 }
 
-func (svc *authSvc) checkPassword(_ context.Context, _, username, password string) (userID string, err error) {
+// revoke revokes access or refresh token of the client (RFC 7009) with the whole session it belongs to
+// POST /oauth/revoke token=TOKEN&token_type_hint=refresh_token&client_id=default&client_secret=secret
+func (svc *authSvc) revoke(c echo.Context) error {
+	r := c.Request()
+	clientID, err := svc.authenticateClient(r)
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusUnauthorized, oauthError("invalid_client"))
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, oauthError("invalid_request"))
+	}
+	columns := []string{"access_hash", "refresh_hash"}
+	switch r.PostFormValue("token_type_hint") {
+	case "refresh_token":
+		columns = []string{"refresh_hash", "access_hash"}
+	case "", "access_token":
+	default:
+		return c.JSON(http.StatusBadRequest, oauthError("unsupported_token_type"))
+	}
+
+	ctx := r.Context()
+	var item *TokenStoreItem
+	for _, column := range columns {
+		item, err = svc.tokens.item(ctx, column, token)
+		if err != nil {
+			svc.logger.Error(err)
+			return c.JSON(http.StatusServiceUnavailable, oauthError("server_error"))
+		}
+		if item != nil {
+			break
+		}
+	}
+	if item == nil {
+		// unknown, expired or already revoked token is not an error for the client
+		return c.NoContent(http.StatusOK)
+	}
+	if item.ClientID != clientID {
+		return c.JSON(http.StatusBadRequest, oauthError("unauthorized_client"))
+	}
+
+	err = svc.userDb.Transaction(func(tx *gorm.DB) error {
+		items, err := svc.tokens.revokeFamily(tx, item.FamilyID)
+		if err != nil {
+			return err
+		}
+		return svc.notifyLogout(ctx, tx, items, "revoked")
+	})
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusServiceUnavailable, oauthError("server_error"))
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// logoutAll revokes all sessions of user with access token from request header, on all clients and devices.
+// Services verify access tokens locally, so revoked ones are refused by them only on routes which introspect tokens,
+// other routes accept them until they expire.
+func (svc *authSvc) logoutAll(c echo.Context) error {
+	tokenInfo, err := svc.oauthServer.ValidationBearerToken(c.Request())
+	if err != nil || tokenInfo.GetUserID() == "" {
+		return c.JSON(http.StatusUnauthorized, common.FromKeysAndValues("error", "unauthorized"))
+	}
+
+	ctx := c.Request().Context()
+	err = svc.userDb.Transaction(func(tx *gorm.DB) error {
+		items, err := svc.tokens.revokeUser(tx, tokenInfo.GetUserID())
+		if err != nil {
+			return err
+		}
+		return svc.notifyLogout(ctx, tx, items, "logout_everywhere")
+	})
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError,
+			common.FromKeysAndValues("error", "failed to log out"))
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// authenticateClient checks client credentials of request, in form or in basic auth header, and returns client id
+func (svc *authSvc) authenticateClient(r *http.Request) (string, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return "", err
+	}
+	var clientID, secret string
+	if _, _, ok := r.BasicAuth(); ok {
+		// credentials in basic auth are form-encoded (RFC 6749, 2.3.1)
+		clientID, secret, err = server.ClientBasicHandler(r)
+		if err == nil {
+			clientID, err = url.QueryUnescape(clientID)
+		}
+		if err == nil {
+			secret, err = url.QueryUnescape(secret)
+		}
+	} else {
+		clientID, secret, err = svc.oauthServer.ClientInfoHandler(r)
+	}
+	if err != nil {
+		return "", err
+	}
+	client, err := svc.oauthServer.Manager.GetClient(r.Context(), clientID)
+	if err != nil {
+		return "", err
+	}
+	if verifier, ok := client.(oauth2.ClientPasswordVerifier); ok {
+		if !verifier.VerifyPassword(secret) {
+			return "", errors.New("bad client secret")
+		}
+	} else if subtle.ConstantTimeCompare([]byte(client.GetSecret()), []byte(secret)) != 1 {
+		return "", errors.New("bad client secret")
+	}
+	return clientID, nil
+}
+
+// oauthError is error response of OAuth endpoints
+func oauthError(code string) map[string]interface{} {
+	return common.FromKeysAndValues("error", code)
+}
+
+// onLogin notifies about new session within transaction of token creation
+func (svc *authSvc) onLogin(ctx context.Context, tx *gorm.DB, item *TokenStoreItem) error {
+	return svc.notify(ctx, tx, "User.LoggedIn", sessionChange{item: *item})
+}
+
+// errInvalidCredentials is the only answer on failed login, so it doesn't reveal which logins exist
+var errInvalidCredentials = oauthErrors.ErrInvalidGrant
+
+// checkPassword returns user with login and password, and checks second factor from context. Failed attempts
+// are throttled by login and address of client, login is locked out after many failures.
+func (svc *authSvc) checkPassword(ctx context.Context, _, username, password string) (string, error) {
+	u, err := svc.verifyPassword(ctx, username, password)
+	if err != nil {
+		return "", err
+	}
+
+	err = svc.checkSecondFactor(ctx, u, secondFactor(ctx))
+	if errors.Is(err, errInvalidCredentials) {
+		svc.logger.Infof("Failed second factor of login %s from %s", username, clientIP(ctx))
+		svc.failLogin(ctx, username, u)
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// failures are forgotten only after both factors, otherwise known password would allow to guess codes
+	err = svc.throttle.succeed(ctx, username)
+	if err != nil {
+		svc.logger.Error(err)
+	}
+	return u.PublicId, nil
+}
+
+// verifyPassword returns active user with login and password, failed attempts are throttled
+func (svc *authSvc) verifyPassword(ctx context.Context, username, password string) (*User, error) {
+	ip := clientIP(ctx)
+	err := svc.throttle.check(ctx, username, ip)
+	if err != nil {
+		svc.logger.Infof("Login %s from %s is refused: %s", username, ip, err.Error())
+		return nil, err
+	}
+
 	var userFromDb User
-	result := svc.userDb.First(&userFromDb, "login = ?", username)
-	if result.RowsAffected == 1 {
-		if userFromDb.checkPassword(password) {
-			userID = userFromDb.PublicId
+	result := svc.userDb.Limit(1).Find(&userFromDb, "login = ?", username)
+	found := result.RowsAffected == 1
+	ok, needsRehash := false, false
+	if found {
+		ok, needsRehash = userFromDb.checkPassword(password)
+	} else {
+		// takes the same time as check of existing user
+		checkDummyPassword(password)
+	}
+
+	if !ok {
+		svc.logger.Infof("Failed login %s from %s, user found: %t", username, ip, found)
+		if found {
+			svc.failLogin(ctx, username, &userFromDb)
 		} else {
-			err = errors.New("bad password")
+			svc.failLogin(ctx, username, nil)
 		}
-	} else {
-		err = errors.New("user not found")
+		return nil, errInvalidCredentials
+	}
+
+	if !userFromDb.Active {
+		svc.logger.Infof("Login of deactivated user %s", userFromDb.PublicId)
+		return nil, errInvalidCredentials
+	}
+	if needsRehash {
+		svc.rehashPassword(&userFromDb, password)
+	}
+	return &userFromDb, nil
+}
+
+// failLogin counts failed attempt of login, u is nil for unknown login
+func (svc *authSvc) failLogin(ctx context.Context, username string, u *User) {
+	err := svc.throttle.fail(ctx, username, clientIP(ctx), func(tx *gorm.DB, failures int, until time.Time) error {
+		svc.logger.Warnf("Login %s is locked out until %s after %d failures", username, until, failures)
+		if u == nil {
+			return nil
+		}
+		return svc.notify(ctx, tx, "User.LockedOut", lockoutChange{user: *u, failures: failures, until: until})
+	})
+	if err != nil {
+		svc.logger.Error(err)
+	}
+}
+
+// unlockUser removes lockout of user with public id from path, admin only
+func (svc *authSvc) unlockUser(c echo.Context) error {
+	var u User
+	result := svc.userDb.Where("public_id = ?", c.Param("uid")).Limit(1).Find(&u)
+	if result.RowsAffected != 1 {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "user not found"))
+	}
+
+	me := common.CurrentUser(c)
+	ctx := c.Request().Context()
+	err := svc.userDb.Transaction(func(tx *gorm.DB) error {
+		locked, err := svc.throttle.unlock(tx, u.Login)
+		if err != nil || !locked {
+			return err
+		}
+		return svc.notify(ctx, tx, "User.Unlocked", lockoutChange{user: u, unlockedBy: me.PublicId})
+	})
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, common.FromKeysAndValues("error", "failed to unlock user"))
+	}
+	svc.logger.Infof("User %s is unlocked by %s", u.PublicId, me.PublicId)
+	return c.JSON(http.StatusOK, common.FromKeysAndValues("result", "unlocked"))
+}
+
+// rehashPassword replaces outdated hash with the current one, password is known only on successful login.
+// Failure doesn't prevent login, hash is updated next time.
+func (svc *authSvc) rehashPassword(u *User, password string) {
+	u.Password = password
+	err := u.calculatePasswordHash()
+	if err != nil {
+		svc.logger.Errorf("Failed to rehash password of user %s: %s", u.PublicId, err.Error())
+		return
+	}
+	err = svc.userDb.Model(u).Updates(map[string]interface{}{
+		"password_hash": u.PasswordHash,
+		"password_salt": u.PasswordSalt,
+		"hash_version":  u.HashVersion,
+	}).Error
+	if err != nil {
+		svc.logger.Errorf("Failed to save rehashed password of user %s: %s", u.PublicId, err.Error())
+		return
 	}
-	return
+	svc.logger.Infof("Password hash of user %s is upgraded", u.PublicId)
 }
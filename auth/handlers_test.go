@@ -0,0 +1,606 @@
+package main
+
+import (
+	"ates/common"
+	"ates/common/testutil"
+	"ates/schema"
+	"ates/schema/events"
+	"context"
+	"encoding/json"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newTestAuthSvc builds Auth on in-memory database, with routes registered in returned echo
+func newTestAuthSvc(t *testing.T) (*authSvc, *echo.Echo) {
+	t.Helper()
+	if err := schema.UseRegistry("mock://"); err != nil {
+		t.Fatal(err)
+	}
+	db := testutil.OpenDB(t, &User{}, &Role{}, &common.OutboxMessage{}, &SigningKey{}, &LoginThrottle{},
+		&UserTOTP{}, &RecoveryCode{}, &EnrollmentToken{})
+	createDefaultRoles(db)
+	svc := newAuthSvc(db, newTestKeyRing(t, db), zap.NewNop().Sugar())
+	// client store widens the pool, but every connection has its own in-memory database
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	svc.permissions, err = common.LoadPermissions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.twoFactorRoles = map[schema.UserRole]bool{}
+	svc.console = io.Discard
+	e := echo.New()
+	svc.routes(e)
+	return svc, e
+}
+
+// createTestUser saves active user with login and password
+func createTestUser(t *testing.T, svc *authSvc, login, password string, role schema.UserRole) User {
+	t.Helper()
+	u := User{PublicId: uuid.NewString(), Login: login, Password: password, RoleID: role, Active: true}
+	if err := u.calculatePasswordHash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.userDb.Create(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// createTestClient saves confidential client with secret, or public one if secret is empty
+func createTestClient(t *testing.T, svc *authSvc, id, secret string, grants ...oauth2.GrantType) {
+	t.Helper()
+	hash, err := hashClientSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.clients.Create(context.Background(), &Client{ID: id, SecretHash: hash,
+		ClientData: ClientData{GrantTypes: grants}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve sends request to echo, body is form if it is url.Values, otherwise it is sent as JSON
+func serve(e *echo.Echo, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var r io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case url.Values:
+		r = strings.NewReader(b.Encode())
+		contentType = echo.MIMEApplicationForm
+	default:
+		data, _ := json.Marshal(b)
+		r = strings.NewReader(string(data))
+		contentType = echo.MIMEApplicationJSON
+	}
+	req := httptest.NewRequest(method, path, r)
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+}
+
+// requestToken posts form to token endpoint
+func requestToken(t *testing.T, e *echo.Echo, form url.Values) (int, tokenResponse) {
+	t.Helper()
+	rec := serve(e, http.MethodPost, "/oauth/token", "", form)
+	var res tokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("token response %s: %v", rec.Body.String(), err)
+	}
+	return rec.Code, res
+}
+
+// login gets tokens with password grant, it fails the test on error
+func login(t *testing.T, e *echo.Echo, client, secret, username, password string) tokenResponse {
+	t.Helper()
+	code, res := requestToken(t, e, url.Values{"grant_type": {"password"}, "client_id": {client},
+		"client_secret": {secret}, "username": {username}, "password": {password}})
+	if code != http.StatusOK {
+		t.Fatalf("login of %s with client %s: %d %+v", username, client, code, res)
+	}
+	return res
+}
+
+func refreshForm(client, secret, refresh string) url.Values {
+	return url.Values{"grant_type": {"refresh_token"}, "client_id": {client}, "client_secret": {secret},
+		"refresh_token": {refresh}}
+}
+
+// outboxEvents returns names of events stored in outbox, in order
+func outboxEvents(t *testing.T, svc *authSvc) []string {
+	t.Helper()
+	var messages []common.OutboxMessage
+	if err := svc.userDb.Order("id").Find(&messages).Error; err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range messages {
+		var headers []kafka.Header
+		if err := json.Unmarshal([]byte(m.Headers), &headers); err != nil {
+			t.Fatal(err)
+		}
+		name, _ := common.GetKafkaHeader(&kafka.Message{Headers: headers}, common.HeaderEvent)
+		names = append(names, name)
+	}
+	return names
+}
+
+func countEvents(names []string, name string) int {
+	n := 0
+	for _, s := range names {
+		if s == name {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRefreshRotation(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials, oauth2.Refreshing)
+	first := login(t, e, "web", "web-secret", "popug", "secret")
+
+	code, second := requestToken(t, e, refreshForm("web", "web-secret", first.RefreshToken))
+	if code != http.StatusOK {
+		t.Fatalf("refresh: %d %+v", code, second)
+	}
+	if second.AccessToken == first.AccessToken || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Errorf("refresh doesn't rotate tokens: %+v after %+v", second, first)
+	}
+	if rec := serve(e, http.MethodGet, "/sessions", second.AccessToken, nil); rec.Code != http.StatusOK {
+		t.Errorf("new access token is refused: %d", rec.Code)
+	}
+	if rec := serve(e, http.MethodGet, "/sessions", first.AccessToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old access token is accepted: %d", rec.Code)
+	}
+	sessions, err := svc.tokens.sessions(context.Background(), svc.mustFindUser(t, "popug").PublicId)
+	if err != nil || len(sessions) != 1 {
+		t.Errorf("sessions after refresh %+v, %v, want the same one", sessions, err)
+	}
+	if code, third := requestToken(t, e, refreshForm("web", "web-secret", second.RefreshToken)); code != http.StatusOK {
+		t.Errorf("second refresh: %d %+v", code, third)
+	}
+}
+
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials, oauth2.Refreshing)
+	other := login(t, e, "web", "web-secret", "popug", "secret")
+	first := login(t, e, "web", "web-secret", "popug", "secret")
+	_, second := requestToken(t, e, refreshForm("web", "web-secret", first.RefreshToken))
+
+	// the old refresh token is presented again: it is stolen, the session is revoked
+	code, res := requestToken(t, e, refreshForm("web", "web-secret", first.RefreshToken))
+	if code != http.StatusBadRequest || res.Error != "invalid_grant" {
+		t.Errorf("reuse of refresh token: %d %+v, want invalid_grant", code, res)
+	}
+	if code, res = requestToken(t, e, refreshForm("web", "web-secret", second.RefreshToken)); code != http.StatusBadRequest {
+		t.Errorf("refresh token of revoked session: %d %+v", code, res)
+	}
+	if rec := serve(e, http.MethodGet, "/sessions", second.AccessToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("access token of revoked session is accepted: %d", rec.Code)
+	}
+	if events := outboxEvents(t, svc); countEvents(events, "User.LoggedOut") != 1 {
+		t.Errorf("events %v, want one User.LoggedOut", events)
+	}
+
+	// other session of the user is not touched
+	if code, res = requestToken(t, e, refreshForm("web", "web-secret", other.RefreshToken)); code != http.StatusOK {
+		t.Errorf("refresh of other session: %d %+v", code, res)
+	}
+}
+
+func TestRefreshByOtherClient(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials, oauth2.Refreshing)
+	createTestClient(t, svc, "mobile", "mobile-secret", oauth2.PasswordCredentials, oauth2.Refreshing)
+	tokens := login(t, e, "web", "web-secret", "popug", "secret")
+
+	code, res := requestToken(t, e, refreshForm("mobile", "mobile-secret", tokens.RefreshToken))
+	if code != http.StatusBadRequest || res.Error != "invalid_grant" {
+		t.Errorf("refresh by other client: %d %+v, want invalid_grant", code, res)
+	}
+	if code, res = requestToken(t, e, refreshForm("web", "wrong", tokens.RefreshToken)); code != http.StatusUnauthorized {
+		t.Errorf("refresh with wrong secret: %d %+v, want invalid_client", code, res)
+	}
+	// presenting token by other client is not its reuse, the owner still can refresh it
+	if code, res = requestToken(t, e, refreshForm("web", "web-secret", tokens.RefreshToken)); code != http.StatusOK {
+		t.Errorf("refresh by own client: %d %+v", code, res)
+	}
+}
+
+// mustFindUser returns user with login
+func (svc *authSvc) mustFindUser(t *testing.T, login string) User {
+	t.Helper()
+	var u User
+	if err := svc.userDb.Where("login = ?", login).First(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestRevokedTokenIsRefusedByAuthAtOnce(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials, oauth2.Refreshing)
+	tokens := login(t, e, "web", "web-secret", "popug", "secret")
+
+	if rec := serve(e, http.MethodGet, "/sessions", tokens.AccessToken, nil); rec.Code != http.StatusOK {
+		t.Fatalf("sessions: %d", rec.Code)
+	}
+	if rec := serve(e, http.MethodDelete, "/sessions", tokens.AccessToken, nil); rec.Code != http.StatusOK {
+		t.Fatalf("revoke sessions: %d %s", rec.Code, rec.Body.String())
+	}
+	// Auth doesn't cache verified tokens, the revoked one is refused by the next request
+	if rec := serve(e, http.MethodGet, "/sessions", tokens.AccessToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked access token got %d, want 401", rec.Code)
+	}
+}
+
+func TestAccessTokenTTL(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials, oauth2.Refreshing)
+	tokens := login(t, e, "web", "web-secret", "popug", "secret")
+
+	check := func(access string) {
+		t.Helper()
+		info, err := svc.tokens.GetByAccess(context.Background(), access)
+		if err != nil || info == nil {
+			t.Fatalf("token is not stored: %v", err)
+		}
+		if info.GetAccessExpiresIn() != accessTokenTTL {
+			t.Errorf("access token lives %s, want %s", info.GetAccessExpiresIn(), accessTokenTTL)
+		}
+	}
+	check(tokens.AccessToken)
+	_, refreshed := requestToken(t, e, refreshForm("web", "web-secret", tokens.RefreshToken))
+	check(refreshed.AccessToken)
+}
+
+func TestLoginUpgradesLegacyPassword(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials, oauth2.Refreshing)
+	u := legacyUser("popug", "secret")
+	u.PublicId = uuid.NewString()
+	u.RoleID = schema.RoleUser
+	if err := svc.userDb.Create(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// failed login leaves legacy hash as it is
+	code, res := requestToken(t, e, url.Values{"grant_type": {"password"}, "client_id": {"web"},
+		"client_secret": {"web-secret"}, "username": {"popug"}, "password": {"wrong"}})
+	if code == http.StatusOK {
+		t.Fatalf("login with wrong password: %d %+v", code, res)
+	}
+	if got := svc.mustFindUser(t, "popug"); got.HashVersion != hashLegacySHA256 || got.PasswordHash != u.PasswordHash ||
+		got.PasswordSalt != "salt" {
+		t.Errorf("hash after failed login: version %d, salt %q", got.HashVersion, got.PasswordSalt)
+	}
+
+	login(t, e, "web", "web-secret", "popug", "secret")
+	got := svc.mustFindUser(t, "popug")
+	if got.HashVersion != hashBcrypt || got.PasswordSalt != "" {
+		t.Fatalf("hash after login: version %d, salt %q, want bcrypt", got.HashVersion, got.PasswordSalt)
+	}
+	if cost, err := bcrypt.Cost([]byte(got.PasswordHash)); err != nil || cost != bcryptCost {
+		t.Errorf("bcrypt cost %d, %v, want %d", cost, err, bcryptCost)
+	}
+	if ok, rehash := got.checkPassword("secret"); !ok || rehash {
+		t.Errorf("upgraded hash: checkPassword = %v, %v", ok, rehash)
+	}
+	// the same password still logs in
+	login(t, e, "web", "web-secret", "popug", "secret")
+}
+
+// userEvents returns payloads of user lifecycle events with name, in order
+func userEvents(t *testing.T, svc *authSvc, name string) []events.User {
+	t.Helper()
+	var messages []common.OutboxMessage
+	if err := svc.userDb.Where("topic = ?", "user.lifecycle").Order("id").Find(&messages).Error; err != nil {
+		t.Fatal(err)
+	}
+	var users []events.User
+	for _, m := range messages {
+		var headers []kafka.Header
+		if err := json.Unmarshal([]byte(m.Headers), &headers); err != nil {
+			t.Fatal(err)
+		}
+		e, err := common.ParseEvent(&kafka.Message{Key: m.Key, Headers: headers, Value: m.Value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Name != name {
+			continue
+		}
+		var u events.User
+		if err = u.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if string(e.Key) != u.Uid {
+			t.Errorf("%s is keyed by %s, want uid %s", name, e.Key, u.Uid)
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
+func TestRegisterUser(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+
+	// public id is generated by server, the one from request is ignored
+	rec := serve(e, http.MethodPost, "/register", "",
+		map[string]interface{}{"uid": "forged", "login": "popug", "password": "secret", "active": false})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", rec.Code, rec.Body.String())
+	}
+	var created User
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.PublicId == "" || created.PublicId == "forged" || created.RoleID != schema.RoleUser || !created.Active {
+		t.Errorf("registered user %+v, want active User with generated uid", created)
+	}
+	if strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("response shows password: %s", rec.Body.String())
+	}
+	if _, err := uuid.Parse(created.PublicId); err != nil {
+		t.Errorf("uid %q is not uuid: %v", created.PublicId, err)
+	}
+	if u := svc.mustFindUser(t, "popug"); u.PublicId != created.PublicId || u.HashVersion != hashBcrypt {
+		t.Errorf("saved user %+v", u)
+	}
+	users := userEvents(t, svc, "User.Created")
+	if len(users) != 1 || users[0].Uid != created.PublicId || users[0].Login != "popug" ||
+		users[0].RoleId != int(schema.RoleUser) || !users[0].Active {
+		t.Errorf("User.Created %+v, want registered user", users)
+	}
+
+	tests := []struct {
+		name string
+		body map[string]interface{}
+		want int
+	}{
+		{"other role", map[string]interface{}{"login": "boss", "password": "secret", "roleId": schema.RoleAdmin},
+			http.StatusForbidden},
+		{"without password", map[string]interface{}{"login": "nopass"}, http.StatusBadRequest},
+		{"taken login", map[string]interface{}{"login": "popug", "password": "other"}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if rec = serve(e, http.MethodPost, "/register", "", tt.body); rec.Code != tt.want {
+			t.Errorf("register %s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	if users = userEvents(t, svc, "User.Created"); len(users) != 1 {
+		t.Errorf("refused registrations are notified: %+v", users)
+	}
+}
+
+func TestProvisionUser(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestUser(t, svc, "admin", "admin-secret", schema.RoleAdmin)
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials)
+	admin := login(t, e, "web", "web-secret", "admin", "admin-secret")
+	user := login(t, e, "web", "web-secret", "popug", "secret")
+	body := map[string]interface{}{"uid": "forged", "login": "boss", "password": "secret", "roleId": schema.RoleManager}
+
+	if rec := serve(e, http.MethodPost, "/admin/users", "", body); rec.Code != http.StatusUnauthorized {
+		t.Errorf("provision without token: %d", rec.Code)
+	}
+	if rec := serve(e, http.MethodPost, "/admin/users", user.AccessToken, body); rec.Code != http.StatusForbidden {
+		t.Errorf("provision by user: %d", rec.Code)
+	}
+	unknown := map[string]interface{}{"login": "ghost", "password": "secret", "roleId": 42}
+	if rec := serve(e, http.MethodPost, "/admin/users", admin.AccessToken, unknown); rec.Code != http.StatusBadRequest {
+		t.Errorf("provision with unknown role: %d", rec.Code)
+	}
+
+	rec := serve(e, http.MethodPost, "/admin/users", admin.AccessToken, body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("provision: %d %s", rec.Code, rec.Body.String())
+	}
+	u := svc.mustFindUser(t, "boss")
+	if u.PublicId == "forged" || u.RoleID != schema.RoleManager || !u.Active {
+		t.Errorf("provisioned user %+v, want active manager with generated uid", u)
+	}
+	users := userEvents(t, svc, "User.Created")
+	if len(users) != 1 || users[0].Uid != u.PublicId || users[0].RoleId != int(schema.RoleManager) {
+		t.Errorf("User.Created %+v, want provisioned manager", users)
+	}
+	login(t, e, "web", "web-secret", "boss", "secret")
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials)
+
+	// without configured admin nothing is created
+	if err := svc.bootstrapAdmin("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if users := userEvents(t, svc, "User.Created"); len(users) != 0 {
+		t.Fatalf("admin is created without configuration: %+v", users)
+	}
+
+	if err := svc.bootstrapAdmin("admin", "admin-secret"); err != nil {
+		t.Fatal(err)
+	}
+	u := svc.mustFindUser(t, "admin")
+	if u.RoleID != schema.RoleAdmin || !u.Active || u.PublicId == "" {
+		t.Errorf("bootstrapped admin %+v", u)
+	}
+	users := userEvents(t, svc, "User.Created")
+	if len(users) != 1 || users[0].Uid != u.PublicId || users[0].RoleId != int(schema.RoleAdmin) {
+		t.Errorf("User.Created %+v, want admin", users)
+	}
+	login(t, e, "web", "web-secret", "admin", "admin-secret")
+
+	// database with users is left as it is, even if configured admin is another one
+	if err := svc.bootstrapAdmin("root", "root-secret"); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	svc.userDb.Model(&User{}).Count(&n)
+	if users = userEvents(t, svc, "User.Created"); n != 1 || len(users) != 1 {
+		t.Errorf("second bootstrap: %d users and events %+v, want only the first admin", n, users)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	admin := createTestUser(t, svc, "admin", "admin-secret", schema.RoleAdmin)
+	popug := createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	other := createTestUser(t, svc, "other", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials)
+	adminTokens := login(t, e, "web", "web-secret", "admin", "admin-secret")
+	tokens := login(t, e, "web", "web-secret", "popug", "secret")
+	path := "/users/" + popug.PublicId
+
+	tests := []struct {
+		name  string
+		token string
+		path  string
+		body  map[string]interface{}
+		want  int
+	}{
+		{"other user", tokens.AccessToken, "/users/" + other.PublicId, map[string]interface{}{"login": "x"},
+			http.StatusForbidden},
+		{"own role", tokens.AccessToken, path, map[string]interface{}{"roleId": schema.RoleAdmin}, http.StatusForbidden},
+		{"own password without current one", tokens.AccessToken, path, map[string]interface{}{"password": "new"},
+			http.StatusForbidden},
+		{"taken login", tokens.AccessToken, path, map[string]interface{}{"login": "other"}, http.StatusConflict},
+		{"admin deactivates own account", adminTokens.AccessToken, "/users/" + admin.PublicId,
+			map[string]interface{}{"active": false}, http.StatusBadRequest},
+		{"unknown user", adminTokens.AccessToken, "/users/nobody", map[string]interface{}{"login": "x"},
+			http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := serve(e, http.MethodPatch, tt.path, tt.token, tt.body); rec.Code != tt.want {
+			t.Errorf("update %s: %d %s, want %d", tt.name, rec.Code, rec.Body.String(), tt.want)
+		}
+	}
+	if names := outboxEvents(t, svc); countEvents(names, "User.Updated") != 0 {
+		t.Fatalf("refused updates are notified: %v", names)
+	}
+
+	// login change keeps sessions
+	rec := serve(e, http.MethodPatch, path, tokens.AccessToken, map[string]interface{}{"login": "popug2"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login change: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec = serve(e, http.MethodGet, "/sessions", tokens.AccessToken, nil); rec.Code != http.StatusOK {
+		t.Errorf("session after login change: %d", rec.Code)
+	}
+
+	// password change revokes sessions
+	rec = serve(e, http.MethodPatch, path, tokens.AccessToken,
+		map[string]interface{}{"password": "new-secret", "currentPassword": "secret"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("password change: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec = serve(e, http.MethodGet, "/sessions", tokens.AccessToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session after password change: %d", rec.Code)
+	}
+	tokens = login(t, e, "web", "web-secret", "popug2", "new-secret")
+
+	// admin changes role and deactivates user, sessions of user are revoked
+	rec = serve(e, http.MethodPatch, path, adminTokens.AccessToken,
+		map[string]interface{}{"roleId": schema.RoleManager, "active": false})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("deactivation: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec = serve(e, http.MethodGet, "/sessions", tokens.AccessToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session of deactivated user: %d", rec.Code)
+	}
+	code, res := requestToken(t, e, url.Values{"grant_type": {"password"}, "client_id": {"web"},
+		"client_secret": {"web-secret"}, "username": {"popug2"}, "password": {"new-secret"}})
+	if code == http.StatusOK {
+		t.Errorf("deactivated user logs in: %+v", res)
+	}
+
+	users := userEvents(t, svc, "User.Updated")
+	if len(users) != 3 {
+		t.Fatalf("User.Updated %+v, want 3", users)
+	}
+	if users[0].Login != "popug2" || users[2].RoleId != int(schema.RoleManager) || users[2].Active {
+		t.Errorf("User.Updated %+v, want new login, then inactive manager", users)
+	}
+	if names := outboxEvents(t, svc); countEvents(names, "User.LoggedOut") != 2 {
+		t.Errorf("events %v, want User.LoggedOut after password change and deactivation", names)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	admin := createTestUser(t, svc, "admin", "admin-secret", schema.RoleAdmin)
+	popug := createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials)
+	adminTokens := login(t, e, "web", "web-secret", "admin", "admin-secret")
+	tokens := login(t, e, "web", "web-secret", "popug", "secret")
+
+	if rec := serve(e, http.MethodDelete, "/users/"+admin.PublicId, tokens.AccessToken, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("delete by user: %d", rec.Code)
+	}
+	if rec := serve(e, http.MethodDelete, "/users/"+admin.PublicId, adminTokens.AccessToken, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("admin deletes own account: %d", rec.Code)
+	}
+	if rec := serve(e, http.MethodDelete, "/users/nobody", adminTokens.AccessToken, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("delete of unknown user: %d", rec.Code)
+	}
+
+	if rec := serve(e, http.MethodDelete, "/users/"+popug.PublicId, adminTokens.AccessToken, nil); rec.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body.String())
+	}
+	var n int64
+	svc.userDb.Model(&User{}).Where("login = ?", "popug").Count(&n)
+	if n != 0 {
+		t.Error("deleted user is found")
+	}
+	if rec := serve(e, http.MethodGet, "/sessions", tokens.AccessToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session of deleted user: %d", rec.Code)
+	}
+	users := userEvents(t, svc, "User.Deleted")
+	if len(users) != 1 || users[0].Uid != popug.PublicId || users[0].Active {
+		t.Errorf("User.Deleted %+v, want inactive deleted user", users)
+	}
+	if names := outboxEvents(t, svc); countEvents(names, "User.LoggedOut") != 1 {
+		t.Errorf("events %v, want User.LoggedOut of deleted user", names)
+	}
+	if rec := serve(e, http.MethodDelete, "/users/"+popug.PublicId, adminTokens.AccessToken, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("second delete: %d", rec.Code)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"ates/common"
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"strings"
+)
+
+// jwtAccessGenerate issues access tokens as JWT signed with the current key of keyRing, with role of user
+// and scope. Services verify them locally with keys from JWKS endpoint (common.JWTVerifier), and introspect
+// them only for actions which need a fresh check of revocation.
+type jwtAccessGenerate struct {
+	keys   *keyRing
+	userOf func(publicId string) (User, error)
+}
+
+func (g *jwtAccessGenerate) Token(_ context.Context, data *oauth2.GenerateBasic, isGenRefresh bool) (string, string, error) {
+	claims := common.AccessClaims{
+		StandardClaims: jwt.StandardClaims{
+			// tokens issued within the same second differ by id, otherwise they would share hash in token store
+			Id:        uuid.NewString(),
+			Audience:  data.Client.GetID(),
+			Subject:   data.UserID,
+			IssuedAt:  data.TokenInfo.GetAccessCreateAt().Unix(),
+			ExpiresAt: data.TokenInfo.GetAccessCreateAt().Add(data.TokenInfo.GetAccessExpiresIn()).Unix(),
+		},
+		Scope: data.TokenInfo.GetScope(),
+	}
+	if data.UserID != "" {
+		u, err := g.userOf(data.UserID)
+		if err != nil {
+			return "", "", err
+		}
+		claims.Role = u.RoleID
+	}
+
+	kid, key := g.keys.signingKey()
+	if key == nil {
+		return "", "", errors.New("no signing key")
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	access, err := token.SignedString(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	refresh := ""
+	if isGenRefresh {
+		t := uuid.NewSHA1(uuid.Must(uuid.NewRandom()), []byte(access)).String()
+		refresh = base64.URLEncoding.EncodeToString([]byte(t))
+		refresh = strings.ToUpper(strings.TrimRight(refresh, "="))
+	}
+	return access, refresh, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"ates/common"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+// SigningKey is RSA key which signs access tokens. Keys are kept in database, so tokens survive restart of Auth,
+// and all replicas sign with the same key.
+type SigningKey struct {
+	gorm.Model
+	Kid        string     `gorm:"unique;type:varchar(64)"`
+	PrivateKey string     `gorm:"type:text"` // PEM, PKCS#1
+	RetiredAt  *time.Time // retired key doesn't sign new tokens, but is published until its tokens expire
+	// Current is true for the key which signs new tokens and null for retired ones:
+	// unique index refuses the second current key, when replicas start on empty table at the same time
+	Current *bool `gorm:"uniqueIndex"`
+}
+
+type parsedKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// keyRing rotates signing keys and publishes public parts of keys which can verify not expired tokens
+type keyRing struct {
+	db          *gorm.DB
+	logger      *zap.SugaredLogger
+	rotateEvery time.Duration
+	tokenTTL    time.Duration
+
+	mx        sync.RWMutex
+	current   parsedKey
+	published []parsedKey
+}
+
+func newKeyRing(db *gorm.DB, logger *zap.SugaredLogger, rotateEvery, tokenTTL time.Duration) (*keyRing, error) {
+	k := &keyRing{
+		db:          db,
+		logger:      logger,
+		rotateEvery: rotateEvery,
+		tokenTTL:    tokenTTL,
+	}
+	err := k.rotateIfNeeded()
+	if err != nil {
+		return nil, err
+	}
+	return k, k.load()
+}
+
+// Run rotates keys on schedule and reloads keys rotated by other replicas, until context is cancelled
+func (k *keyRing) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := k.rotateIfNeeded()
+			if err != nil {
+				k.logger.Errorf("Failed to rotate signing key: %s", err.Error())
+			}
+			err = k.load()
+			if err != nil {
+				k.logger.Errorf("Failed to load signing keys: %s", err.Error())
+			}
+		}
+	}
+}
+
+// rotateIfNeeded creates new key if current one is older than rotation period,
+// and deletes retired keys whose tokens are expired
+func (k *keyRing) rotateIfNeeded() error {
+	err := k.db.Transaction(func(tx *gorm.DB) error {
+		var current []SigningKey
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("retired_at is null").
+			Order("id desc").
+			Find(&current).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if len(current) == 1 && current[0].CreatedAt.After(now.Add(-k.rotateEvery)) {
+			return nil
+		}
+
+		for _, old := range current {
+			err = tx.Model(&old).Updates(map[string]interface{}{"retired_at": now, "current": nil}).Error
+			if err != nil {
+				return err
+			}
+		}
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		isCurrent := true
+		key := SigningKey{
+			Kid:     uuid.NewString(),
+			Current: &isCurrent,
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+			})),
+		}
+		err = tx.Create(&key).Error
+		if err != nil {
+			return err
+		}
+		k.logger.Infof("Signing key is rotated, new kid=%s", key.Kid)
+
+		return tx.Unscoped().Where("retired_at < ?", now.Add(-k.tokenTTL)).Delete(&SigningKey{}).Error
+	})
+	if err != nil && k.hasFreshKey() {
+		// another replica has created the current key at the same time
+		return nil
+	}
+	return err
+}
+
+// hasFreshKey checks if there is current key younger than rotation period
+func (k *keyRing) hasFreshKey() bool {
+	var n int64
+	err := k.db.Model(&SigningKey{}).
+		Where("retired_at is null and created_at > ?", time.Now().UTC().Add(-k.rotateEvery)).
+		Count(&n).Error
+	return err == nil && n > 0
+}
+
+// load reads keys from database
+func (k *keyRing) load() error {
+	var keys []SigningKey
+	err := k.db.Order("id desc").Find(&keys).Error
+	if err != nil {
+		return err
+	}
+
+	var current parsedKey
+	published := make([]parsedKey, 0, len(keys))
+	for _, key := range keys {
+		block, _ := pem.Decode([]byte(key.PrivateKey))
+		if block == nil {
+			k.logger.Errorf("Signing key %s is not PEM encoded", key.Kid)
+			continue
+		}
+		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			k.logger.Errorf("Failed to parse signing key %s: %s", key.Kid, err.Error())
+			continue
+		}
+		pk := parsedKey{kid: key.Kid, key: privateKey}
+		if key.RetiredAt == nil && current.key == nil {
+			current = pk
+		}
+		published = append(published, pk)
+	}
+	if current.key == nil {
+		return errors.New("no active signing key")
+	}
+
+	k.mx.Lock()
+	k.current = current
+	k.published = published
+	k.mx.Unlock()
+	return nil
+}
+
+// signingKey returns key for new tokens
+func (k *keyRing) signingKey() (string, *rsa.PrivateKey) {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+	return k.current.kid, k.current.key
+}
+
+// jwks returns public keys for verification of tokens
+func (k *keyRing) jwks() common.JWKSet {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+	set := common.JWKSet{Keys: make([]common.JWK, 0, len(k.published))}
+	for _, pk := range k.published {
+		set.Keys = append(set.Keys, common.NewJWK(pk.kid, &pk.key.PublicKey))
+	}
+	return set
+}
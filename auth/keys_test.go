@@ -0,0 +1,121 @@
+package main
+
+import (
+	"ates/common"
+	"ates/common/testutil"
+	"ates/schema"
+	"context"
+	"encoding/json"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestKeyRing(t *testing.T, db *gorm.DB) *keyRing {
+	t.Helper()
+	k, err := newKeyRing(db, zap.NewNop().Sugar(), 24*time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	db := testutil.OpenDB(t, &SigningKey{})
+	k := newTestKeyRing(t, db)
+	first, _ := k.signingKey()
+	if first == "" || len(k.jwks().Keys) != 1 {
+		t.Fatalf("new key ring has current key %q and %d published", first, len(k.jwks().Keys))
+	}
+
+	// other replica starts with the same fresh key
+	other := newTestKeyRing(t, db)
+	if kid, _ := other.signingKey(); kid != first {
+		t.Errorf("other replica signs with %s, want %s", kid, first)
+	}
+
+	// key older than rotation period is retired, but is published while its tokens are valid
+	db.Model(&SigningKey{}).Where("kid = ?", first).Update("created_at", time.Now().UTC().Add(-25*time.Hour))
+	if err := k.rotateIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.load(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := k.signingKey()
+	if second == first || len(k.jwks().Keys) != 2 {
+		t.Errorf("after rotation current key is %s, %d keys published, want new one and both", second, len(k.jwks().Keys))
+	}
+
+	// retired key is deleted after its tokens expire
+	db.Model(&SigningKey{}).Where("kid = ?", first).Update("retired_at", time.Now().UTC().Add(-2*time.Hour))
+	db.Model(&SigningKey{}).Where("kid = ?", second).Update("created_at", time.Now().UTC().Add(-25*time.Hour))
+	if err := k.rotateIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	var kids []string
+	db.Model(&SigningKey{}).Order("id").Pluck("kid", &kids)
+	if len(kids) != 2 || kids[0] != second {
+		t.Errorf("keys after second rotation %v, want %s and new one", kids, second)
+	}
+}
+
+func TestOnlyOneCurrentKey(t *testing.T) {
+	db := testutil.OpenDB(t, &SigningKey{})
+	k := newTestKeyRing(t, db)
+	current := true
+	err := db.Create(&SigningKey{Kid: "concurrent", PrivateKey: "-", Current: &current}).Error
+	if err == nil {
+		t.Fatal("second current key is saved")
+	}
+	// rotation which loses the race to a fresh key of other replica is not an error
+	if !k.hasFreshKey() {
+		t.Error("fresh key is not found")
+	}
+}
+
+func TestAccessTokenVerifiedWithJWKS(t *testing.T) {
+	k := newTestKeyRing(t, testutil.OpenDB(t, &SigningKey{}))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(k.jwks())
+	}))
+	defer srv.Close()
+
+	g := &jwtAccessGenerate{keys: k, userOf: func(publicId string) (User, error) {
+		return User{PublicId: publicId, RoleID: schema.RoleManager}, nil
+	}}
+	info := &models.Token{AccessCreateAt: time.Now(), AccessExpiresIn: 10 * time.Minute, Scope: "tasks"}
+	access, refresh, err := g.Token(context.Background(), &oauth2.GenerateBasic{
+		Client:    &models.Client{ID: "web"},
+		UserID:    "u1",
+		TokenInfo: info,
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refresh == "" {
+		t.Error("refresh token is not generated")
+	}
+	again, _, err := g.Token(context.Background(), &oauth2.GenerateBasic{
+		Client:    &models.Client{ID: "web"},
+		UserID:    "u1",
+		TokenInfo: info,
+	}, false)
+	if err != nil || again == access {
+		t.Errorf("token with the same claims = %v, want other token", err)
+	}
+
+	id, err := common.NewJWTVerifier(srv.URL, srv.Client()).Verify(context.Background(), access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.PublicId != "u1" || id.ClientID != "web" || id.Scope != "tasks" ||
+		id.ExpiresAt.Unix() != info.AccessCreateAt.Add(10*time.Minute).Unix() {
+		t.Errorf("identity of access token = %+v", id)
+	}
+}
@@ -2,31 +2,53 @@ package main
 
 import (
 	"ates/common"
+	"ates/schema"
+	"context"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/go-oauth2/oauth2/v4/errors"
 	"github.com/go-oauth2/oauth2/v4/manage"
 	"github.com/go-oauth2/oauth2/v4/server"
-	"github.com/go-oauth2/oauth2/v4/store"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/hamba/avro/v2"
+	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"go.uber.org/zap"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type authSvc struct {
-	logger        *zap.SugaredLogger
-	oauthServer   *server.Server
-	userDb        *gorm.DB
-	kafkaProducer *kafka.Producer
+	logger         *zap.SugaredLogger
+	oauthServer    *server.Server
+	userDb         *gorm.DB
+	kafkaProducer  *kafka.Producer
+	keys           *keyRing
+	tokens         *TokenStore
+	clients        *ClientStore
+	throttle       *loginThrottle
+	twoFactorRoles map[schema.UserRole]bool // roles, which must use second factor
+	permissions    common.Permissions
+	console        io.Writer // one-time secrets for operator are printed here, they are never logged
 }
 
+// version is set on build with -ldflags "-X main.version=..."
+var version = "dev"
+
+// accessTokenTTL is lifetime of access tokens. Services verify them locally, so revoked access token is accepted
+// by them until it expires, except routes which introspect tokens. Refresh tokens live as long as by default.
+const accessTokenTTL = 10 * time.Minute
+
 func main() {
 
 	zapLogger := zap.New(common.GetZapCore(true))
 	logger := zapLogger.Sugar()
 	logger.Info("Starting aTES.Auth service")
+	common.SetProducer("Auth", version)
 
 	webAddress := os.Getenv("ATES_AUTH_SERVER")
 	if webAddress == "" {
@@ -44,6 +66,12 @@ func main() {
 		os.Exit(-1)
 	}
 
+	schemaRegistryUrl := os.Getenv("ATES_SCHEMA_REGISTRY")
+	if schemaRegistryUrl == "" {
+		logger.Fatalf("Missing schema registry url in ATES_SCHEMA_REGISTRY env, use mock:// for in-process registry")
+		os.Exit(-1)
+	}
+
 	e := common.GetNewEcho(logger)
 	e.Use(middleware.Recover())
 
@@ -54,31 +82,42 @@ func main() {
 	}
 
 	// Ensure tables
-	_ = db.AutoMigrate(&User{}, &Role{})
+	_ = db.AutoMigrate(&User{}, &Role{}, &common.OutboxMessage{}, &common.OutboxLease{}, &SigningKey{}, &LoginThrottle{},
+		&UserTOTP{}, &RecoveryCode{}, &EnrollmentToken{})
 	createDefaultRoles(db)
 
-	clientStore := NewClientStore(db)
-
-	manager := manage.NewDefaultManager()
-	manager.SetAuthorizeCodeTokenCfg(manage.DefaultAuthorizeCodeTokenCfg)
-	manager.MapClientStorage(clientStore)
-
-	// Will store access tokens in memory
-	manager.MustTokenStorage(store.NewMemoryTokenStore())
+	err = schema.UseRegistry(schemaRegistryUrl)
+	if err != nil {
+		logger.Fatalf("Failed to connect to schema registry: %s", err.Error())
+		os.Exit(-1)
+	}
+	// producer registers its schemas at start, so incompatible change fails before any event is sent
+	for _, s := range []avro.Schema{schema.UserSchema, schema.UserSessionSchema, schema.UserLockoutSchema} {
+		err = schema.Register(s)
+		if err != nil {
+			logger.Fatalf("Failed to register avro schema: %s", err.Error())
+			os.Exit(-1)
+		}
+	}
 
-	srv := server.NewDefaultServer(manager)
-	srv.SetAllowGetAccessRequest(true)
-	srv.SetClientInfoHandler(server.ClientFormHandler)
+	keyRotation := 24 * time.Hour
+	if v := os.Getenv("ATES_AUTH_KEY_ROTATION"); v != "" {
+		keyRotation, err = time.ParseDuration(v)
+		if err != nil {
+			logger.Fatalf("Bad duration in ATES_AUTH_KEY_ROTATION env")
+			os.Exit(-1)
+		}
+	}
+	keys, err := newKeyRing(db, logger, keyRotation, accessTokenTTL)
+	if err != nil {
+		logger.Fatalf("Failed to prepare signing keys: %s", err.Error())
+		os.Exit(-1)
+	}
 
-	srv.SetInternalErrorHandler(func(err error) (re *errors.Response) {
-		logger.Errorf("Internal Error: %s", err.Error())
-		return
-	})
-	srv.SetResponseErrorHandler(func(re *errors.Response) {
-		logger.Errorf("Response Error: %s", re.Error.Error())
+	kafkaProducer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers":  "localhost",
+		"enable.idempotence": true, // keeps order of events with the same key on retries
 	})
-
-	kafkaProducer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": "localhost"})
 	if err != nil {
 		logger.Fatalf("Failed to initialize Kafka Producer")
 		os.Exit(-1)
@@ -97,22 +136,163 @@ func main() {
 		}
 	}()
 
-	app := authSvc{
-		logger:        logger,
-		oauthServer:   srv,
-		userDb:        db,
-		kafkaProducer: kafkaProducer,
+	// permission matrix maps actions to roles and scopes, ATES_PERMISSIONS is path of JSON file
+	permissions, err := common.LoadPermissions(os.Getenv("ATES_PERMISSIONS"))
+	if err != nil {
+		logger.Fatalf("Failed to load permissions: %s", err.Error())
+		os.Exit(-1)
 	}
+	// roles, which must use second factor, are given by names in ATES_AUTH_2FA_ROLES
+	twoFactorRolesNames := os.Getenv("ATES_AUTH_2FA_ROLES")
+	if twoFactorRolesNames == "" {
+		twoFactorRolesNames = defaultTwoFactorRoles
+	}
+	twoFactorRoles, err := parseTwoFactorRoles(twoFactorRolesNames)
+	if err != nil {
+		logger.Fatalf("Failed to parse ATES_AUTH_2FA_ROLES: %s", err.Error())
+		os.Exit(-1)
+	}
+
+	app := newAuthSvc(db, keys, logger)
+	app.kafkaProducer = kafkaProducer
+	app.permissions = permissions
+	app.twoFactorRoles = twoFactorRoles
+
+	err = app.bootstrapAdmin(os.Getenv("ATES_AUTH_ADMIN_LOGIN"), os.Getenv("ATES_AUTH_ADMIN_PASSWORD"))
+	if err != nil {
+		logger.Fatalf("Failed to create admin: %s", err.Error())
+		os.Exit(-1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go common.NewOutboxRelay(db, kafkaProducer, logger).Run(ctx)
+	go keys.Run(ctx)
+	go app.tokens.RunGC(ctx, time.Minute)
+	go app.throttle.RunGC(ctx, time.Minute, logger)
+
+	app.routes(e)
+
+	common.StartEcho(ctx, e, webAddress, logger)
+}
+
+// newAuthSvc builds Auth with OAuth2 server on clients and tokens stored in db, access tokens are signed with keys
+func newAuthSvc(db *gorm.DB, keys *keyRing, logger *zap.SugaredLogger) *authSvc {
+	clientStore := NewClientStore(db)
+
+	manager := manage.NewDefaultManager()
+	manager.SetAuthorizeCodeTokenCfg(&manage.Config{AccessTokenExp: accessTokenTTL,
+		RefreshTokenExp: manage.DefaultAuthorizeCodeTokenCfg.RefreshTokenExp, IsGenerateRefresh: true})
+	manager.SetPasswordTokenCfg(&manage.Config{AccessTokenExp: accessTokenTTL,
+		RefreshTokenExp: manage.DefaultPasswordTokenCfg.RefreshTokenExp, IsGenerateRefresh: true})
+	manager.SetClientTokenCfg(&manage.Config{AccessTokenExp: accessTokenTTL})
+	manager.MapClientStorage(clientStore)
+	manager.SetValidateURIHandler(validateRedirectURI)
+
+	// tokens are stored in MySQL, so several replicas of Auth can run behind load balancer
+	tokenStore := NewTokenStore(db, logger)
+	manager.MapTokenStorage(tokenStore)
+	// refresh token is rotated: new refresh token on every refresh, the old one is removed
+	manager.SetRefreshTokenCfg(&manage.RefreshingConfig{AccessTokenExp: accessTokenTTL, IsGenerateRefresh: true,
+		IsRemoveAccess: true, IsRemoveRefreshing: true})
+
+	srv := server.NewDefaultServer(manager)
+	srv.SetAllowGetAccessRequest(true)
+	srv.SetClientInfoHandler(server.ClientFormHandler)
+	// grant types and scopes are allowed per client
+	srv.SetClientAuthorizedHandler(clientStore.AllowsGrant)
+	srv.SetClientScopeHandler(clientStore.AllowsScope)
+	// browser clients use authorization code flow, and must prove it with PKCE
+	requirePKCE(srv)
+
+	srv.SetInternalErrorHandler(func(err error) (re *errors.Response) {
+		if re = throttledResponse(err); re != nil {
+			return re
+		}
+		if re = twoFactorResponse(err); re != nil {
+			return re
+		}
+		logger.Errorf("Internal Error: %s", err.Error())
+		return
+	})
+	srv.SetResponseErrorHandler(func(re *errors.Response) {
+		logger.Errorf("Response Error: %s", re.Error.Error())
+	})
+
+	app := &authSvc{
+		logger:      logger,
+		oauthServer: srv,
+		userDb:      db,
+		keys:        keys,
+		tokens:      tokenStore,
+		clients:     clientStore,
+		throttle:    &loginThrottle{db: db},
+		console:     os.Stderr,
+	}
+	tokenStore.SetLoginHandler(app.onLogin)
+	// access tokens are JWT with role of user, services verify them with keys from JWKS endpoint
+	manager.MapAccessGenerate(&jwtAccessGenerate{keys: keys, userOf: app.findUser})
 	srv.SetPasswordAuthorizationHandler(app.checkPassword)
+	srv.SetUserAuthorizationHandler(app.authorizeUser)
+	return app
+}
+
+// routes registers endpoints of Auth
+func (svc *authSvc) routes(e *echo.Echo) {
+	// Browser clients get tokens with authorization code flow and PKCE, the user signs in on the page of Auth.
+	// Password flow is left for trusted backend clients.
+
+	e.GET("/oauth/authorize", svc.authorize)
+	e.POST("/oauth/authorize", svc.authorize)
+	e.GET("/oauth/token", svc.token)
+	e.POST("/oauth/token", svc.token)
+	e.POST("/oauth/revoke", svc.revoke)
+	e.POST("/logout/all", svc.logoutAll)
+	e.POST("/register", svc.registerUser)
+	e.GET(common.JWKSPath, svc.jwks)
+	e.POST(common.IntrospectPath, svc.introspect)
+	e.POST("/2fa/enroll", svc.enrollTwoFactor)
+	e.POST("/2fa/confirm", svc.confirmTwoFactor)
 
-	// At this time we support only token requests with Password flow (provide username/password)
-	// Not secure enough
+	// user and admin endpoints are authenticated with access tokens issued by this service. Tokens are checked
+	// against token store on every request without cache, so revoked tokens and changed roles are seen at once.
+	auth := common.NewAuthenticator(common.VerifierFunc(svc.verifyAccessToken), svc.lookupUser, svc.permissions,
+		0, svc.logger)
 
-	e.GET("/oauth/token", app.token)
-	//e.GET("oauth/authorize", app.authorize)
-	e.POST("/register", app.registerUser)
-	e.GET("/verify", app.verify)
-	e.POST("/verify", app.verify)
+	e.PATCH("/users/:uid", svc.updateUser, auth.Allow("user.update"))
+	e.DELETE("/users/:uid", svc.deleteUser, auth.Allow("user.manage"))
+	e.POST("/admin/users", svc.provisionUser, auth.Allow("user.manage"))
+	e.POST("/admin/users/:uid/unlock", svc.unlockUser, auth.Allow("user.manage"))
+	e.DELETE("/admin/users/:uid/2fa", svc.resetTwoFactor, auth.Allow("user.manage"))
+	e.POST("/admin/users/:uid/2fa/enrollment", svc.issueTwoFactorEnrollment, auth.Allow("user.manage"))
 
-	e.Logger.Fatal(e.Start(webAddress))
+	e.GET("/sessions", svc.listSessions, auth.Allow("session.own"))
+	e.DELETE("/sessions", svc.revokeSessions, auth.Allow("session.own"))
+	e.DELETE("/sessions/:id", svc.revokeSession, auth.Allow("session.own"))
+	e.GET("/admin/users/:uid/sessions", svc.listSessions, auth.Allow("session.manage"))
+	e.DELETE("/admin/users/:uid/sessions", svc.revokeSessions, auth.Allow("session.manage"))
+	e.DELETE("/admin/users/:uid/sessions/:id", svc.revokeSession, auth.Allow("session.manage"))
+
+	e.GET("/admin/clients", svc.listClients, auth.Allow("client.manage"))
+	e.POST("/admin/clients", svc.createClient, auth.Allow("client.manage"))
+	e.GET("/admin/clients/:id", svc.getClient, auth.Allow("client.manage"))
+	e.PUT("/admin/clients/:id", svc.updateClient, auth.Allow("client.manage"))
+	e.DELETE("/admin/clients/:id", svc.deleteClient, auth.Allow("client.manage"))
+	e.POST("/admin/clients/:id/secret", svc.rotateClientSecret, auth.Allow("client.manage"))
+}
+
+// verifyAccessToken checks access token of user and admin endpoints of Auth against token store
+func (svc *authSvc) verifyAccessToken(ctx context.Context, token string) (common.Identity, error) {
+	ti, err := svc.oauthServer.Manager.LoadAccessToken(ctx, token)
+	if err != nil {
+		return common.Identity{}, err
+	}
+	if err = svc.tokens.markSeen(ctx, token); err != nil {
+		svc.logger.Error(err)
+	}
+	return common.Identity{
+		PublicId:  ti.GetUserID(),
+		ClientID:  ti.GetClientID(),
+		Scope:     ti.GetScope(),
+		ExpiresAt: ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn()),
+	}, nil
 }
@@ -3,49 +3,91 @@ package main
 import (
 	"ates/common"
 	"ates/schema"
+	"ates/schema/events"
+	"crypto/subtle"
 	"errors"
-	"github.com/hamba/avro/v2"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"sync"
 )
 
-type AuthVerification struct {
-	PublicId string `json:"sub"`
-}
-
 type User struct {
 	gorm.Model   `json:"-"`
-	PublicId     string          `gorm:"default:(uuid());unique" json:"uid" avro:"uid"`
-	Login        string          `gorm:"unique" json:"login" avro:"login"`
+	PublicId     string          `gorm:"default:(uuid());unique" json:"uid"`
+	Login        string          `gorm:"unique" json:"login"`
 	Password     string          `gorm:"-" json:"password,omitempty"`
 	PasswordHash string          `json:"-"`
-	PasswordSalt string          `json:"-"`
-	RoleID       schema.UserRole `json:"roleId" avro:"roleId"`
+	PasswordSalt string          `json:"-"` // only for legacy hashes, bcrypt keeps salt in hash
+	HashVersion  int             `gorm:"not null;default:0" json:"-"`
+	RoleID       schema.UserRole `json:"roleId"`
 	Role         Role            `json:"-"`
+	Active       bool            `gorm:"not null;default:true" json:"active"` // deactivated user can't log in
+}
+
+// Versions of password hash
+const (
+	hashLegacySHA256 = 0 // SHA256 of password and salt, users are moved to bcrypt on login
+	hashBcrypt       = 1
+)
+
+// bcryptCost is cost of new hashes, hashes with lower cost are recalculated on login
+const bcryptCost = 12
+
+// dummyHash is checked for unknown login, so response time doesn't reveal which logins exist
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcryptCost)
+	return hash
+})
+
+func checkDummyPassword(password string) {
+	_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
 }
 
 func (u *User) calculatePasswordHash() error {
 	if u.Password == "" {
 		return errors.New("password must be set")
 	}
-	u.PasswordSalt = common.GenerateRandomString(10)
-	u.PasswordHash = common.HashSHA256([]byte(u.Password + u.PasswordSalt))
+	if len(u.Password) > 72 {
+		return errors.New("password must not be longer than 72 bytes")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	u.PasswordSalt = ""
+	u.HashVersion = hashBcrypt
 	return nil
 }
 
-func (u *User) checkPassword(password string) bool {
+// checkPassword verifies password, needsRehash is true when hash of valid password is outdated
+func (u *User) checkPassword(password string) (ok bool, needsRehash bool) {
 	if u.PasswordHash == "" {
-		return false
+		return false, false
 	}
-	hash := common.HashSHA256([]byte(password + u.PasswordSalt))
-	return hash == u.PasswordHash
-}
-
-func (u *User) marshal() ([]byte, error) {
-	return avro.Marshal(schema.UserSchema, u)
+	switch u.HashVersion {
+	case hashLegacySHA256:
+		hash := common.HashSHA256([]byte(password + u.PasswordSalt))
+		ok = subtle.ConstantTimeCompare([]byte(hash), []byte(u.PasswordHash)) == 1
+		return ok, ok
+	case hashBcrypt:
+		if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(u.PasswordHash))
+		return true, err == nil && cost < bcryptCost
+	}
+	return false, false
 }
 
-func (u *User) unmarshal(b []byte) error {
-	return avro.Unmarshal(schema.UserSchema, b, u)
+// toEvent maps User to event, only public attributes are sent
+func (u *User) toEvent() events.User {
+	return events.User{
+		Uid:    u.PublicId,
+		Login:  u.Login,
+		RoleId: int(u.RoleID),
+		Active: u.Active,
+	}
 }
 
 type Role struct {
@@ -78,4 +120,10 @@ func createDefaultRoles(db *gorm.DB) {
 		},
 		Name: "Accountant",
 	})
+	db.Create(&Role{
+		Model: gorm.Model{
+			ID: 5,
+		},
+		Name: "Chief",
+	})
 }
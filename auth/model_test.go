@@ -0,0 +1,45 @@
+package main
+
+import (
+	"ates/common"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+// legacyUser has SHA256 hash of password, as users created before bcrypt
+func legacyUser(login, password string) User {
+	return User{Login: login, PasswordSalt: "salt", HashVersion: hashLegacySHA256,
+		PasswordHash: common.HashSHA256([]byte(password + "salt")), Active: true}
+}
+
+func TestCheckPassword(t *testing.T) {
+	current := User{Password: "secret"}
+	if err := current.calculatePasswordHash(); err != nil {
+		t.Fatal(err)
+	}
+	cheap, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		user       User
+		password   string
+		ok, rehash bool
+	}{
+		{"legacy", legacyUser("popug", "secret"), "secret", true, true},
+		{"legacy wrong", legacyUser("popug", "secret"), "wrong", false, false},
+		{"legacy without salt", legacyUser("popug", "secret"), "secretsalt", false, false},
+		{"bcrypt", current, "secret", true, false},
+		{"bcrypt wrong", current, "wrong", false, false},
+		{"bcrypt of low cost", User{PasswordHash: string(cheap), HashVersion: hashBcrypt}, "secret", true, true},
+		{"no hash", User{HashVersion: hashLegacySHA256}, "", false, false},
+		{"unknown version", User{PasswordHash: current.PasswordHash, HashVersion: 7}, "secret", false, false},
+	}
+	for _, tt := range tests {
+		ok, rehash := tt.user.checkPassword(tt.password)
+		if ok != tt.ok || rehash != tt.rehash {
+			t.Errorf("%s: checkPassword = %v, %v, want %v, %v", tt.name, ok, rehash, tt.ok, tt.rehash)
+		}
+	}
+}
@@ -2,47 +2,116 @@ package main
 
 import (
 	"ates/common"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"ates/schema/events"
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"time"
 )
 
-// notifyAsync sends notification to Kafka
-func (svc *authSvc) notifyAsync(eventType string, e interface{}) {
+// sessionChange is login or logout of user session (token family) for audit
+type sessionChange struct {
+	item   TokenStoreItem
+	reason string
+}
 
-	topic := "user.lifecycle"
+func (s sessionChange) toEvent() events.UserSession {
+	return events.UserSession{
+		Uid:       s.item.UserID,
+		ClientId:  s.item.ClientID,
+		SessionId: s.item.FamilyID,
+		Reason:    s.reason,
+	}
+}
+
+// lockoutChange is lockout of user after failed logins, or unlock by admin, for audit
+type lockoutChange struct {
+	user       User
+	failures   int
+	until      time.Time
+	unlockedBy string
+}
 
-	msg := kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-		Key:            []byte(common.GenerateRandomString(10)),
-		Value:          nil,
+func (l lockoutChange) toEvent() events.UserLockout {
+	e := events.UserLockout{
+		Uid:        l.user.PublicId,
+		Failures:   l.failures,
+		UnlockedBy: l.unlockedBy,
 	}
+	if !l.until.IsZero() {
+		e.LockedUntil = l.until.UnixMilli()
+	}
+	return e
+}
+
+// notify stores notification in outbox within transaction tx, it is sent to Kafka by OutboxRelay
+func (svc *authSvc) notify(ctx context.Context, tx *gorm.DB, eventType string, e interface{}) error {
 
-	common.AppendKafkaHeader(&msg, "event", eventType)
-	common.AppendKafkaHeader(&msg, "producer", "Auth")
+	var topic string
+	var event *common.Event
 
 	switch e.(type) {
 	case User:
-		common.AppendKafkaHeader(&msg, "eventVersion", "v1")
 		switch eventType {
-		case "User.Created":
+		case "User.Created", "User.Updated", "User.Deleted":
+			// every event carries the whole public state of user, consumers overwrite their copies
+			topic = "user.lifecycle"
 			u := e.(User)
-			userForNotify := User{
-				PublicId: u.PublicId,
-				Login:    u.Login,
-				RoleID:   u.RoleID,
+			ue := u.toEvent()
+			b, err := ue.Marshal()
+			if err != nil {
+				return fmt.Errorf("failed to marshal User %s to avro: %w", u.PublicId, err)
 			}
-			b, err := userForNotify.marshal()
+			event = common.NewEvent(ctx, eventType, "v2", b)
+			event.Key = []byte(u.PublicId)
+		}
+	case sessionChange:
+		switch eventType {
+		case "User.LoggedIn", "User.LoggedOut":
+			// audit events have their own topic, business consumers of user.lifecycle don't need them
+			topic = "user.audit"
+			s := e.(sessionChange)
+			se := s.toEvent()
+			b, err := se.Marshal()
+			if err != nil {
+				return fmt.Errorf("failed to marshal session %s to avro: %w", s.item.FamilyID, err)
+			}
+			event = common.NewEvent(ctx, eventType, "v1", b)
+			event.Key = []byte(s.item.UserID)
+		}
+	case lockoutChange:
+		switch eventType {
+		case "User.LockedOut", "User.Unlocked":
+			topic = "user.audit"
+			l := e.(lockoutChange)
+			le := l.toEvent()
+			b, err := le.Marshal()
 			if err != nil {
-				svc.logger.Errorf("failed to marshal User %s to avro", u.PublicId)
+				return fmt.Errorf("failed to marshal lockout of User %s to avro: %w", l.user.PublicId, err)
 			}
-			msg.Value = b
+			event = common.NewEvent(ctx, eventType, "v1", b)
+			event.Key = []byte(l.user.PublicId)
 		}
 	}
 
-	if msg.Value != nil {
-		err := svc.kafkaProducer.Produce(&msg, nil)
+	if event == nil {
+		return fmt.Errorf("no notification for %s", eventType)
+	}
+	return common.StoreInOutbox(tx, event.Message(topic))
+}
+
+// notifyLogout stores User.LoggedOut for every session of deleted tokens
+func (svc *authSvc) notifyLogout(ctx context.Context, tx *gorm.DB, items []TokenStoreItem, reason string) error {
+	seen := map[string]bool{}
+	for _, item := range items {
+		if item.UserID == "" || seen[item.FamilyID] {
+			continue
+		}
+		seen[item.FamilyID] = true
+		err := svc.notify(ctx, tx, "User.LoggedOut", sessionChange{item: item, reason: reason})
 		if err != nil {
-			svc.logger.Errorf("Failed to send event notification on %s", eventType)
-			svc.logger.Error(err)
+			return err
 		}
 	}
+	return nil
 }
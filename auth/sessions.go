@@ -0,0 +1,108 @@
+package main
+
+import (
+	"ates/common"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+// sessionResponse shows session to its user or admin, id is id of token family, ip is address of login
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	ClientID   string    `json:"clientId"`
+	IssuedAt   time.Time `json:"issuedAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	IP         string    `json:"ip"`
+}
+
+// sessionsOwner returns public id of user, whose sessions are managed: current user on /sessions,
+// or user from path on admin endpoints
+func sessionsOwner(c echo.Context) string {
+	if uid := c.Param("uid"); uid != "" {
+		return uid
+	}
+	return common.CurrentUser(c).PublicId
+}
+
+// listSessions renders active sessions of user: clients and devices, which hold valid tokens
+// GET /sessions, GET /admin/users/:uid/sessions
+func (svc *authSvc) listSessions(c echo.Context) error {
+	sessions, err := svc.tokens.sessions(c.Request().Context(), sessionsOwner(c))
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	res := make([]sessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		res = append(res, sessionResponse{
+			ID:         s.FamilyID,
+			ClientID:   s.ClientID,
+			IssuedAt:   s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			IP:         s.IP,
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// revokeSession revokes one session of user with all its tokens
+// DELETE /sessions/:id, DELETE /admin/users/:uid/sessions/:id
+func (svc *authSvc) revokeSession(c echo.Context) error {
+	ctx := c.Request().Context()
+	owner := sessionsOwner(c)
+	session, err := svc.tokens.session(ctx, owner, c.Param("id"))
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if session == nil {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "session not found"))
+	}
+
+	err = svc.userDb.Transaction(func(tx *gorm.DB) error {
+		items, err := svc.tokens.revokeFamily(tx, session.FamilyID)
+		if err != nil {
+			return err
+		}
+		return svc.notifyLogout(ctx, tx, items, revokeReason(c))
+	})
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, common.FromKeysAndValues("error", "failed to revoke session"))
+	}
+	svc.logger.Infof("Session %s of user %s is revoked by %s", session.FamilyID, owner, common.CurrentUser(c).PublicId)
+	return c.JSON(http.StatusOK, common.FromKeysAndValues("result", "session is revoked"))
+}
+
+// revokeSessions revokes all sessions of user
+// DELETE /sessions, DELETE /admin/users/:uid/sessions
+func (svc *authSvc) revokeSessions(c echo.Context) error {
+	ctx := c.Request().Context()
+	owner := sessionsOwner(c)
+	err := svc.userDb.Transaction(func(tx *gorm.DB) error {
+		items, err := svc.tokens.revokeUser(tx, owner)
+		if err != nil {
+			return err
+		}
+		return svc.notifyLogout(ctx, tx, items, revokeReason(c))
+	})
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, common.FromKeysAndValues("error", "failed to revoke sessions"))
+	}
+	svc.logger.Infof("All sessions of user %s are revoked by %s", owner, common.CurrentUser(c).PublicId)
+	return c.JSON(http.StatusOK, common.FromKeysAndValues("result", "sessions are revoked"))
+}
+
+// revokeReason is reason of User.LoggedOut: the user revokes own sessions, or admin does it
+func revokeReason(c echo.Context) string {
+	if c.Param("uid") != "" {
+		return "admin_revoked"
+	}
+	if c.Param("id") != "" {
+		return "revoked"
+	}
+	return "logout_everywhere"
+}
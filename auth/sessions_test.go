@@ -0,0 +1,169 @@
+package main
+
+import (
+	"ates/schema"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postFrom posts form to path from address ip
+func postFrom(e *echo.Echo, ip, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.RemoteAddr = ip + ":40000"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func listSessionsOf(t *testing.T, e *echo.Echo, token string) []sessionResponse {
+	t.Helper()
+	rec := serve(e, http.MethodGet, "/sessions", token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sessions: %d %s", rec.Code, rec.Body.String())
+	}
+	var sessions []sessionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
+
+func TestSessionAddressOfAuthorizationCode(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	e.IPExtractor = echo.ExtractIPDirect()
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	const redirect = "https://app.example.com/cb"
+	hash, err := hashClientSecret("web-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.clients.Create(context.Background(), &Client{ID: "web", SecretHash: hash, Domain: redirect,
+		ClientData: ClientData{GrantTypes: []oauth2.GrantType{oauth2.AuthorizationCode, oauth2.Refreshing}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// user signs in on the login page from own address
+	verifier := strings.Repeat("v", 43)
+	challenge := sha256.Sum256([]byte(verifier))
+	rec := postFrom(e, "198.51.100.7", "/oauth/authorize", url.Values{"response_type": {"code"},
+		"client_id": {"web"}, "redirect_uri": {redirect}, "state": {"s1"},
+		"code_challenge": {base64.RawURLEncoding.EncodeToString(challenge[:])}, "code_challenge_method": {"S256"},
+		"login": {"popug"}, "password": {"secret"}, "consent": {"allow"}})
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || err != nil || location.Query().Get("code") == "" {
+		t.Fatalf("authorize: %d %s %s", rec.Code, rec.Header().Get("Location"), rec.Body.String())
+	}
+
+	// backend of client exchanges code and refreshes tokens from its own address
+	rec = postFrom(e, "10.0.0.9", "/oauth/token", url.Values{"grant_type": {"authorization_code"},
+		"code": {location.Query().Get("code")}, "redirect_uri": {redirect}, "client_id": {"web"},
+		"client_secret": {"web-secret"}, "code_verifier": {verifier}})
+	var tokens tokenResponse
+	if err = json.Unmarshal(rec.Body.Bytes(), &tokens); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("code exchange: %d %s", rec.Code, rec.Body.String())
+	}
+	sessions := listSessionsOf(t, e, tokens.AccessToken)
+	if len(sessions) != 1 || sessions[0].IP != "198.51.100.7" || sessions[0].ClientID != "web" {
+		t.Fatalf("sessions %+v, want one with address of user", sessions)
+	}
+
+	svc.userDb.Model(&Session{}).Where("family_id = ?", sessions[0].ID).
+		Update("last_seen_at", time.Now().Add(-time.Hour))
+	rec = postFrom(e, "10.0.0.9", "/oauth/token", refreshForm("web", "web-secret", tokens.RefreshToken))
+	if err = json.Unmarshal(rec.Body.Bytes(), &tokens); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("refresh: %d %s", rec.Code, rec.Body.String())
+	}
+	refreshed := listSessionsOf(t, e, tokens.AccessToken)
+	if len(refreshed) != 1 || refreshed[0].IP != "198.51.100.7" || refreshed[0].ID != sessions[0].ID {
+		t.Errorf("sessions after refresh %+v, want the same address of user", refreshed)
+	}
+	if time.Since(refreshed[0].LastSeenAt) > time.Minute {
+		t.Errorf("session is last seen at %v, want time of refresh", refreshed[0].LastSeenAt)
+	}
+}
+
+func TestSessionSeenOnIntrospection(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials)
+	createTestClient(t, svc, "tm", "tm-secret", oauth2.ClientCredentials)
+	tokens := login(t, e, "web", "web-secret", "popug", "secret")
+	past := time.Now().Add(-time.Hour)
+	svc.userDb.Model(&Session{}).Where("user_id = ?", svc.mustFindUser(t, "popug").PublicId).
+		Update("last_seen_at", past)
+
+	rec := serve(e, http.MethodPost, "/oauth/introspect", "", url.Values{"token": {tokens.AccessToken},
+		"client_id": {"tm"}, "client_secret": {"tm-secret"}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"active":true`) {
+		t.Fatalf("introspection: %d %s", rec.Code, rec.Body.String())
+	}
+	var s Session
+	svc.userDb.First(&s)
+	if !s.LastSeenAt.After(past) {
+		t.Errorf("session is last seen at %v after introspection of its token", s.LastSeenAt)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	createTestUser(t, svc, "admin", "admin-secret", schema.RoleAdmin)
+	popug := createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestUser(t, svc, "other", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials)
+	admin := login(t, e, "web", "web-secret", "admin", "admin-secret")
+	first := login(t, e, "web", "web-secret", "popug", "secret")
+	second := login(t, e, "web", "web-secret", "popug", "secret")
+	other := login(t, e, "web", "web-secret", "other", "secret")
+
+	sessions := listSessionsOf(t, e, first.AccessToken)
+	if len(sessions) != 2 {
+		t.Fatalf("sessions %+v, want 2", sessions)
+	}
+	firstID := sessions[1].ID // the latest seen first
+	for _, s := range sessions {
+		if s.IssuedAt.IsZero() || s.LastSeenAt.IsZero() {
+			t.Errorf("session without times: %+v", s)
+		}
+	}
+
+	// sessions of other users are not found
+	if rec := serve(e, http.MethodDelete, "/sessions/"+firstID, other.AccessToken, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("revoke session of other user: %d", rec.Code)
+	}
+	if rec := serve(e, http.MethodGet, "/admin/users/"+popug.PublicId+"/sessions", other.AccessToken, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("sessions of other user listed by user: %d", rec.Code)
+	}
+
+	rec := serve(e, http.MethodDelete, "/admin/users/"+popug.PublicId+"/sessions/"+firstID, admin.AccessToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke by admin: %d %s", rec.Code, rec.Body.String())
+	}
+	left := listSessionsOf(t, e, second.AccessToken)
+	if len(left) != 1 || left[0].ID == firstID {
+		t.Errorf("sessions after revocation %+v, want only the second one", left)
+	}
+	var revoked int
+	for _, s := range []tokenResponse{first, second} {
+		if serve(e, http.MethodGet, "/sessions", s.AccessToken, nil).Code == http.StatusUnauthorized {
+			revoked++
+		}
+	}
+	if revoked != 1 {
+		t.Errorf("%d sessions are refused, want the revoked one", revoked)
+	}
+	if names := outboxEvents(t, svc); countEvents(names, "User.LoggedOut") != 1 {
+		t.Errorf("events %v, want one User.LoggedOut", names)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	oauthErrors "github.com/go-oauth2/oauth2/v4/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LoginThrottle counts failed logins by login or by IP address. It is kept in database, so all replicas of Auth
+// apply the same limits.
+type LoginThrottle struct {
+	Key           string `gorm:"primaryKey;type:varchar(255)"` // "login:<login>" or "ip:<address>"
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// throttlePolicy delays next attempt exponentially after free attempts are spent, and locks out after many failures
+type throttlePolicy struct {
+	freeAttempts int           // failures without delay
+	baseDelay    time.Duration // delay after the first counted failure, it is doubled on every next one
+	maxDelay     time.Duration
+	lockoutAfter int // every lockoutAfter failures lock out for lockout, 0 - never
+	lockout      time.Duration
+	resetAfter   time.Duration // failures are forgotten after this time without new ones
+}
+
+// loginPolicy protects single account, failures are counted for unknown logins too, so lockout doesn't reveal users
+var loginPolicy = throttlePolicy{
+	freeAttempts: 3,
+	baseDelay:    time.Second,
+	maxDelay:     5 * time.Minute,
+	lockoutAfter: 10,
+	lockout:      30 * time.Minute,
+	resetAfter:   time.Hour,
+}
+
+// ipPolicy slows down password spraying from one address over many logins
+var ipPolicy = throttlePolicy{
+	freeAttempts: 20,
+	baseDelay:    time.Second,
+	maxDelay:     15 * time.Minute,
+	resetAfter:   time.Hour,
+}
+
+// blockedUntil returns time before which attempts are refused
+func (p throttlePolicy) blockedUntil(t LoginThrottle, now time.Time) time.Time {
+	if t.LockedUntil != nil && t.LockedUntil.After(now) {
+		return *t.LockedUntil
+	}
+	if t.Failures < p.freeAttempts || now.Sub(t.LastFailureAt) > p.resetAfter {
+		return time.Time{}
+	}
+	delay := p.maxDelay
+	if n := t.Failures - p.freeAttempts; n < 30 {
+		delay = min(p.baseDelay<<n, p.maxDelay)
+	}
+	return t.LastFailureAt.Add(delay)
+}
+
+// throttledError is returned when login attempt is refused without checking password
+type throttledError struct {
+	retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("too many failed attempts, retry after %s", e.retryAfter.Round(time.Second))
+}
+
+// throttledResponse is OAuth error response for throttledError, or nil for other errors
+func throttledResponse(err error) *oauthErrors.Response {
+	var te *throttledError
+	if !errors.As(err, &te) {
+		return nil
+	}
+	re := oauthErrors.NewResponse(errors.New("too_many_attempts"), http.StatusTooManyRequests)
+	re.Description = te.Error()
+	re.SetHeader("Retry-After", strconv.Itoa(int(te.retryAfter.Seconds())+1))
+	return re
+}
+
+type loginThrottle struct {
+	db *gorm.DB
+}
+
+func loginKey(login string) string {
+	return "login:" + login
+}
+
+// keys returns keys of counters for attempt, address is not known for requests without context of client
+func keys(login, ip string) []string {
+	if ip == "" {
+		return []string{loginKey(login)}
+	}
+	return []string{loginKey(login), "ip:" + ip}
+}
+
+type clientIPKey struct{}
+
+// withClientIP returns context with address of client, which logs in
+func withClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+func clientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// check returns error if attempt to log in with login from address ip must be refused
+func (t *loginThrottle) check(ctx context.Context, login, ip string) error {
+	var rows []LoginThrottle
+	err := t.db.WithContext(ctx).Where("`key` in ?", keys(login, ip)).Find(&rows).Error
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var until time.Time
+	for _, row := range rows {
+		policy := loginPolicy
+		if row.Key != loginKey(login) {
+			policy = ipPolicy
+		}
+		if u := policy.blockedUntil(row, now); u.After(until) {
+			until = u
+		}
+	}
+	if until.After(now) {
+		return &throttledError{retryAfter: until.Sub(now)}
+	}
+	return nil
+}
+
+// fail counts failed attempt. onLockout is called within the same transaction when login gets locked out.
+func (t *loginThrottle) fail(ctx context.Context, login, ip string,
+	onLockout func(tx *gorm.DB, failures int, until time.Time) error) error {
+
+	return t.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for _, key := range keys(login, ip) {
+			policy := loginPolicy
+			if key != loginKey(login) {
+				policy = ipPolicy
+			}
+
+			row := LoginThrottle{Key: key}
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("`key` = ?", key).Limit(1).Find(&row).Error
+			if err != nil {
+				return err
+			}
+			if now.Sub(row.LastFailureAt) > policy.resetAfter {
+				row.Failures = 0
+			}
+			row.Failures++
+			row.LastFailureAt = now
+			lockedOut := policy.lockoutAfter > 0 && row.Failures%policy.lockoutAfter == 0
+			if lockedOut {
+				until := now.Add(policy.lockout)
+				row.LockedUntil = &until
+			}
+			err = tx.Save(&row).Error
+			if err != nil {
+				return err
+			}
+			if lockedOut && onLockout != nil {
+				err = onLockout(tx, row.Failures, *row.LockedUntil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// succeed forgets failures of login, failures of address are kept: one valid account must not reset them
+func (t *loginThrottle) succeed(ctx context.Context, login string) error {
+	return t.db.WithContext(ctx).Where("`key` = ?", loginKey(login)).Delete(&LoginThrottle{}).Error
+}
+
+// unlock removes lockout and failures of login within transaction tx, returns true if login was locked out
+func (t *loginThrottle) unlock(tx *gorm.DB, login string) (bool, error) {
+	var row LoginThrottle
+	result := tx.Where("`key` = ?", loginKey(login)).Limit(1).Find(&row)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	err := tx.Delete(&row).Error
+	return row.LockedUntil != nil && row.LockedUntil.After(time.Now()), err
+}
+
+// RunGC purges counters, which are reset and not locked out, periodically until context is cancelled
+func (t *loginThrottle) RunGC(ctx context.Context, interval time.Duration, logger *zap.SugaredLogger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	resetAfter := max(loginPolicy.resetAfter, ipPolicy.resetAfter)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			result := t.db.WithContext(ctx).
+				Where("last_failure_at < ? and (locked_until is null or locked_until < ?)", now.Add(-resetAfter), now).
+				Delete(&LoginThrottle{})
+			if result.Error != nil {
+				logger.Errorf("Failed to purge login throttle counters: %s", result.Error.Error())
+			} else if result.RowsAffected > 0 {
+				logger.Infof("Purged %d login throttle counters", result.RowsAffected)
+			}
+		}
+	}
+}
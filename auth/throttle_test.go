@@ -0,0 +1,178 @@
+package main
+
+import (
+	"ates/common/testutil"
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+var testPolicy = throttlePolicy{
+	freeAttempts: 3,
+	baseDelay:    time.Second,
+	maxDelay:     time.Minute,
+	lockoutAfter: 10,
+	lockout:      30 * time.Minute,
+	resetAfter:   time.Hour,
+}
+
+func TestBlockedUntil(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		failures int
+		delay    time.Duration // 0 means not blocked
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 0},
+		{3, time.Second}, // free attempts are spent
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{8, 32 * time.Second},
+		{9, time.Minute}, // capped
+		{40, time.Minute},
+		{1000, time.Minute}, // shift doesn't overflow
+	}
+	for _, tt := range tests {
+		got := testPolicy.blockedUntil(LoginThrottle{Failures: tt.failures, LastFailureAt: now}, now)
+		want := time.Time{}
+		if tt.delay > 0 {
+			want = now.Add(tt.delay)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%d failures: blocked until %v, want %v", tt.failures, got, want)
+		}
+	}
+}
+
+func TestBlockedUntilReset(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	row := LoginThrottle{Failures: 8, LastFailureAt: now.Add(-testPolicy.resetAfter - time.Second)}
+	if got := testPolicy.blockedUntil(row, now); !got.IsZero() {
+		t.Errorf("failures older than resetAfter block until %v", got)
+	}
+
+	// lockout lasts its time, even if delay is over
+	until := now.Add(10 * time.Minute)
+	row = LoginThrottle{Failures: 10, LastFailureAt: now.Add(-2 * time.Hour), LockedUntil: &until}
+	if got := testPolicy.blockedUntil(row, now); !got.Equal(until) {
+		t.Errorf("locked out login is blocked until %v, want %v", got, until)
+	}
+	past := now.Add(-time.Minute)
+	row.LockedUntil = &past
+	if got := testPolicy.blockedUntil(row, now); !got.IsZero() {
+		t.Errorf("expired lockout blocks until %v", got)
+	}
+}
+
+func TestLoginThrottleLockout(t *testing.T) {
+	th := &loginThrottle{db: testutil.OpenDB(t, &LoginThrottle{})}
+	ctx := context.Background()
+
+	var lockouts []int
+	onLockout := func(tx *gorm.DB, failures int, until time.Time) error {
+		if until.Before(time.Now().Add(loginPolicy.lockout - time.Minute)) {
+			t.Errorf("lockout until %v is too short", until)
+		}
+		lockouts = append(lockouts, failures)
+		return nil
+	}
+	for i := 0; i < 2*loginPolicy.lockoutAfter+1; i++ {
+		if err := th.fail(ctx, "popug", "10.0.0.1", onLockout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []int{loginPolicy.lockoutAfter, 2 * loginPolicy.lockoutAfter}
+	if len(lockouts) != len(want) || lockouts[0] != want[0] || lockouts[1] != want[1] {
+		t.Errorf("locked out after %v failures, want %v", lockouts, want)
+	}
+
+	var te *throttledError
+	if err := th.check(ctx, "popug", "10.0.0.2"); !errors.As(err, &te) || te.retryAfter < loginPolicy.lockout-time.Minute {
+		t.Errorf("locked out login from other address got %v, want lockout", err)
+	}
+	// address is throttled on its own, after more free attempts
+	if err := th.check(ctx, "other", "10.0.0.1"); !errors.As(err, &te) {
+		t.Errorf("address with %d failures is not throttled: %v", 2*loginPolicy.lockoutAfter+1, err)
+	}
+	if err := th.check(ctx, "other", "10.0.0.2"); err != nil {
+		t.Errorf("other login from other address is refused: %v", err)
+	}
+
+	locked, err := th.unlock(th.db, "popug")
+	if err != nil || !locked {
+		t.Errorf("unlock = %v, %v, want locked login", locked, err)
+	}
+	if err = th.check(ctx, "popug", ""); err != nil {
+		t.Errorf("unlocked login is refused: %v", err)
+	}
+}
+
+func TestLoginThrottleReset(t *testing.T) {
+	th := &loginThrottle{db: testutil.OpenDB(t, &LoginThrottle{})}
+	ctx := context.Background()
+	err := th.db.Create(&LoginThrottle{
+		Key:           loginKey("popug"),
+		Failures:      loginPolicy.lockoutAfter - 1,
+		LastFailureAt: time.Now().Add(-loginPolicy.resetAfter - time.Minute),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = th.check(ctx, "popug", ""); err != nil {
+		t.Errorf("login with old failures is refused: %v", err)
+	}
+
+	lockedOut := false
+	err = th.fail(ctx, "popug", "", func(tx *gorm.DB, failures int, until time.Time) error {
+		lockedOut = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockedOut {
+		t.Error("old failures are counted for lockout")
+	}
+	var row LoginThrottle
+	th.db.Where("`key` = ?", loginKey("popug")).Find(&row)
+	if row.Failures != 1 {
+		t.Errorf("failures after reset = %d, want 1", row.Failures)
+	}
+}
+
+func TestUnknownLoginAndWrongPassword(t *testing.T) {
+	db := testutil.OpenDB(t, &User{}, &Role{}, &LoginThrottle{})
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Create(&User{PublicId: "u1", Login: "popug", PasswordHash: string(hash), HashVersion: hashBcrypt,
+		Active: true}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &authSvc{logger: zap.NewNop().Sugar(), userDb: db, throttle: &loginThrottle{db: db}}
+	ctx := withClientIP(context.Background(), "10.0.0.1")
+
+	for i := 0; i < loginPolicy.freeAttempts; i++ {
+		for _, login := range []string{"popug", "ghost"} {
+			_, err = svc.verifyPassword(ctx, login, "wrong")
+			if err != errInvalidCredentials {
+				t.Errorf("attempt %d of %s got %v, want invalid credentials", i+1, login, err)
+			}
+		}
+	}
+	// both are throttled the same way, so lockout doesn't reveal which logins exist
+	for _, login := range []string{"popug", "ghost"} {
+		_, err = svc.verifyPassword(ctx, login, "secret")
+		var te *throttledError
+		if !errors.As(err, &te) {
+			t.Errorf("%s after free attempts got %v, want throttled", login, err)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"ates/common"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// TokenStoreItem is authorization code or access token with its refresh token.
+// Tokens are found by SHA256 of them, JWT is too long to be indexed. Data has no plaintext tokens,
+// so a dump of the table can't be used to call services.
+type TokenStoreItem struct {
+	ID          uint `gorm:"primaryKey"`
+	CreatedAt   time.Time
+	ExpiredAt   time.Time `gorm:"index"`
+	CodeHash    string    `gorm:"type:varchar(64);index"`
+	AccessHash  string    `gorm:"type:varchar(64);index"`
+	RefreshHash string    `gorm:"type:varchar(64);index"`
+	UserID      string    `gorm:"type:varchar(64);index"`
+	FamilyID    string    `gorm:"type:varchar(64);index"` // session: tokens issued on login and all refreshed from them
+	ClientID    string    `gorm:"type:varchar(255)"`
+	IP          string    `gorm:"type:varchar(64)"` // of user on the login page, only for authorization code
+	Data        string    `gorm:"type:text"`        // json-encoded models.Token without code, access and refresh tokens
+}
+
+// RevokedRefreshToken remembers removed refresh token until its expiration:
+// if it is presented again, the token is stolen, and the whole session is revoked
+type RevokedRefreshToken struct {
+	RefreshHash string    `gorm:"primaryKey;type:varchar(64)"`
+	FamilyID    string    `gorm:"type:varchar(64)"`
+	UserID      string    `gorm:"type:varchar(64)"`
+	ExpiredAt   time.Time `gorm:"index"`
+}
+
+// Session describes token family for its user: client, address and time of login, and the last time Auth
+// has seen it. Session is active while it has not expired tokens.
+type Session struct {
+	FamilyID string `gorm:"primaryKey;type:varchar(64)"`
+	UserID   string `gorm:"type:varchar(64);index"`
+	ClientID string `gorm:"type:varchar(255)"`
+	// IP is address of user at login: of the login page in authorization code flow, of the token request
+	// in password flow. Refresh doesn't change it, refresh comes from backend of client as often as not.
+	IP        string    `gorm:"type:varchar(64)"`
+	CreatedAt time.Time // issued at
+	// LastSeenAt is time of refresh, introspection of access token or call of Auth routes with it, updated at
+	// most once a minute. Services verify access tokens locally, so calls of services are not seen.
+	LastSeenAt time.Time
+}
+
+// sessionSeenInterval limits writes on every use of access token seen by Auth
+const sessionSeenInterval = time.Minute
+
+func NewTokenStore(db *gorm.DB, logger *zap.SugaredLogger) *TokenStore {
+	store := &TokenStore{
+		db:        db,
+		logger:    logger,
+		tableName: "oauth2_tokens",
+	}
+	if err := db.Table(store.tableName).AutoMigrate(&TokenStoreItem{}); err != nil {
+		panic(err)
+	}
+	// last_used_at of sessions is renamed, services use access tokens without Auth, it was never time of the last use
+	if m := db.Migrator(); m.HasColumn(&Session{}, "last_used_at") {
+		if err := m.RenameColumn(&Session{}, "last_used_at", "last_seen_at"); err != nil {
+			panic(err)
+		}
+	}
+	if err := db.AutoMigrate(&RevokedRefreshToken{}, &Session{}); err != nil {
+		panic(err)
+	}
+	return store
+}
+
+// TokenStore keeps tokens in MySQL, so they survive restart of Auth and are shared between replicas
+type TokenStore struct {
+	tableName string
+	db        *gorm.DB
+	logger    *zap.SugaredLogger
+	onLogin   func(ctx context.Context, tx *gorm.DB, item *TokenStoreItem) error
+}
+
+// SetLoginHandler sets handler called in transaction of token creation, when user starts new session
+func (s *TokenStore) SetLoginHandler(h func(ctx context.Context, tx *gorm.DB, item *TokenStoreItem) error) {
+	s.onLogin = h
+}
+
+type familyKey struct{}
+
+// withTokenFamily returns context for refreshing of token: new token continues the session of the old one
+func withTokenFamily(ctx context.Context, familyID string) context.Context {
+	return context.WithValue(ctx, familyKey{}, familyID)
+}
+
+func tokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	return common.HashSHA256([]byte(token))
+}
+
+func (s *TokenStore) Create(ctx context.Context, info oauth2.TokenInfo) error {
+	data, err := tokenData(info)
+	if err != nil {
+		return err
+	}
+	item := &TokenStoreItem{
+		UserID:   info.GetUserID(),
+		ClientID: info.GetClientID(),
+		Data:     string(data),
+	}
+
+	if code := info.GetCode(); code != "" {
+		item.CodeHash = tokenHash(code)
+		item.IP = clientIP(ctx)
+		item.ExpiredAt = info.GetCodeCreateAt().Add(info.GetCodeExpiresIn())
+	} else {
+		item.AccessHash = tokenHash(info.GetAccess())
+		item.ExpiredAt = info.GetAccessCreateAt().Add(info.GetAccessExpiresIn())
+		if refresh := info.GetRefresh(); refresh != "" {
+			item.RefreshHash = tokenHash(refresh)
+			if info.GetRefreshExpiresIn() == 0 {
+				// refresh token without expiration
+				item.ExpiredAt = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+			} else if exp := info.GetRefreshCreateAt().Add(info.GetRefreshExpiresIn()); exp.After(item.ExpiredAt) {
+				item.ExpiredAt = exp
+			}
+		}
+	}
+
+	item.FamilyID, _ = ctx.Value(familyKey{}).(string)
+	refresh := item.FamilyID != ""
+	login := !refresh && item.CodeHash == "" && item.UserID != ""
+	if item.FamilyID == "" {
+		item.FamilyID = uuid.NewString()
+	}
+
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Table(s.tableName).Create(item).Error
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if refresh {
+			return tx.Model(&Session{}).Where("family_id = ?", item.FamilyID).Update("last_seen_at", now).Error
+		}
+		if !login {
+			return nil
+		}
+		err = tx.Create(&Session{
+			FamilyID:   item.FamilyID,
+			UserID:     item.UserID,
+			ClientID:   item.ClientID,
+			IP:         clientIP(ctx),
+			CreatedAt:  now,
+			LastSeenAt: now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if s.onLogin != nil {
+			return s.onLogin(ctx, tx, item)
+		}
+		return nil
+	})
+}
+
+// tokenData encodes token info without plaintext tokens, they are restored from the presented token by get
+func tokenData(info oauth2.TokenInfo) ([]byte, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	var stored models.Token
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, err
+	}
+	stored.Code, stored.Access, stored.Refresh = "", "", ""
+	return json.Marshal(&stored)
+}
+
+// deleteWhere deletes tokens within transaction tx, their refresh tokens are remembered as revoked
+func (s *TokenStore) deleteWhere(tx *gorm.DB, query string, args ...interface{}) ([]TokenStoreItem, error) {
+	var items []TokenStoreItem
+	err := tx.Table(s.tableName).Where(query, args...).Find(&items).Error
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+		if item.RefreshHash == "" {
+			continue
+		}
+		err = tx.Save(&RevokedRefreshToken{
+			RefreshHash: item.RefreshHash,
+			FamilyID:    item.FamilyID,
+			UserID:      item.UserID,
+			ExpiredAt:   item.ExpiredAt,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Table(s.tableName).Where("id in ?", ids).Delete(&TokenStoreItem{}).Error
+	return items, err
+}
+
+func (s *TokenStore) remove(ctx context.Context, column, token string) error {
+	if token == "" {
+		// manager removes access token of refreshed token, it is not known as it isn't stored
+		return nil
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		_, err := s.deleteWhere(tx, column+" = ?", tokenHash(token))
+		return err
+	})
+}
+
+func (s *TokenStore) RemoveByCode(ctx context.Context, code string) error {
+	return s.remove(ctx, "code_hash", code)
+}
+
+func (s *TokenStore) RemoveByAccess(ctx context.Context, access string) error {
+	return s.remove(ctx, "access_hash", access)
+}
+
+func (s *TokenStore) RemoveByRefresh(ctx context.Context, refresh string) error {
+	return s.remove(ctx, "refresh_hash", refresh)
+}
+
+// item returns not expired token record, or nil if it is not found
+func (s *TokenStore) item(ctx context.Context, column, token string) (*TokenStoreItem, error) {
+	if token == "" {
+		return nil, nil
+	}
+	var item TokenStoreItem
+	result := s.db.WithContext(ctx).Table(s.tableName).
+		Where(column+" = ? and expired_at > ?", tokenHash(token), time.Now()).
+		Limit(1).
+		Find(&item)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &item, nil
+}
+
+// get returns not expired token, or nil if it is not found
+func (s *TokenStore) get(ctx context.Context, column, token string) (oauth2.TokenInfo, error) {
+	item, err := s.item(ctx, column, token)
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	var info models.Token
+	err = json.Unmarshal([]byte(item.Data), &info)
+	if err != nil {
+		return nil, err
+	}
+	switch column {
+	case "code_hash":
+		info.Code = token
+	case "access_hash":
+		info.Access = token
+	case "refresh_hash":
+		info.Refresh = token
+	}
+	return &info, nil
+}
+
+func (s *TokenStore) GetByCode(ctx context.Context, code string) (oauth2.TokenInfo, error) {
+	return s.get(ctx, "code_hash", code)
+}
+
+func (s *TokenStore) GetByAccess(ctx context.Context, access string) (oauth2.TokenInfo, error) {
+	return s.get(ctx, "access_hash", access)
+}
+
+func (s *TokenStore) GetByRefresh(ctx context.Context, refresh string) (oauth2.TokenInfo, error) {
+	return s.get(ctx, "refresh_hash", refresh)
+}
+
+// revokedRefresh returns record of revoked refresh token, or nil if token was not revoked
+func (s *TokenStore) revokedRefresh(ctx context.Context, refresh string) (*RevokedRefreshToken, error) {
+	var revoked RevokedRefreshToken
+	result := s.db.WithContext(ctx).Where("refresh_hash = ?", tokenHash(refresh)).Limit(1).Find(&revoked)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+	return &revoked, nil
+}
+
+// sessions returns active sessions of user, the latest used first
+func (s *TokenStore) sessions(ctx context.Context, userID string) ([]Session, error) {
+	var sessions []Session
+	err := s.db.WithContext(ctx).
+		Where("user_id = ? and family_id in (?)", userID,
+			s.db.Table(s.tableName).Select("family_id").Where("expired_at > ?", time.Now())).
+		Order("last_seen_at desc").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// session returns active session of user, or nil if it is not found
+func (s *TokenStore) session(ctx context.Context, userID, familyID string) (*Session, error) {
+	sessions, err := s.sessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		if session.FamilyID == familyID {
+			return &session, nil
+		}
+	}
+	return nil, nil
+}
+
+// markSeen sets time, when Auth has seen access token of session
+func (s *TokenStore) markSeen(ctx context.Context, access string) error {
+	now := time.Now()
+	return s.db.WithContext(ctx).Model(&Session{}).
+		Where("family_id in (?) and last_seen_at < ?",
+			s.db.Table(s.tableName).Select("family_id").Where("access_hash = ?", tokenHash(access)),
+			now.Add(-sessionSeenInterval)).
+		Update("last_seen_at", now).Error
+}
+
+// revokeFamily deletes all tokens of session within transaction tx
+func (s *TokenStore) revokeFamily(tx *gorm.DB, familyID string) ([]TokenStoreItem, error) {
+	return s.deleteWhere(tx, "family_id = ?", familyID)
+}
+
+// revokeUser deletes all tokens of user within transaction tx
+func (s *TokenStore) revokeUser(tx *gorm.DB, userID string) ([]TokenStoreItem, error) {
+	return s.deleteWhere(tx, "user_id = ?", userID)
+}
+
+// revokeClient deletes all tokens of client within transaction tx
+func (s *TokenStore) revokeClient(tx *gorm.DB, clientID string) ([]TokenStoreItem, error) {
+	return s.deleteWhere(tx, "client_id = ?", clientID)
+}
+
+// RunGC purges expired tokens periodically, until context is cancelled
+func (s *TokenStore) RunGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.purge(ctx)
+			if err != nil {
+				s.logger.Errorf("Failed to purge expired tokens: %s", err.Error())
+			} else if n > 0 {
+				s.logger.Infof("Purged %d expired tokens", n)
+			}
+		}
+	}
+}
+
+// purge deletes expired tokens, revoked refresh tokens and sessions without tokens, returns number of deleted tokens
+func (s *TokenStore) purge(ctx context.Context) (int64, error) {
+	result := s.db.WithContext(ctx).Table(s.tableName).
+		Where("expired_at <= ?", time.Now()).
+		Delete(&TokenStoreItem{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	err := s.db.WithContext(ctx).Where("expired_at <= ?", time.Now()).Delete(&RevokedRefreshToken{}).Error
+	if err != nil {
+		return 0, err
+	}
+	err = s.db.WithContext(ctx).
+		Where("family_id not in (?)", s.db.Table(s.tableName).Select("family_id")).
+		Delete(&Session{}).Error
+	return result.RowsAffected, err
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"ates/common/testutil"
+	"context"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTokenStore(t *testing.T) *TokenStore {
+	return NewTokenStore(testutil.OpenDB(t), zap.NewNop().Sugar())
+}
+
+// loginToken is access and refresh token of user u1 issued on login to client web
+func loginToken(access, refresh string) *models.Token {
+	now := time.Now()
+	return &models.Token{
+		ClientID:         "web",
+		UserID:           "u1",
+		Access:           access,
+		AccessCreateAt:   now,
+		AccessExpiresIn:  10 * time.Minute,
+		Refresh:          refresh,
+		RefreshCreateAt:  now,
+		RefreshExpiresIn: 24 * time.Hour,
+	}
+}
+
+func TestTokenStoreCreate(t *testing.T) {
+	s := newTestTokenStore(t)
+	var logins []string
+	s.SetLoginHandler(func(ctx context.Context, tx *gorm.DB, item *TokenStoreItem) error {
+		logins = append(logins, item.FamilyID)
+		return nil
+	})
+	ctx := withClientIP(context.Background(), "10.0.0.1")
+
+	if err := s.Create(ctx, loginToken("access-1", "refresh-1")); err != nil {
+		t.Fatal(err)
+	}
+	var item TokenStoreItem
+	if err := s.db.Table(s.tableName).First(&item).Error; err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(item.Data, "access-1") || strings.Contains(item.Data, "refresh-1") {
+		t.Errorf("plaintext token is stored: %s", item.Data)
+	}
+	if item.AccessHash != tokenHash("access-1") || item.RefreshHash != tokenHash("refresh-1") {
+		t.Errorf("token is stored with hashes %s, %s", item.AccessHash, item.RefreshHash)
+	}
+	if !item.ExpiredAt.After(time.Now().Add(23 * time.Hour)) {
+		t.Errorf("item expires at %v, want expiration of refresh token", item.ExpiredAt)
+	}
+
+	sessions, err := s.sessions(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].FamilyID != item.FamilyID || sessions[0].ClientID != "web" ||
+		sessions[0].IP != "10.0.0.1" || len(logins) != 1 {
+		t.Fatalf("sessions %+v and logins %v after login, want one", sessions, logins)
+	}
+
+	// refreshed token continues the session, it is not a new login, and address of login is kept
+	past := time.Now().Add(-time.Hour)
+	s.db.Model(&Session{}).Where("family_id = ?", item.FamilyID).Update("last_seen_at", past)
+	err = s.Create(withTokenFamily(withClientIP(ctx, "10.0.0.2"), item.FamilyID), loginToken("access-2", "refresh-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ = s.sessions(ctx, "u1")
+	if len(sessions) != 1 || sessions[0].IP != "10.0.0.1" || !sessions[0].LastSeenAt.After(past) || len(logins) != 1 {
+		t.Errorf("sessions %+v and logins %v after refresh, want the same session", sessions, logins)
+	}
+
+	// authorization code is not a session yet, it keeps address of user for the session
+	code := &models.Token{ClientID: "web", UserID: "u1", Code: "code-1", CodeCreateAt: time.Now(),
+		CodeExpiresIn: time.Minute}
+	if err = s.Create(withClientIP(ctx, "198.51.100.7"), code); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ = s.sessions(ctx, "u1"); len(sessions) != 1 || len(logins) != 1 {
+		t.Errorf("authorization code starts session: %+v", sessions)
+	}
+	if codeItem, err := s.item(ctx, "code_hash", "code-1"); err != nil || codeItem == nil || codeItem.IP != "198.51.100.7" {
+		t.Errorf("authorization code %+v, %v, want address of user", codeItem, err)
+	}
+}
+
+func TestTokenStoreGet(t *testing.T) {
+	s := newTestTokenStore(t)
+	ctx := context.Background()
+	if err := s.Create(ctx, loginToken("access-1", "refresh-1")); err != nil {
+		t.Fatal(err)
+	}
+	code := &models.Token{ClientID: "web", UserID: "u1", Code: "code-1", CodeCreateAt: time.Now(),
+		CodeExpiresIn: time.Minute}
+	if err := s.Create(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.GetByAccess(ctx, "access-1")
+	if err != nil || info == nil {
+		t.Fatalf("GetByAccess = %v, %v", info, err)
+	}
+	if info.GetAccess() != "access-1" || info.GetUserID() != "u1" || info.GetClientID() != "web" {
+		t.Errorf("token by access = %+v", info)
+	}
+	info, err = s.GetByRefresh(ctx, "refresh-1")
+	if err != nil || info == nil || info.GetRefresh() != "refresh-1" {
+		t.Errorf("GetByRefresh = %+v, %v", info, err)
+	}
+	info, err = s.GetByCode(ctx, "code-1")
+	if err != nil || info == nil || info.GetCode() != "code-1" {
+		t.Errorf("GetByCode = %+v, %v", info, err)
+	}
+
+	for _, token := range []string{"", "access-2", "refresh-1"} {
+		if info, err = s.GetByAccess(ctx, token); err != nil || info != nil {
+			t.Errorf("GetByAccess(%q) = %+v, %v, want nothing", token, info, err)
+		}
+	}
+
+	expired := loginToken("access-old", "")
+	expired.AccessCreateAt = time.Now().Add(-time.Hour)
+	if err = s.Create(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = s.GetByAccess(ctx, "access-old"); err != nil || info != nil {
+		t.Errorf("expired token is found: %+v, %v", info, err)
+	}
+}
+
+func TestTokenStoreRemove(t *testing.T) {
+	s := newTestTokenStore(t)
+	ctx := context.Background()
+	for _, token := range []*models.Token{loginToken("access-1", "refresh-1"), loginToken("access-2", "refresh-2")} {
+		if err := s.Create(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	code := &models.Token{ClientID: "web", UserID: "u1", Code: "code-1", CodeCreateAt: time.Now(),
+		CodeExpiresIn: time.Minute}
+	if err := s.Create(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+
+	// manager removes unknown access token of refreshed one, it must not match items without access token
+	if err := s.RemoveByAccess(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := s.GetByCode(ctx, "code-1"); info == nil {
+		t.Fatal("removal of empty access token deletes authorization code")
+	}
+
+	if err := s.RemoveByAccess(ctx, "access-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveByRefresh(ctx, "refresh-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveByCode(ctx, "code-1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"access-1", "access-2"} {
+		if info, _ := s.GetByAccess(ctx, token); info != nil {
+			t.Errorf("removed token %s is found", token)
+		}
+	}
+	if info, _ := s.GetByCode(ctx, "code-1"); info != nil {
+		t.Error("removed authorization code is found")
+	}
+	// refresh tokens of removed items are remembered for reuse detection
+	for _, refresh := range []string{"refresh-1", "refresh-2"} {
+		revoked, err := s.revokedRefresh(ctx, refresh)
+		if err != nil || revoked == nil || revoked.UserID != "u1" {
+			t.Errorf("revoked %s = %+v, %v", refresh, revoked, err)
+		}
+	}
+}
+
+func TestTokenStorePurge(t *testing.T) {
+	s := newTestTokenStore(t)
+	ctx := context.Background()
+	expired := loginToken("access-old", "refresh-old")
+	expired.AccessCreateAt = time.Now().Add(-48 * time.Hour)
+	expired.RefreshCreateAt = expired.AccessCreateAt
+	for _, token := range []*models.Token{expired, loginToken("access-1", "refresh-1")} {
+		if err := s.Create(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.db.Create(&RevokedRefreshToken{RefreshHash: tokenHash("refresh-0"), UserID: "u1",
+		ExpiredAt: time.Now().Add(-time.Minute)}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("purged %d tokens, want 1", n)
+	}
+	var tokens, revoked, sessions int64
+	s.db.Table(s.tableName).Count(&tokens)
+	s.db.Model(&RevokedRefreshToken{}).Count(&revoked)
+	s.db.Model(&Session{}).Count(&sessions)
+	if tokens != 1 || revoked != 0 || sessions != 1 {
+		t.Errorf("after purge %d tokens, %d revoked and %d sessions left, want 1, 0 and 1", tokens, revoked, sessions)
+	}
+}
+
+func TestTokenStoreRenamesLastUsedAt(t *testing.T) {
+	db := testutil.OpenDB(t)
+	if err := db.Exec("create table sessions (family_id varchar(64) primary key, last_used_at datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+	NewTokenStore(db, zap.NewNop().Sugar())
+	if m := db.Migrator(); m.HasColumn(&Session{}, "last_used_at") || !m.HasColumn(&Session{}, "last_seen_at") {
+		t.Error("last_used_at of sessions is not renamed to last_seen_at")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is SHA1 seed of test vectors in RFC 6238, "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 6238 gives 8 digits, 6-digit code is their tail
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+		if got := totpCode(key, totpStep(now)); got != tt.code {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+		step, ok := matchTOTP(rfc6238Secret, tt.code, now, 0)
+		if !ok || step != totpStep(now) {
+			t.Errorf("code %s at %d is not matched", tt.code, tt.unix)
+		}
+	}
+}
+
+func TestMatchTOTPSkew(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	tests := []struct {
+		offset int64
+		ok     bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+	for _, tt := range tests {
+		code := totpCode(key, current+tt.offset)
+		step, ok := matchTOTP(rfc6238Secret, code, now, 0)
+		if ok != tt.ok {
+			t.Errorf("code of step %+d: ok = %v, want %v", tt.offset, ok, tt.ok)
+		}
+		if ok && step != current+tt.offset {
+			t.Errorf("code of step %+d matched step %d", tt.offset, step-current)
+		}
+	}
+}
+
+func TestMatchTOTPReplay(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111111, 0)
+	code := totpCode(key, totpStep(now))
+	step, ok := matchTOTP(rfc6238Secret, code, now, 0)
+	if !ok {
+		t.Fatal("code is not matched")
+	}
+	if _, ok = matchTOTP(rfc6238Secret, code, now, step); ok {
+		t.Error("code is accepted twice")
+	}
+	// code of earlier step within skew is refused after later one is used
+	if _, ok = matchTOTP(rfc6238Secret, totpCode(key, step-1), now, step); ok {
+		t.Error("code older than the last used one is accepted")
+	}
+	if _, ok = matchTOTP(rfc6238Secret, totpCode(key, step+1), now, step); !ok {
+		t.Error("code of the next step is refused")
+	}
+}
+
+func TestMatchTOTPMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "94287082", "abcdef"} {
+		if _, ok := matchTOTP(rfc6238Secret, code, now, 0); ok {
+			t.Errorf("code %q is accepted", code)
+		}
+	}
+	if _, ok := matchTOTP("not base32!", "287082", now, 0); ok {
+		t.Error("code is accepted for malformed secret")
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"ates/common"
+	"ates/schema"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	oauthErrors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UserTOTP is TOTP secret of user. It works as second factor only after it is confirmed with a code.
+type UserTOTP struct {
+	UserID    string `gorm:"primaryKey;type:varchar(64)"` // public id of user
+	Secret    string `gorm:"type:varchar(64)"`            // base32
+	Confirmed bool
+	LastStep  int64 // time step of the last accepted code
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// EnrollmentToken lets user of role, which requires second factor, enroll TOTP. Admin issues it, and it works
+// once, so stolen password alone doesn't let to enroll another authenticator.
+type EnrollmentToken struct {
+	UserID    string `gorm:"primaryKey;type:varchar(64)"` // public id of user, new token replaces the old one
+	TokenHash string `gorm:"type:varchar(64)"`            // SHA256 of token
+	IssuedBy  string `gorm:"type:varchar(64)"`            // public id of admin, empty for bootstrapped admin
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+const enrollmentTokenTTL = 24 * time.Hour
+
+// RecoveryCode replaces TOTP code once, when the user has lost the authenticator
+type RecoveryCode struct {
+	ID       uint   `gorm:"primaryKey"`
+	UserID   string `gorm:"type:varchar(64);index"`
+	CodeHash string `gorm:"type:varchar(64)"` // SHA256 of normalized code, codes are random
+	UsedAt   *time.Time
+}
+
+const recoveryCodeCount = 10
+
+// defaultTwoFactorRoles may close days and see income of the company
+const defaultTwoFactorRoles = "admin,chief,accountant"
+
+// parseTwoFactorRoles parses comma-separated names of roles, which must use second factor, "none" gives no roles
+func parseTwoFactorRoles(s string) (map[schema.UserRole]bool, error) {
+	roles := map[schema.UserRole]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		role, ok := schema.ParseUserRole(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown role %s", name)
+		}
+		roles[role] = true
+	}
+	return roles, nil
+}
+
+// twoFactorError is returned when password is valid, but second factor is missing
+type twoFactorError struct {
+	code        string
+	description string
+}
+
+func (e *twoFactorError) Error() string {
+	return e.description
+}
+
+var errTwoFactorRequired = &twoFactorError{"mfa_required", "one-time code or recovery code is required"}
+var errTwoFactorEnrollmentRequired = &twoFactorError{"mfa_enrollment_required",
+	"two-factor authentication is required for the role, enroll with POST /2fa/enroll and enrollment token from admin"}
+
+var errEnrollmentTokenRequired = errors.New("enrollment token is missing, wrong or expired, ask admin for a new one")
+
+// twoFactorResponse is OAuth error response for twoFactorError, or nil for other errors
+func twoFactorResponse(err error) *oauthErrors.Response {
+	var tfe *twoFactorError
+	if !errors.As(err, &tfe) {
+		return nil
+	}
+	re := oauthErrors.NewResponse(errors.New(tfe.code), http.StatusForbidden)
+	re.Description = tfe.description
+	return re
+}
+
+type secondFactorKey struct{}
+
+// withSecondFactor returns context with TOTP or recovery code sent with credentials
+func withSecondFactor(ctx context.Context, code string) context.Context {
+	return context.WithValue(ctx, secondFactorKey{}, code)
+}
+
+func secondFactor(ctx context.Context) string {
+	code, _ := ctx.Value(secondFactorKey{}).(string)
+	return code
+}
+
+// normalizeRecoveryCode drops separators and case, codes are shown as XXXX-XXXX
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// newRecoveryCodes generates recovery codes of user, codes are returned to show them once
+func newRecoveryCodes(userID string) ([]string, []RecoveryCode, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	rows := make([]RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := totpEncoding.EncodeToString(b)
+		codes = append(codes, s[:4]+"-"+s[4:])
+		rows = append(rows, RecoveryCode{UserID: userID, CodeHash: common.HashSHA256([]byte(s))})
+	}
+	return codes, rows, nil
+}
+
+// checkSecondFactor checks TOTP or recovery code of user with valid password. Users without confirmed TOTP
+// pass, unless their role requires second factor.
+func (svc *authSvc) checkSecondFactor(ctx context.Context, u *User, code string) error {
+	return svc.userDb.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var t UserTOTP
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? and confirmed = ?", u.PublicId, true).Limit(1).Find(&t)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			if svc.twoFactorRoles[u.RoleID] {
+				return errTwoFactorEnrollmentRequired
+			}
+			return nil
+		}
+		if code == "" {
+			return errTwoFactorRequired
+		}
+
+		if step, ok := matchTOTP(t.Secret, code, time.Now(), t.LastStep); ok {
+			return tx.Model(&t).Update("last_step", step).Error
+		}
+		result = tx.Model(&RecoveryCode{}).
+			Where("user_id = ? and code_hash = ? and used_at is null", u.PublicId,
+				common.HashSHA256([]byte(normalizeRecoveryCode(code)))).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInvalidCredentials
+		}
+		svc.logger.Infof("User %s used recovery code", u.PublicId)
+		return nil
+	})
+}
+
+// twoFactorRequest is body of enrollment requests, they are authenticated with password: user of role,
+// which requires second factor, can't get a token before enrollment, so enrollment token from admin is sent too
+type twoFactorRequest struct {
+	Login           string `json:"login"`
+	Password        string `json:"password"`
+	EnrollmentToken string `json:"enrollmentToken"`
+	Code            string `json:"code"`
+}
+
+// issueEnrollmentToken replaces enrollment token of user with new one, token is returned to show it once
+func issueEnrollmentToken(tx *gorm.DB, userID, issuedBy string) (string, time.Time, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expiresAt := time.Now().Add(enrollmentTokenTTL)
+	err = tx.Save(&EnrollmentToken{UserID: userID, TokenHash: common.HashSHA256([]byte(token)), IssuedBy: issuedBy,
+		ExpiresAt: expiresAt, CreatedAt: time.Now()}).Error
+	return token, expiresAt, err
+}
+
+// checkEnrollmentToken checks enrollment token of user, whose role requires second factor. Other users enroll
+// with password only.
+func (svc *authSvc) checkEnrollmentToken(tx *gorm.DB, u *User, token string) error {
+	if !svc.twoFactorRoles[u.RoleID] {
+		return nil
+	}
+	if token == "" {
+		return errEnrollmentTokenRequired
+	}
+	var n int64
+	err := tx.Model(&EnrollmentToken{}).Where("user_id = ? and token_hash = ? and expires_at > ?",
+		u.PublicId, common.HashSHA256([]byte(token)), time.Now()).Count(&n).Error
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errEnrollmentTokenRequired
+	}
+	return nil
+}
+
+// enrollmentTokenResponse answers missing or wrong enrollment token
+func enrollmentTokenResponse(c echo.Context) error {
+	return c.JSON(http.StatusForbidden, common.FromKeysAndValues("error", "enrollment_token_required",
+		"error_description", errEnrollmentTokenRequired.Error()))
+}
+
+// readTwoFactorRequest reads request and checks password, answers error itself
+func (svc *authSvc) readTwoFactorRequest(c echo.Context) (*twoFactorRequest, *User, error) {
+	var req twoFactorRequest
+	err := c.Bind(&req)
+	if err != nil || req.Login == "" {
+		return nil, nil, c.JSON(http.StatusBadRequest, common.FromKeysAndValues("error", "bad request"))
+	}
+	ctx := withClientIP(c.Request().Context(), c.RealIP())
+	u, err := svc.verifyPassword(ctx, req.Login, req.Password)
+	if re := throttledResponse(err); re != nil {
+		c.Response().Header().Set("Retry-After", re.Header.Get("Retry-After"))
+		return nil, nil, c.JSON(re.StatusCode, common.FromKeysAndValues("error", re.Error.Error(),
+			"error_description", re.Description))
+	}
+	if err != nil {
+		return nil, nil, c.JSON(http.StatusUnauthorized, oauthError("invalid_grant"))
+	}
+	return &req, u, nil
+}
+
+// enrollTwoFactor generates TOTP secret of user, it is used after confirmTwoFactor
+// POST /2fa/enroll {"login": "...", "password": "...", "enrollmentToken": "..."} ->
+// {"secret": "...", "uri": "otpauth://totp/..."}
+func (svc *authSvc) enrollTwoFactor(c echo.Context) error {
+	req, u, err := svc.readTwoFactorRequest(c)
+	if u == nil {
+		return err
+	}
+	err = svc.checkEnrollmentToken(svc.userDb, u, req.EnrollmentToken)
+	if errors.Is(err, errEnrollmentTokenRequired) {
+		svc.logger.Infof("User %s is refused enrollment without valid enrollment token", u.PublicId)
+		return enrollmentTokenResponse(c)
+	}
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+
+	var t UserTOTP
+	result := svc.userDb.Where("user_id = ?", u.PublicId).Limit(1).Find(&t)
+	if result.Error != nil {
+		svc.logger.Error(result.Error)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if t.Confirmed {
+		return c.JSON(http.StatusConflict,
+			common.FromKeysAndValues("error", "two-factor authentication is enrolled, admin can reset it"))
+	}
+
+	secret, err := newTOTPSecret()
+	if err == nil {
+		err = svc.userDb.Save(&UserTOTP{UserID: u.PublicId, Secret: secret, CreatedAt: time.Now()}).Error
+	}
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	svc.logger.Infof("User %s started enrollment of two-factor authentication", u.PublicId)
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, common.FromKeysAndValues("secret", secret, "uri", totpURI(secret, u.Login)))
+}
+
+// confirmTwoFactor turns on second factor, when user sends valid code of enrolled secret. Enrollment token
+// is used up here. Recovery codes are returned only in this response.
+// POST /2fa/confirm {"login": "...", "password": "...", "enrollmentToken": "...", "code": "123456"} ->
+// {"recoveryCodes": [...]}
+func (svc *authSvc) confirmTwoFactor(c echo.Context) error {
+	req, u, err := svc.readTwoFactorRequest(c)
+	if u == nil {
+		return err
+	}
+
+	var codes []string
+	ctx := withClientIP(c.Request().Context(), c.RealIP())
+	err = svc.userDb.Transaction(func(tx *gorm.DB) error {
+		err := svc.checkEnrollmentToken(tx, u, req.EnrollmentToken)
+		if err != nil {
+			return err
+		}
+		var t UserTOTP
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? and confirmed = ?", u.PublicId, false).Limit(1).Find(&t)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		step, ok := matchTOTP(t.Secret, req.Code, time.Now(), t.LastStep)
+		if !ok {
+			return errInvalidCredentials
+		}
+		err = tx.Model(&t).Updates(map[string]interface{}{"confirmed": true, "last_step": step}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ?", u.PublicId).Delete(&EnrollmentToken{}).Error
+		if err != nil {
+			return err
+		}
+
+		var rows []RecoveryCode
+		codes, rows, err = newRecoveryCodes(u.PublicId)
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ?", u.PublicId).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if errors.Is(err, errEnrollmentTokenRequired) {
+		return enrollmentTokenResponse(c)
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		svc.failLogin(ctx, u.Login, u)
+		return c.JSON(http.StatusUnauthorized, common.FromKeysAndValues("error", "invalid code"))
+	}
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if codes == nil {
+		return c.JSON(http.StatusConflict,
+			common.FromKeysAndValues("error", "two-factor authentication is not being enrolled"))
+	}
+	svc.logger.Infof("User %s turned on two-factor authentication", u.PublicId)
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, common.FromKeysAndValues("recoveryCodes", codes))
+}
+
+// resetTwoFactor removes TOTP secret, enrollment token and recovery codes of user with public id from path,
+// admin only. The user enrolls again with new enrollment token, if role requires second factor.
+func (svc *authSvc) resetTwoFactor(c echo.Context) error {
+	var u User
+	result := svc.userDb.Where("public_id = ?", c.Param("uid")).Limit(1).Find(&u)
+	if result.RowsAffected != 1 {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "user not found"))
+	}
+
+	err := svc.userDb.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", u.PublicId).Delete(&UserTOTP{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ?", u.PublicId).Delete(&EnrollmentToken{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", u.PublicId).Delete(&RecoveryCode{}).Error
+	})
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError,
+			common.FromKeysAndValues("error", "failed to reset two-factor authentication"))
+	}
+	svc.logger.Infof("Two-factor authentication of user %s is reset by %s", u.PublicId, common.CurrentUser(c).PublicId)
+	return c.JSON(http.StatusOK, common.FromKeysAndValues("result", "two-factor authentication is reset"))
+}
+
+// issueTwoFactorEnrollment issues enrollment token of user with public id from path, admin only. The user
+// sends it with POST /2fa/enroll and /2fa/confirm, it is returned only in this response.
+func (svc *authSvc) issueTwoFactorEnrollment(c echo.Context) error {
+	var u User
+	result := svc.userDb.Where("public_id = ?", c.Param("uid")).Limit(1).Find(&u)
+	if result.RowsAffected != 1 {
+		return c.JSON(http.StatusNotFound, common.FromKeysAndValues("error", "user not found"))
+	}
+	var n int64
+	svc.userDb.Model(&UserTOTP{}).Where("user_id = ? and confirmed = ?", u.PublicId, true).Count(&n)
+	if n > 0 {
+		return c.JSON(http.StatusConflict,
+			common.FromKeysAndValues("error", "two-factor authentication is enrolled, reset it first"))
+	}
+
+	me := common.CurrentUser(c)
+	token, expiresAt, err := issueEnrollmentToken(svc.userDb, u.PublicId, me.PublicId)
+	if err != nil {
+		svc.logger.Error(err)
+		return c.JSON(http.StatusInternalServerError,
+			common.FromKeysAndValues("error", "failed to issue enrollment token"))
+	}
+	svc.logger.Infof("Enrollment token of user %s is issued by %s", u.PublicId, me.PublicId)
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, common.FromKeysAndValues("enrollmentToken", token, "expiresAt", expiresAt))
+}
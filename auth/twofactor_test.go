@@ -0,0 +1,276 @@
+package main
+
+import (
+	"ates/common"
+	"ates/common/testutil"
+	"ates/schema"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTwoFactorSvc(t *testing.T) *authSvc {
+	return &authSvc{
+		logger:         zap.NewNop().Sugar(),
+		userDb:         testutil.OpenDB(t, &UserTOTP{}, &RecoveryCode{}),
+		twoFactorRoles: map[schema.UserRole]bool{schema.RoleAdmin: true},
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, rows, err := newRecoveryCodes("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(rows) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d rows, want %d", len(codes), len(rows), recoveryCodeCount)
+	}
+	format := regexp.MustCompile(`^[A-Z2-7]{4}-[A-Z2-7]{4}$`)
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %s is not XXXX-XXXX", code)
+		}
+		if seen[code] {
+			t.Errorf("code %s is repeated", code)
+		}
+		seen[code] = true
+		if rows[i].UserID != "u1" || rows[i].CodeHash != common.HashSHA256([]byte(normalizeRecoveryCode(code))) {
+			t.Errorf("row %+v doesn't match code %s", rows[i], code)
+		}
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	for _, code := range []string{"ABCD-EFGH", "abcd-efgh", "ABCDEFGH", "abcd efgh", " Abcd-Efgh "} {
+		if got := normalizeRecoveryCode(code); got != "ABCDEFGH" {
+			t.Errorf("normalizeRecoveryCode(%q) = %q", code, got)
+		}
+	}
+}
+
+func TestCheckSecondFactorNotEnrolled(t *testing.T) {
+	svc := newTwoFactorSvc(t)
+	ctx := context.Background()
+
+	err := svc.checkSecondFactor(ctx, &User{PublicId: "u1", RoleID: schema.RoleUser}, "")
+	if err != nil {
+		t.Errorf("user without second factor is refused: %v", err)
+	}
+	err = svc.checkSecondFactor(ctx, &User{PublicId: "a1", RoleID: schema.RoleAdmin}, "")
+	if !errors.Is(err, errTwoFactorEnrollmentRequired) {
+		t.Errorf("admin without second factor got %v, want enrollment required", err)
+	}
+
+	// secret which is not confirmed is not a second factor yet
+	err = svc.userDb.Create(&UserTOTP{UserID: "u1", Secret: rfc6238Secret}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.checkSecondFactor(ctx, &User{PublicId: "u1", RoleID: schema.RoleUser}, "")
+	if err != nil {
+		t.Errorf("user with unconfirmed secret is refused: %v", err)
+	}
+}
+
+func TestCheckSecondFactorTOTP(t *testing.T) {
+	svc := newTwoFactorSvc(t)
+	ctx := context.Background()
+	u := &User{PublicId: "u1", RoleID: schema.RoleUser}
+	err := svc.userDb.Create(&UserTOTP{UserID: u.PublicId, Secret: rfc6238Secret, Confirmed: true}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = svc.checkSecondFactor(ctx, u, ""); !errors.Is(err, errTwoFactorRequired) {
+		t.Errorf("missing code got %v, want second factor required", err)
+	}
+	if err = svc.checkSecondFactor(ctx, u, "000000"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("wrong code got %v, want invalid credentials", err)
+	}
+
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := totpCode(key, totpStep(time.Now()))
+	if err = svc.checkSecondFactor(ctx, u, code); err != nil {
+		t.Fatalf("valid code is refused: %v", err)
+	}
+	if err = svc.checkSecondFactor(ctx, u, code); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("replayed code got %v, want invalid credentials", err)
+	}
+}
+
+func TestCheckSecondFactorRecoveryCode(t *testing.T) {
+	svc := newTwoFactorSvc(t)
+	ctx := context.Background()
+	u := &User{PublicId: "u1", RoleID: schema.RoleUser}
+	err := svc.userDb.Create(&UserTOTP{UserID: u.PublicId, Secret: rfc6238Secret, Confirmed: true}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, rows, err := newRecoveryCodes(u.PublicId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.userDb.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// code is typed without separator and in lower case
+	typed := strings.ToLower(strings.ReplaceAll(codes[0], "-", " "))
+	if err = svc.checkSecondFactor(ctx, u, typed); err != nil {
+		t.Fatalf("recovery code %q is refused: %v", typed, err)
+	}
+	if err = svc.checkSecondFactor(ctx, u, codes[0]); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("used recovery code got %v, want invalid credentials", err)
+	}
+	if err = svc.checkSecondFactor(ctx, u, codes[1]); err != nil {
+		t.Errorf("other recovery code is refused: %v", err)
+	}
+	if err = svc.checkSecondFactor(ctx, &User{PublicId: "u2"}, codes[2]); err != nil {
+		// u2 has no second factor, so any code passes
+		t.Errorf("user without second factor is refused: %v", err)
+	}
+	err = svc.userDb.Create(&UserTOTP{UserID: "u2", Secret: rfc6238Secret, Confirmed: true}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.checkSecondFactor(ctx, &User{PublicId: "u2"}, codes[2]); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("recovery code of other user got %v, want invalid credentials", err)
+	}
+}
+
+// enroll posts enrollment request with body to path, and decodes response into res
+func enroll(t *testing.T, e *echo.Echo, path string, body map[string]string, res interface{}) int {
+	t.Helper()
+	rec := serve(e, http.MethodPost, path, "", body)
+	if res != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestEnrollmentOfPrivilegedRole(t *testing.T) {
+	svc, e := newTestAuthSvc(t)
+	svc.twoFactorRoles = map[schema.UserRole]bool{schema.RoleChief: true}
+	createTestUser(t, svc, "admin", "admin-secret", schema.RoleAdmin)
+	chief := createTestUser(t, svc, "chief", "secret", schema.RoleChief)
+	createTestUser(t, svc, "popug", "secret", schema.RoleUser)
+	createTestClient(t, svc, "web", "web-secret", oauth2.PasswordCredentials)
+	admin := login(t, e, "web", "web-secret", "admin", "admin-secret")
+	popug := login(t, e, "web", "web-secret", "popug", "secret")
+	issuePath := "/admin/users/" + chief.PublicId + "/2fa/enrollment"
+
+	// stolen password alone doesn't enroll
+	credentials := map[string]string{"login": "chief", "password": "secret"}
+	if code := enroll(t, e, "/2fa/enroll", credentials, nil); code != http.StatusForbidden {
+		t.Errorf("enrollment without token: %d, want 403", code)
+	}
+	credentials["enrollmentToken"] = "guessed"
+	if code := enroll(t, e, "/2fa/enroll", credentials, nil); code != http.StatusForbidden {
+		t.Errorf("enrollment with wrong token: %d, want 403", code)
+	}
+
+	if rec := serve(e, http.MethodPost, issuePath, popug.AccessToken, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("enrollment token issued by user: %d", rec.Code)
+	}
+	expired, _, err := issueEnrollmentToken(svc.userDb, chief.PublicId, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.userDb.Model(&EnrollmentToken{}).Where("user_id = ?", chief.PublicId).Update("expires_at", time.Now())
+	credentials["enrollmentToken"] = expired
+	if code := enroll(t, e, "/2fa/enroll", credentials, nil); code != http.StatusForbidden {
+		t.Errorf("enrollment with expired token: %d, want 403", code)
+	}
+
+	rec := serve(e, http.MethodPost, issuePath, admin.AccessToken, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("issue enrollment token: %d %s", rec.Code, rec.Body.String())
+	}
+	var issued struct {
+		EnrollmentToken string    `json:"enrollmentToken"`
+		ExpiresAt       time.Time `json:"expiresAt"`
+	}
+	if err = json.Unmarshal(rec.Body.Bytes(), &issued); err != nil || issued.EnrollmentToken == "" {
+		t.Fatalf("enrollment token %s: %v", rec.Body.String(), err)
+	}
+	if d := time.Until(issued.ExpiresAt); d < enrollmentTokenTTL-time.Minute || d > enrollmentTokenTTL {
+		t.Errorf("enrollment token expires in %s, want %s", d, enrollmentTokenTTL)
+	}
+	credentials["enrollmentToken"] = issued.EnrollmentToken
+	var secret struct {
+		Secret string `json:"secret"`
+	}
+	if code := enroll(t, e, "/2fa/enroll", credentials, &secret); code != http.StatusOK || secret.Secret == "" {
+		t.Fatalf("enrollment with token: %d %+v", code, secret)
+	}
+	key, err := totpEncoding.DecodeString(secret.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials["code"] = totpCode(key, totpStep(time.Now()))
+	var confirmed struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	if code := enroll(t, e, "/2fa/confirm", credentials, &confirmed); code != http.StatusOK ||
+		len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("confirmation: %d %+v", code, confirmed)
+	}
+
+	// token works once
+	var n int64
+	svc.userDb.Model(&EnrollmentToken{}).Where("user_id = ?", chief.PublicId).Count(&n)
+	if n != 0 {
+		t.Error("enrollment token is left after confirmation")
+	}
+	if code := enroll(t, e, "/2fa/enroll", credentials, nil); code != http.StatusForbidden {
+		t.Errorf("enrollment with used token: %d, want 403", code)
+	}
+	if rec = serve(e, http.MethodPost, issuePath, admin.AccessToken, nil); rec.Code != http.StatusConflict {
+		t.Errorf("enrollment token for enrolled user: %d, want 409", rec.Code)
+	}
+	code, res := requestToken(t, e, url.Values{"grant_type": {"password"}, "client_id": {"web"},
+		"client_secret": {"web-secret"}, "username": {"chief"}, "password": {"secret"},
+		"otp": {confirmed.RecoveryCodes[0]}})
+	if code != http.StatusOK {
+		t.Errorf("login with second factor: %d %+v", code, res)
+	}
+
+	// roles without required second factor enroll with password
+	if code := enroll(t, e, "/2fa/enroll", map[string]string{"login": "popug", "password": "secret"}, nil); code != http.StatusOK {
+		t.Errorf("enrollment of user: %d, want 200", code)
+	}
+}
+
+func TestBootstrapAdminEnrollmentToken(t *testing.T) {
+	svc, _ := newTestAuthSvc(t)
+	svc.twoFactorRoles = map[schema.UserRole]bool{schema.RoleAdmin: true}
+	var console strings.Builder
+	svc.console = &console
+
+	if err := svc.bootstrapAdmin("admin", "admin-secret"); err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile(`admin admin, valid until \S+: (\S+)\n$`).FindStringSubmatch(console.String())
+	if m == nil {
+		t.Fatalf("enrollment token is not shown: %q", console.String())
+	}
+	u := svc.mustFindUser(t, "admin")
+	if err := svc.checkEnrollmentToken(svc.userDb, &u, m[1]); err != nil {
+		t.Errorf("shown enrollment token is refused: %v", err)
+	}
+}
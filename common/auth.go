@@ -0,0 +1,244 @@
+package common
+
+import (
+	"ates/schema"
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity is owner of access token, as told by Auth
+type Identity struct {
+	PublicId  string // empty for token of service account
+	Login     string
+	Role      schema.UserRole
+	ClientID  string
+	Scope     string    // space-delimited
+	ExpiresAt time.Time // expiration of token, zero if unknown
+}
+
+// Verifier checks access token, returns identity of authenticated user
+type Verifier interface {
+	Verify(ctx context.Context, token string) (Identity, error)
+}
+
+// VerifierFunc allows to use function as Verifier, e.g. stub of Auth in tests
+type VerifierFunc func(ctx context.Context, token string) (Identity, error)
+
+func (f VerifierFunc) Verify(ctx context.Context, token string) (Identity, error) {
+	return f(ctx, token)
+}
+
+// AuthUser is authenticated user, as known by the current service, or service account
+type AuthUser struct {
+	ID       uint // local identifier
+	PublicId string
+	Role     schema.UserRole
+	ClientID string   // OAuth client, which got the token
+	Scopes   []string // permissions of service account, scopes of user token grant nothing
+}
+
+// IsService is true for service account, which has client only and no user
+func (u AuthUser) IsService() bool {
+	return u.PublicId == "" && u.ClientID != ""
+}
+
+// HasScope checks that service account is granted scope
+func (u AuthUser) HasScope(scope string) bool {
+	if !u.IsService() {
+		return false
+	}
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// UserLookup finds local copy of user with identity verified by Auth, it can create the copy
+// if event about the user hasn't arrived yet
+type UserLookup func(id Identity) (AuthUser, error)
+
+// ErrUserNotSynced is returned by UserLookup, when there is no local copy of user and identity
+// has too little to create it
+var ErrUserNotSynced = errors.New("user is not synced yet")
+
+type cachedAuth struct {
+	user    AuthUser
+	expires time.Time
+}
+
+const authUserKey = "authUser"
+
+// Authenticator verifies bearer tokens and caches verified ones for TTL, so tokens are not verified on every request.
+// Role of user is taken from Auth if verifier knows it, or from local copy. Changes of role are applied after TTL.
+// Requests are allowed by permission matrix.
+type Authenticator struct {
+	verifier     Verifier
+	introspector Verifier // asks Auth about token, nil if service doesn't introspect
+	lookup       UserLookup
+	permissions  Permissions
+	ttl          time.Duration
+	logger       *zap.SugaredLogger
+
+	mx    sync.Mutex
+	cache map[string]cachedAuth // hash of token -> user
+}
+
+// NewAuthenticator creates Authenticator, which caches verified tokens for ttl, zero ttl turns cache off
+func NewAuthenticator(verifier Verifier, lookup UserLookup, permissions Permissions, ttl time.Duration,
+	logger *zap.SugaredLogger) *Authenticator {
+
+	return &Authenticator{
+		verifier:    verifier,
+		lookup:      lookup,
+		permissions: permissions,
+		ttl:         ttl,
+		logger:      logger,
+		cache:       map[string]cachedAuth{},
+	}
+}
+
+// SetIntrospector sets verifier, which asks Auth about token on every call. It checks tokens of routes
+// with AllowFresh, and tokens of users not synced yet (lookup returns ErrUserNotSynced), as Auth knows them.
+func (a *Authenticator) SetIntrospector(introspector Verifier) {
+	a.introspector = introspector
+}
+
+// Allow returns route middleware, which allows request only for authenticated user permitted to do action.
+// User is put into echo.Context, see CurrentUser. Action missing in permission matrix stops the service.
+func (a *Authenticator) Allow(action string) echo.MiddlewareFunc {
+	return a.allow(action, false)
+}
+
+// AllowFresh is Allow, which doesn't trust cache and local verification: token is introspected on every request,
+// so revoked token or changed role are seen at once. It is for a few actions, which can't wait until token expires.
+func (a *Authenticator) AllowFresh(action string) echo.MiddlewareFunc {
+	if a.introspector == nil {
+		a.logger.Fatalf("Action %s needs introspection, but it is not set", action)
+	}
+	return a.allow(action, true)
+}
+
+func (a *Authenticator) allow(action string, fresh bool) echo.MiddlewareFunc {
+	if _, ok := a.permissions[action]; !ok {
+		a.logger.Fatalf("Action %s is missing in permissions", action)
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user, err := a.authenticate(c, fresh)
+			if err != nil {
+				a.logger.Infof("Auth failed: %s", err.Error())
+				return c.JSON(http.StatusUnauthorized, FromKeysAndValues("error", "unauthorized"))
+			}
+			if !a.permissions.Allows(action, user) {
+				return c.JSON(http.StatusForbidden, FromKeysAndValues("error", "forbidden"))
+			}
+			return next(c)
+		}
+	}
+}
+
+// authenticate returns user of request, token is verified once per request. Fresh authentication
+// introspects token, even if it is already verified.
+func (a *Authenticator) authenticate(c echo.Context, fresh bool) (AuthUser, error) {
+	if user, ok := c.Get(authUserKey).(AuthUser); ok && !fresh {
+		return user, nil
+	}
+
+	token, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return AuthUser{}, errors.New("missing bearer token")
+	}
+
+	key := HashSHA256([]byte(token))
+	now := time.Now()
+	if !fresh {
+		a.mx.Lock()
+		cached, ok := a.cache[key]
+		a.mx.Unlock()
+		if ok && now.Before(cached.expires) {
+			c.Set(authUserKey, cached.user)
+			return cached.user, nil
+		}
+	}
+
+	verifier := a.verifier
+	if fresh {
+		verifier = a.introspector
+	}
+	ctx := c.Request().Context()
+	id, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return AuthUser{}, err
+	}
+	user, err := a.userOf(id)
+	if errors.Is(err, ErrUserNotSynced) && a.introspector != nil && !fresh {
+		// Auth knows login and role to create local copy
+		id, err = a.introspector.Verify(ctx, token)
+		if err != nil {
+			return AuthUser{}, err
+		}
+		user, err = a.userOf(id)
+	}
+	if err != nil {
+		return AuthUser{}, err
+	}
+	if a.ttl > 0 {
+		a.remember(key, user, id.ExpiresAt)
+	}
+	c.Set(authUserKey, user)
+	return user, nil
+}
+
+// remember caches user of token with hash key for TTL, but not after expiration of token
+func (a *Authenticator) remember(key string, user AuthUser, tokenExpiresAt time.Time) {
+	now := time.Now()
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	for k, v := range a.cache {
+		if now.After(v.expires) {
+			delete(a.cache, k)
+		}
+	}
+	// token is not trusted after its expiration, even if it is verified recently
+	expires := now.Add(a.ttl)
+	if !tokenExpiresAt.IsZero() && tokenExpiresAt.Before(expires) {
+		expires = tokenExpiresAt
+	}
+	a.cache[key] = cachedAuth{user: user, expires: expires}
+}
+
+// userOf gives user or service account with verified identity
+func (a *Authenticator) userOf(id Identity) (AuthUser, error) {
+	switch {
+	case id.PublicId != "":
+		user, err := a.lookup(id)
+		if err != nil {
+			return AuthUser{}, err
+		}
+		if id.Role != 0 {
+			// role from Auth is up to date, local copy can lag behind
+			user.Role = id.Role
+		}
+		user.ClientID = id.ClientID
+		return user, nil
+	case id.ClientID != "":
+		// token of service account, got with client_credentials grant
+		return AuthUser{ClientID: id.ClientID, Scopes: strings.Fields(id.Scope)}, nil
+	default:
+		return AuthUser{}, errors.New("token has neither user nor client")
+	}
+}
+
+// CurrentUser returns user authenticated by Authenticator.Allow
+func CurrentUser(c echo.Context) AuthUser {
+	user, _ := c.Get(authUserKey).(AuthUser)
+	return user
+}
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"ates/schema"
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testPermissions = Permissions{
+	"task.create":   {Roles: []schema.UserRole{schema.RoleUser, schema.RoleManager}},
+	"task.reassign": {Roles: []schema.UserRole{schema.RoleManager}, Scopes: []string{"tasks:reassign"}},
+}
+
+// stubVerifier counts verifications and answers the same identity
+type stubVerifier struct {
+	id    Identity
+	err   error
+	calls int
+}
+
+func (s *stubVerifier) verifier() Verifier {
+	return VerifierFunc(func(ctx context.Context, token string) (Identity, error) {
+		s.calls++
+		return s.id, s.err
+	})
+}
+
+// localUsers is UserLookup of users with roles, which are synced already
+func localUsers(roles map[string]schema.UserRole) UserLookup {
+	return func(id Identity) (AuthUser, error) {
+		role, ok := roles[id.PublicId]
+		if !ok {
+			return AuthUser{}, ErrUserNotSynced
+		}
+		return AuthUser{ID: 1, PublicId: id.PublicId, Role: role}, nil
+	}
+}
+
+// serve sends request with token to route allowed by middleware, returns status code
+func serve(t *testing.T, allow echo.MiddlewareFunc, token string) int {
+	t.Helper()
+	e := echo.New()
+	e.GET("/", func(c echo.Context) error {
+		if CurrentUser(c).PublicId == "" && CurrentUser(c).ClientID == "" {
+			t.Error("no current user in allowed request")
+		}
+		return c.NoContent(http.StatusOK)
+	}, allow)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func newTestAuthenticator(v *stubVerifier, ttl time.Duration) *Authenticator {
+	return NewAuthenticator(v.verifier(), localUsers(map[string]schema.UserRole{
+		"u1": schema.RoleUser,
+		"a1": schema.RoleAccountant,
+	}), testPermissions, ttl, zap.NewNop().Sugar())
+}
+
+func TestAuthenticatorCache(t *testing.T) {
+	v := &stubVerifier{id: Identity{PublicId: "u1", ExpiresAt: time.Now().Add(time.Hour)}}
+	a := newTestAuthenticator(v, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if code := serve(t, a.Allow("task.create"), "t1"); code != http.StatusOK {
+			t.Fatalf("got %d, want 200", code)
+		}
+	}
+	if v.calls != 1 {
+		t.Errorf("token verified %d times within TTL, want 1", v.calls)
+	}
+	serve(t, a.Allow("task.create"), "t2")
+	if v.calls != 2 {
+		t.Errorf("other token is not verified")
+	}
+}
+
+func TestAuthenticatorCacheExpiry(t *testing.T) {
+	v := &stubVerifier{id: Identity{PublicId: "u1"}}
+	a := newTestAuthenticator(v, 20*time.Millisecond)
+	serve(t, a.Allow("task.create"), "t1")
+	time.Sleep(30 * time.Millisecond)
+	serve(t, a.Allow("task.create"), "t1")
+	if v.calls != 2 {
+		t.Errorf("token verified %d times, want 2 after TTL", v.calls)
+	}
+
+	// token expiring before TTL is not trusted after expiration
+	v = &stubVerifier{id: Identity{PublicId: "u1", ExpiresAt: time.Now().Add(20 * time.Millisecond)}}
+	a = newTestAuthenticator(v, time.Hour)
+	serve(t, a.Allow("task.create"), "t1")
+	serve(t, a.Allow("task.create"), "t1")
+	if v.calls != 1 {
+		t.Fatalf("token verified %d times before expiration, want 1", v.calls)
+	}
+	time.Sleep(30 * time.Millisecond)
+	v.err = errors.New("token is expired")
+	if code := serve(t, a.Allow("task.create"), "t1"); code != http.StatusUnauthorized {
+		t.Errorf("expired token got %d, want 401", code)
+	}
+	if v.calls != 2 {
+		t.Errorf("token verified %d times, want 2 after expiration", v.calls)
+	}
+}
+
+func TestAuthenticatorWithoutCache(t *testing.T) {
+	v := &stubVerifier{id: Identity{PublicId: "u1", ExpiresAt: time.Now().Add(time.Hour)}}
+	a := newTestAuthenticator(v, 0)
+	for i := 0; i < 3; i++ {
+		serve(t, a.Allow("task.create"), "t1")
+	}
+	if v.calls != 3 || len(a.cache) != 0 {
+		t.Errorf("token verified %d times with %d cached, want every time without cache", v.calls, len(a.cache))
+	}
+}
+
+func TestAuthenticatorUnauthorized(t *testing.T) {
+	v := &stubVerifier{id: Identity{PublicId: "u1"}}
+	a := newTestAuthenticator(v, time.Minute)
+	if code := serve(t, a.Allow("task.create"), ""); code != http.StatusUnauthorized {
+		t.Errorf("request without token got %d, want 401", code)
+	}
+	if v.calls != 0 {
+		t.Error("verifier is called without token")
+	}
+
+	v.err = errors.New("bad signature")
+	if code := serve(t, a.Allow("task.create"), "t1"); code != http.StatusUnauthorized {
+		t.Errorf("request with bad token got %d, want 401", code)
+	}
+	// failed verification is not cached
+	v.err = nil
+	if code := serve(t, a.Allow("task.create"), "t1"); code != http.StatusOK {
+		t.Errorf("request with good token got %d, want 200", code)
+	}
+}
+
+func TestAuthenticatorForbidden(t *testing.T) {
+	v := &stubVerifier{id: Identity{PublicId: "a1"}}
+	a := newTestAuthenticator(v, time.Minute)
+	if code := serve(t, a.Allow("task.create"), "t1"); code != http.StatusForbidden {
+		t.Errorf("accountant creating task got %d, want 403", code)
+	}
+
+	// role told by Auth overrides local copy
+	v = &stubVerifier{id: Identity{PublicId: "u1", Role: schema.RoleManager}}
+	a = newTestAuthenticator(v, time.Minute)
+	if code := serve(t, a.Allow("task.reassign"), "t1"); code != http.StatusOK {
+		t.Errorf("manager reassigning tasks got %d, want 200", code)
+	}
+}
+
+func TestAuthenticatorServiceAccount(t *testing.T) {
+	v := &stubVerifier{id: Identity{ClientID: "cron", Scope: "reports tasks:reassign"}}
+	a := newTestAuthenticator(v, time.Minute)
+	if code := serve(t, a.Allow("task.reassign"), "t1"); code != http.StatusOK {
+		t.Errorf("service account with scope got %d, want 200", code)
+	}
+	if code := serve(t, a.Allow("task.create"), "t1"); code != http.StatusForbidden {
+		t.Errorf("service account without scope got %d, want 403", code)
+	}
+
+	// scope of user token grants nothing
+	v = &stubVerifier{id: Identity{PublicId: "u1", ClientID: "web", Scope: "tasks:reassign"}}
+	a = newTestAuthenticator(v, time.Minute)
+	if code := serve(t, a.Allow("task.reassign"), "t1"); code != http.StatusForbidden {
+		t.Errorf("user token with scope got %d, want 403", code)
+	}
+
+	v = &stubVerifier{id: Identity{}}
+	a = newTestAuthenticator(v, time.Minute)
+	if code := serve(t, a.Allow("task.reassign"), "t1"); code != http.StatusUnauthorized {
+		t.Errorf("token without user and client got %d, want 401", code)
+	}
+}
+
+func TestAuthenticatorIntrospection(t *testing.T) {
+	local := &stubVerifier{id: Identity{PublicId: "new"}}
+	introspector := &stubVerifier{id: Identity{PublicId: "new", Login: "popug", Role: schema.RoleUser}}
+	synced := map[string]schema.UserRole{"u1": schema.RoleUser}
+	a := NewAuthenticator(local.verifier(), func(id Identity) (AuthUser, error) {
+		role, ok := synced[id.PublicId]
+		if !ok {
+			if id.Login == "" {
+				return AuthUser{}, ErrUserNotSynced
+			}
+			// copy is created from introspection
+			synced[id.PublicId] = id.Role
+			role = id.Role
+		}
+		return AuthUser{PublicId: id.PublicId, Role: role}, nil
+	}, testPermissions, time.Minute, zap.NewNop().Sugar())
+
+	if code := serve(t, a.Allow("task.create"), "t1"); code != http.StatusUnauthorized {
+		t.Errorf("user not synced without introspection got %d, want 401", code)
+	}
+
+	a.SetIntrospector(introspector.verifier())
+	if code := serve(t, a.Allow("task.create"), "t1"); code != http.StatusOK {
+		t.Errorf("user not synced got %d, want 200", code)
+	}
+	if introspector.calls != 1 {
+		t.Errorf("introspected %d times, want 1", introspector.calls)
+	}
+	serve(t, a.Allow("task.create"), "t1")
+	if introspector.calls != 1 {
+		t.Errorf("cached token is introspected")
+	}
+
+	// fresh route introspects every time, revoked token is refused at once
+	fresh := a.AllowFresh("task.create")
+	serve(t, fresh, "t1")
+	introspector.err = errors.New("token is not active")
+	if code := serve(t, fresh, "t1"); code != http.StatusUnauthorized {
+		t.Errorf("revoked token on fresh route got %d, want 401", code)
+	}
+	if introspector.calls != 3 {
+		t.Errorf("introspected %d times, want 3", introspector.calls)
+	}
+}
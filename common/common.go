@@ -1,6 +1,8 @@
 package common
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -10,7 +12,9 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"math/rand"
+	"math/big"
+	"net"
+	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -69,17 +73,25 @@ const digitBytes = "0123456789"
 const letterBytes = "abcdefghijklmnopqrstuwxyz"
 const digitLetterBytes = digitBytes + letterBytes
 
-// GenerateRandomString returns string containing N symbols: lowercase latins and digits
+// GenerateRandomString returns string containing N symbols: lowercase latins and digits.
+// Symbols are taken from crypto/rand, so the string can be used as secret.
 func GenerateRandomString(n int) string {
 	b := make([]byte, n)
+	max := big.NewInt(int64(len(digitLetterBytes)))
 	for i := range b {
-		b[i] = digitLetterBytes[rand.Int63()%int64(len(digitLetterBytes))]
+		k, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err) // crypto/rand doesn't fail on supported platforms
+		}
+		b[i] = digitLetterBytes[k.Int64()]
 	}
 	return string(b)
 }
 
 func GetNewEcho(logger *zap.SugaredLogger) *echo.Echo {
 	e := echo.New()
+	e.IPExtractor = ipExtractor(os.Getenv("ATES_TRUSTED_PROXIES"), logger)
+	e.Use(CorrelationMiddleware())
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
 		LogURI:      true,
 		LogStatus:   true,
@@ -92,6 +104,7 @@ func GetNewEcho(logger *zap.SugaredLogger) *echo.Echo {
 				"status", v.Status,
 				"ip", v.RemoteIP,
 				"latency_human", v.Latency.String(),
+				"correlation_id", CorrelationID(c.Request().Context()),
 			)
 			return nil
 		},
@@ -99,6 +112,45 @@ func GetNewEcho(logger *zap.SugaredLogger) *echo.Echo {
 	return e
 }
 
+// ipExtractor returns how real address of client is found. X-Forwarded-For is set by client, so it is used
+// only with trusted proxies: comma-separated CIDRs, e.g. "10.0.0.0/8". Without them the peer address is used.
+func ipExtractor(trustedProxies string, logger *zap.SugaredLogger) echo.IPExtractor {
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range strings.Split(trustedProxies, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Fatalf("Bad CIDR %s in ATES_TRUSTED_PROXIES: %s", cidr, err.Error())
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	if len(options) == 3 {
+		return echo.ExtractIPDirect()
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// StartEcho serves requests until context is cancelled, then shuts server down gracefully
+func StartEcho(ctx context.Context, e *echo.Echo, address string, logger *zap.SugaredLogger) {
+	go func() {
+		err := e.Start(address)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := e.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
 func GetZapCore(forDevel bool) zapcore.Core {
 	allLevels := zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
 		if forDevel {
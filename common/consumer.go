@@ -0,0 +1,211 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// EventHandler processes event, all database work must be done within transaction tx.
+// Events produced by handler with ctx are caused by the processed event.
+type EventHandler func(ctx context.Context, tx *gorm.DB, e *Event) error
+
+// EventConsumer reads messages from Kafka and dispatches them to handlers registered by event name and version.
+// Offsets are committed manually, only after handler's transaction is committed.
+// Message failed after all retry attempts is moved to dead-letter queue, see DeadLetter.
+type EventConsumer struct {
+	name        string
+	consumer    *kafka.Consumer
+	db          *gorm.DB
+	logger      *zap.SugaredLogger
+	handlers    map[string]EventHandler
+	retryPolicy RetryPolicy
+	dlqTopic    string
+}
+
+// NewEventConsumer wraps Kafka consumer, which must be created with "enable.auto.commit"=false.
+// Name is used to mark dead letters and to build name of DLQ topic.
+func NewEventConsumer(name string, consumer *kafka.Consumer, db *gorm.DB, logger *zap.SugaredLogger) *EventConsumer {
+	return &EventConsumer{
+		name:        name,
+		consumer:    consumer,
+		db:          db,
+		logger:      logger,
+		handlers:    map[string]EventHandler{},
+		retryPolicy: DefaultRetryPolicy,
+		dlqTopic:    strings.ToLower(name) + ".dlq",
+	}
+}
+
+// SetRetryPolicy overrides DefaultRetryPolicy.
+// Sum of backoffs must be less than max.poll.interval.ms, otherwise consumer leaves the group while retrying.
+func (c *EventConsumer) SetRetryPolicy(p RetryPolicy) {
+	c.retryPolicy = p
+}
+
+// Subscribe subscribes to topics. Messages are processed one by one, and offset is committed after each of them,
+// so after rebalance new owner of partition continues right after the last processed message, keeping the order.
+func (c *EventConsumer) Subscribe(topics []string) error {
+	return c.consumer.SubscribeTopics(topics, c.onRebalance)
+}
+
+// onRebalance is called from ReadMessage, never in the middle of message processing.
+// Partitions are (un)assigned by library after the callback.
+func (c *EventConsumer) onRebalance(_ *kafka.Consumer, ev kafka.Event) error {
+	switch e := ev.(type) {
+	case kafka.AssignedPartitions:
+		c.logger.Infof("Partitions assigned: %v", e.Partitions)
+	case kafka.RevokedPartitions:
+		if c.consumer.AssignmentLost() {
+			c.logger.Errorf("Partitions lost, their last messages could be processed again: %v", e.Partitions)
+		} else {
+			c.logger.Infof("Partitions revoked: %v", e.Partitions)
+		}
+	}
+	return nil
+}
+
+func handlerKey(event, version string) string {
+	return event + "/" + version
+}
+
+// Handle registers handler for event with given name and eventVersion; empty version matches any version
+func (c *EventConsumer) Handle(event, version string, h EventHandler) {
+	c.handlers[handlerKey(event, version)] = h
+}
+
+// handlerFor returns handler for exact event version, or handler registered for any version
+func (c *EventConsumer) handlerFor(event, version string) (EventHandler, bool) {
+	if h, ok := c.handlers[handlerKey(event, version)]; ok {
+		return h, true
+	}
+	h, ok := c.handlers[handlerKey(event, "")]
+	return h, ok
+}
+
+// Run reads messages until context is cancelled, then closes Kafka consumer
+func (c *EventConsumer) Run(ctx context.Context) {
+	defer func() {
+		_ = c.consumer.Close()
+	}()
+
+	for ctx.Err() == nil {
+		msg, err := c.consumer.ReadMessage(time.Second)
+		if err != nil {
+			var kafkaErr kafka.Error
+			if errors.As(err, &kafkaErr) && kafkaErr.IsTimeout() {
+				continue
+			}
+			c.logger.Error(err)
+			continue
+		}
+
+		err = c.processWithRetries(ctx, msg)
+		if err != nil {
+			// offset is not committed, event is not lost: rewind, so the message is read again
+			c.logger.Errorf("Failed to process message %s at %v: %s", msg.Key, msg.TopicPartition, err.Error())
+			err = c.consumer.Seek(msg.TopicPartition, 0)
+			if err != nil {
+				c.logger.Errorf("Failed to rewind to %v: %s", msg.TopicPartition, err.Error())
+			}
+			continue
+		}
+
+		_, err = c.consumer.CommitMessage(msg)
+		if err != nil {
+			c.logger.Errorf("Failed to commit offset %v: %s", msg.TopicPartition, err.Error())
+		}
+	}
+}
+
+// processWithRetries calls handler according to retry policy, and moves message to DLQ if all attempts failed.
+// Returned error means the message must be read again.
+func (c *EventConsumer) processWithRetries(ctx context.Context, msg *kafka.Message) error {
+	// events of the same entity share the key: while earlier one is in dead letters, later ones must wait there too
+	parked, err := c.hasPendingDeadLetter(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if parked {
+		return c.moveToDeadLetters(ctx, msg, errors.New("earlier event with the same key is in dead letters"), 0)
+	}
+
+	for attempt := 1; attempt <= c.retryPolicy.MaxAttempts; attempt++ {
+		err = c.process(ctx, msg)
+		if err == nil {
+			return nil
+		}
+		c.logger.Infof("Attempt %d of processing message %s at %v failed: %s",
+			attempt, msg.Key, msg.TopicPartition, err.Error())
+
+		if attempt < c.retryPolicy.MaxAttempts {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.retryPolicy.backoff(attempt)):
+			}
+		}
+	}
+	return c.moveToDeadLetters(ctx, msg, err, c.retryPolicy.MaxAttempts)
+}
+
+// process runs registered handler in transaction, messages without handler are skipped
+func (c *EventConsumer) process(ctx context.Context, msg *kafka.Message) error {
+	e, err := ParseEvent(msg)
+	if err != nil {
+		c.logger.Infof("%s in the message %s, skipping", err.Error(), msg.Key)
+		return nil
+	}
+
+	h, ok := c.handlerFor(e.Name, e.Version)
+	if !ok {
+		c.logger.Debugf("no handler for %s %s, skipping", e.Name, e.Version)
+		return nil
+	}
+
+	c.logger.Debugf("Processing %s %s, eventId=%s correlationId=%s", e.Name, e.Version, e.ID, e.CorrelationID)
+	return c.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return c.handleOnce(WithCause(ctx, e), tx, h, e)
+	})
+}
+
+// ProcessedEvent marks event as handled by consumer, it is saved in the same transaction as handler's changes
+type ProcessedEvent struct {
+	Consumer    string `gorm:"primaryKey;type:varchar(64)"`
+	EventID     string `gorm:"primaryKey;type:varchar(64)"`
+	ProcessedAt time.Time
+}
+
+// handleOnce calls handler if event with the same eventId was not processed by this consumer yet.
+// Messages without eventId are always handled.
+func (c *EventConsumer) handleOnce(ctx context.Context, tx *gorm.DB, h EventHandler, e *Event) error {
+	if e.ID == "" {
+		return h(ctx, tx, e)
+	}
+
+	var processed ProcessedEvent
+	result := tx.Where("consumer = ? and event_id = ?", c.name, e.ID).Limit(1).Find(&processed)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 1 {
+		c.logger.Infof("Event %s is already processed, skipping", e.ID)
+		return nil
+	}
+
+	err := h(ctx, tx, e)
+	if err != nil {
+		return err
+	}
+
+	// concurrent insert of the same event fails on primary key, and the whole transaction is rolled back
+	return tx.Create(&ProcessedEvent{
+		Consumer:    c.name,
+		EventID:     e.ID,
+		ProcessedAt: time.Now().UTC(),
+	}).Error
+}
@@ -0,0 +1,184 @@
+package common
+
+import (
+	"ates/common/testutil"
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"testing"
+)
+
+// handledRow is written by test handlers, to see whether their transaction is committed
+type handledRow struct {
+	ID    uint
+	Event string
+}
+
+func newTestConsumer(t *testing.T) *EventConsumer {
+	db := testutil.OpenDB(t, &handledRow{}, &ProcessedEvent{}, &DeadLetter{}, &OutboxMessage{})
+	return NewEventConsumer("Test", nil, db, zap.NewNop().Sugar())
+}
+
+// testMessage builds message of event with name and version, empty name means message without envelope
+func testMessage(name, version, key string) *kafka.Message {
+	if name == "" {
+		topic := "task.lifecycle"
+		return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Key: []byte(key)}
+	}
+	e := NewEvent(context.Background(), name, version, []byte(name+" "+version))
+	e.Key = []byte(key)
+	return e.Message("task.lifecycle")
+}
+
+// saveEvent is handler, which saves name and version of event
+func saveEvent(_ context.Context, tx *gorm.DB, e *Event) error {
+	return tx.Create(&handledRow{Event: e.Name + " " + e.Version}).Error
+}
+
+func handledEvents(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	var rows []handledRow
+	if err := db.Order("id").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, r := range rows {
+		events = append(events, r.Event)
+	}
+	return events
+}
+
+func TestHandlerFor(t *testing.T) {
+	c := newTestConsumer(t)
+	var called string
+	handler := func(name string) EventHandler {
+		return func(context.Context, *gorm.DB, *Event) error {
+			called = name
+			return nil
+		}
+	}
+	c.Handle("Task.Created", "v2", handler("v2"))
+	c.Handle("Task.Created", "", handler("any"))
+
+	tests := []struct {
+		event, version, want string
+	}{
+		{"Task.Created", "v2", "v2"},
+		{"Task.Created", "v1", "any"},
+		{"Task.Created", "", "any"},
+		{"Task.Updated", "v2", ""},
+	}
+	for _, tt := range tests {
+		called = ""
+		h, ok := c.handlerFor(tt.event, tt.version)
+		if ok {
+			_ = h(context.Background(), nil, nil)
+		}
+		if called != tt.want {
+			t.Errorf("handlerFor(%s, %s) calls %q, want %q", tt.event, tt.version, called, tt.want)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	c := newTestConsumer(t)
+	c.Handle("Task.Created", "v2", saveEvent)
+	c.Handle("Task.Completed", "v1", func(ctx context.Context, tx *gorm.DB, e *Event) error {
+		if err := saveEvent(ctx, tx, e); err != nil {
+			return err
+		}
+		return errors.New("account not found")
+	})
+	ctx := context.Background()
+
+	// messages without envelope or handler are skipped
+	for _, msg := range []*kafka.Message{testMessage("", "", "t1"), testMessage("Task.Assigned", "v1", "t1")} {
+		if err := c.process(ctx, msg); err != nil {
+			t.Errorf("skipped message got %v", err)
+		}
+	}
+	if err := c.process(ctx, testMessage("Task.Created", "v2", "t1")); err != nil {
+		t.Fatal(err)
+	}
+	// failed handler's changes are rolled back
+	if err := c.process(ctx, testMessage("Task.Completed", "v1", "t1")); err == nil {
+		t.Error("error of handler is not returned")
+	}
+	if got := handledEvents(t, c.db); len(got) != 1 || got[0] != "Task.Created v2" {
+		t.Errorf("handled %v, want only Task.Created v2", got)
+	}
+}
+
+func TestHandleOnce(t *testing.T) {
+	c := newTestConsumer(t)
+	c.Handle("Task.Created", "v2", saveEvent)
+	ctx := context.Background()
+
+	msg := testMessage("Task.Created", "v2", "t1")
+	for i := 0; i < 2; i++ {
+		if err := c.process(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := handledEvents(t, c.db); len(got) != 1 {
+		t.Errorf("redelivered event is handled %d times, want once", len(got))
+	}
+	var n int64
+	c.db.Model(&ProcessedEvent{}).Where("consumer = ?", "Test").Count(&n)
+	if n != 1 {
+		t.Errorf("%d processed events are saved, want 1", n)
+	}
+
+	// other consumer processes the same event on its own
+	other := NewEventConsumer("Other", nil, c.db, c.logger)
+	other.Handle("Task.Created", "", saveEvent)
+	if err := other.process(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := handledEvents(t, c.db); len(got) != 2 {
+		t.Errorf("event is handled %d times by two consumers, want 2", len(got))
+	}
+}
+
+func TestHandleOnceWithoutEventID(t *testing.T) {
+	c := newTestConsumer(t)
+	c.Handle("Task.Created", "v2", saveEvent)
+	msg := testMessage("Task.Created", "v2", "t1")
+	msg.Headers = msg.Headers[1:] // eventId is the first header
+	if _, err := GetKafkaHeader(msg, HeaderEventID); err == nil {
+		t.Fatal("message has eventId")
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.process(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := handledEvents(t, c.db); len(got) != 2 {
+		t.Errorf("event without id is handled %d times, want every time", len(got))
+	}
+}
+
+func TestHandleOnceRollsBackFailedHandler(t *testing.T) {
+	c := newTestConsumer(t)
+	failing := true
+	c.Handle("Task.Created", "v2", func(ctx context.Context, tx *gorm.DB, e *Event) error {
+		if failing {
+			return errors.New("user not synced")
+		}
+		return saveEvent(ctx, tx, e)
+	})
+	msg := testMessage("Task.Created", "v2", "t1")
+	if err := c.process(context.Background(), msg); err == nil {
+		t.Fatal("error of handler is not returned")
+	}
+	// failed event is not marked processed, so its retry is handled
+	failing = false
+	if err := c.process(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := handledEvents(t, c.db); len(got) != 1 {
+		t.Errorf("retried event is handled %d times, want once", len(got))
+	}
+}
@@ -0,0 +1,257 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy defines how many times handler is called for a message, and pauses between attempts
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// backoff returns pause after given failed attempt, doubling it each time
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// RetryPolicyFromEnv reads <prefix>_RETRY_ATTEMPTS, <prefix>_RETRY_BACKOFF and <prefix>_RETRY_MAX_BACKOFF,
+// missing values are taken from DefaultRetryPolicy
+func RetryPolicyFromEnv(prefix string) (RetryPolicy, error) {
+	p := DefaultRetryPolicy
+	if v := os.Getenv(prefix + "_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("bad value of %s_RETRY_ATTEMPTS", prefix)
+		}
+		p.MaxAttempts = n
+	}
+	if v := os.Getenv(prefix + "_RETRY_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return p, fmt.Errorf("bad value of %s_RETRY_BACKOFF", prefix)
+		}
+		p.InitialBackoff = d
+	}
+	if v := os.Getenv(prefix + "_RETRY_MAX_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return p, fmt.Errorf("bad value of %s_RETRY_MAX_BACKOFF", prefix)
+		}
+		p.MaxBackoff = d
+	}
+	return p, nil
+}
+
+// DeadLetter is a message that consumer failed to process after all retry attempts.
+// It is also published to DLQ topic of the consumer via outbox.
+type DeadLetter struct {
+	gorm.Model
+	Consumer   string     `json:"consumer"`
+	Topic      string     `json:"topic"`
+	Partition  int32      `json:"partition"`
+	Offset     int64      `json:"offset"`
+	Event      string     `json:"event"`
+	Key        []byte     `json:"key"`
+	Headers    string     `gorm:"type:text" json:"headers"` // json-encoded []kafka.Header
+	Value      []byte     `json:"value"`
+	Error      string     `gorm:"type:text" json:"error"`
+	Attempts   int        `json:"attempts"`
+	RedrivenAt *time.Time `gorm:"index" json:"redrivenAt"`
+}
+
+func (d *DeadLetter) toKafkaMessage() (*kafka.Message, error) {
+	topic := d.Topic
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: d.Partition, Offset: kafka.Offset(d.Offset)},
+		Key:            d.Key,
+		Value:          d.Value,
+	}
+	if d.Headers != "" {
+		err := json.Unmarshal([]byte(d.Headers), &msg.Headers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// moveToDeadLetters saves failed message and puts its copy to DLQ topic, with original headers,
+// error and number of attempts
+func (c *EventConsumer) moveToDeadLetters(ctx context.Context, msg *kafka.Message, cause error, attempts int) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+	eventType, _ := GetKafkaHeader(msg, HeaderEvent)
+
+	dl := DeadLetter{
+		Consumer:  c.name,
+		Topic:     *msg.TopicPartition.Topic,
+		Partition: msg.TopicPartition.Partition,
+		Offset:    int64(msg.TopicPartition.Offset),
+		Event:     eventType,
+		Key:       msg.Key,
+		Headers:   string(headers),
+		Value:     msg.Value,
+		Error:     cause.Error(),
+		Attempts:  attempts,
+	}
+
+	dlqMsg := kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &c.dlqTopic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        append([]kafka.Header{}, msg.Headers...),
+	}
+	AppendKafkaHeader(&dlqMsg, "dlqError", cause.Error())
+	AppendKafkaHeader(&dlqMsg, "dlqAttempts", strconv.Itoa(attempts))
+	AppendKafkaHeader(&dlqMsg, "dlqConsumer", c.name)
+	AppendKafkaHeader(&dlqMsg, "dlqOriginalTopic", dl.Topic)
+	AppendKafkaHeader(&dlqMsg, "dlqOriginalPartition", strconv.Itoa(int(dl.Partition)))
+	AppendKafkaHeader(&dlqMsg, "dlqOriginalOffset", strconv.FormatInt(dl.Offset, 10))
+
+	err = c.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Create(&dl)
+		if result.RowsAffected != 1 {
+			return errors.New("failed to save dead letter")
+		}
+		return StoreInOutbox(tx, &dlqMsg)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move message to dead letters: %w", err)
+	}
+
+	c.logger.Errorf("Message %s at %v is moved to %s after %d attempts: %s",
+		msg.Key, msg.TopicPartition, c.dlqTopic, attempts, cause.Error())
+	return nil
+}
+
+// hasPendingDeadLetter checks if there is not redriven dead letter with the same topic and key
+func (c *EventConsumer) hasPendingDeadLetter(ctx context.Context, msg *kafka.Message) (bool, error) {
+	if len(msg.Key) == 0 {
+		return false, nil
+	}
+	var n int64
+	err := c.db.WithContext(ctx).Model(&DeadLetter{}).
+		Where(&DeadLetter{Consumer: c.name, Topic: *msg.TopicPartition.Topic, Key: msg.Key}).
+		Where("redriven_at is null").
+		Count(&n).Error
+	return n > 0, err
+}
+
+// DeadLetters returns dead letters of this consumer, only not redriven if pendingOnly is set
+func (c *EventConsumer) DeadLetters(pendingOnly bool) ([]DeadLetter, error) {
+	var list []DeadLetter
+	q := c.db.Where("consumer = ?", c.name)
+	if pendingOnly {
+		q = q.Where("redriven_at is null")
+	}
+	err := q.Order("id").Find(&list).Error
+	return list, err
+}
+
+// Redrive processes dead letter with registered handler again, and marks it redriven on success
+func (c *EventConsumer) Redrive(ctx context.Context, id uint) error {
+	db := c.db.WithContext(ctx)
+	var dl DeadLetter
+	result := db.Where("id = ? and consumer = ?", id, c.name).Limit(1).Find(&dl)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return errors.New("dead letter not found")
+	}
+	if dl.RedrivenAt != nil {
+		return errors.New("dead letter is already redriven")
+	}
+	if len(dl.Key) > 0 {
+		var earlier int64
+		err := db.Model(&DeadLetter{}).
+			Where(&DeadLetter{Consumer: c.name, Topic: dl.Topic, Key: dl.Key}).
+			Where("redriven_at is null and id < ?", dl.ID).
+			Count(&earlier).Error
+		if err != nil {
+			return err
+		}
+		if earlier > 0 {
+			return errors.New("earlier dead letter with the same key must be redriven first")
+		}
+	}
+
+	msg, err := dl.toKafkaMessage()
+	if err != nil {
+		return err
+	}
+	e, err := ParseEvent(msg)
+	if err != nil {
+		return err
+	}
+	h, ok := c.handlerFor(e.Name, e.Version)
+	if !ok {
+		return fmt.Errorf("no handler for %s %s", e.Name, e.Version)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := c.handleOnce(WithCause(ctx, e), tx, h, e)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		dl.RedrivenAt = &now
+		return tx.Save(&dl).Error
+	})
+}
+
+// ListDeadLettersHandler renders dead letters of the consumer, with ?all=true includes already redriven ones
+func (c *EventConsumer) ListDeadLettersHandler() echo.HandlerFunc {
+	return func(ec echo.Context) error {
+		list, err := c.DeadLetters(ec.QueryParam("all") != "true")
+		if err != nil {
+			c.logger.Error(err)
+			return ec.JSON(http.StatusInternalServerError, FromKeysAndValues("error", "failed to list dead letters"))
+		}
+		return ec.JSON(http.StatusOK, list)
+	}
+}
+
+// RedriveDeadLetterHandler processes dead letter with id from path again, see Redrive
+func (c *EventConsumer) RedriveDeadLetterHandler() echo.HandlerFunc {
+	return func(ec echo.Context) error {
+		id, err := strconv.ParseUint(ec.Param("id"), 10, 32)
+		if err != nil {
+			return ec.JSON(http.StatusBadRequest, FromKeysAndValues("error", "bad id"))
+		}
+
+		err = c.Redrive(ec.Request().Context(), uint(id))
+		if err != nil {
+			c.logger.Errorf("Failed to redrive dead letter#%d: %s", id, err.Error())
+			return ec.JSON(http.StatusBadRequest, FromKeysAndValues("error", err.Error()))
+		}
+		return ec.JSON(http.StatusOK, FromKeysAndValues("result", "dead letter redriven"))
+	}
+}
@@ -0,0 +1,199 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"gorm.io/gorm"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	want := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second, // capped
+		10 * time.Second,
+	}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+	if got := p.backoff(1000); got != p.MaxBackoff {
+		t.Errorf("backoff of many attempts = %s, want cap %s", got, p.MaxBackoff)
+	}
+
+	// initial backoff above the cap is capped too
+	p = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute, MaxBackoff: time.Second}
+	if got := p.backoff(1); got != time.Second {
+		t.Errorf("backoff(1) = %s, want cap %s", got, time.Second)
+	}
+}
+
+func TestRetryPolicyFromEnv(t *testing.T) {
+	p, err := RetryPolicyFromEnv("ATES_TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != DefaultRetryPolicy {
+		t.Errorf("policy without env = %+v, want default %+v", p, DefaultRetryPolicy)
+	}
+
+	t.Setenv("ATES_TEST_RETRY_ATTEMPTS", "3")
+	t.Setenv("ATES_TEST_RETRY_BACKOFF", "250ms")
+	p, err = RetryPolicyFromEnv("ATES_TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RetryPolicy{MaxAttempts: 3, InitialBackoff: 250 * time.Millisecond, MaxBackoff: DefaultRetryPolicy.MaxBackoff}
+	if p != want {
+		t.Errorf("policy = %+v, want %+v", p, want)
+	}
+
+	t.Setenv("ATES_TEST_RETRY_MAX_BACKOFF", "2m")
+	p, err = RetryPolicyFromEnv("ATES_TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxBackoff != 2*time.Minute {
+		t.Errorf("max backoff = %s, want 2m", p.MaxBackoff)
+	}
+
+	tests := []struct {
+		name, value string
+	}{
+		{"ATES_TEST_RETRY_ATTEMPTS", "many"},
+		{"ATES_TEST_RETRY_ATTEMPTS", "0"},
+		{"ATES_TEST_RETRY_BACKOFF", "1"},
+		{"ATES_TEST_RETRY_MAX_BACKOFF", "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			if _, err := RetryPolicyFromEnv("ATES_TEST"); err == nil {
+				t.Errorf("bad %s=%s is accepted", tt.name, tt.value)
+			}
+		})
+	}
+}
+
+func TestDeadLetterAndRedrive(t *testing.T) {
+	c := newTestConsumer(t)
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	failing := true
+	attempts := 0
+	c.Handle("Task.Completed", "v1", func(ctx context.Context, tx *gorm.DB, e *Event) error {
+		attempts++
+		if failing {
+			return errors.New("account not found")
+		}
+		return saveEvent(ctx, tx, e)
+	})
+	ctx := context.Background()
+
+	if err := c.processWithRetries(ctx, testMessage("Task.Completed", "v1", "t1")); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("handler is called %d times, want 2", attempts)
+	}
+	list, err := c.DeadLetters(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Attempts != 2 || list[0].Error != "account not found" || list[0].Event != "Task.Completed" {
+		t.Fatalf("dead letters %+v, want one after 2 attempts", list)
+	}
+	var dlq []OutboxMessage
+	c.db.Where("topic = ?", "test.dlq").Find(&dlq)
+	if len(dlq) != 1 {
+		t.Errorf("%d messages are sent to DLQ topic, want 1", len(dlq))
+	}
+
+	if err = c.Redrive(ctx, list[0].ID+1); err == nil || err.Error() != "dead letter not found" {
+		t.Errorf("redrive of unknown dead letter got %v", err)
+	}
+	if err = c.Redrive(ctx, list[0].ID); err == nil {
+		t.Error("redrive with failing handler succeeded")
+	}
+	failing = false
+	if err = c.Redrive(ctx, list[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := handledEvents(t, c.db); len(got) != 1 || got[0] != "Task.Completed v1" {
+		t.Errorf("redriven event is handled as %v", got)
+	}
+	if err = c.Redrive(ctx, list[0].ID); err == nil || !strings.Contains(err.Error(), "already redriven") {
+		t.Errorf("second redrive got %v", err)
+	}
+	if list, _ = c.DeadLetters(true); len(list) != 0 {
+		t.Errorf("pending dead letters %+v after redrive", list)
+	}
+}
+
+func TestRedriveDatabaseError(t *testing.T) {
+	c := newTestConsumer(t)
+	sqlDB, err := c.db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = sqlDB.Close()
+	err = c.Redrive(context.Background(), 1)
+	if err == nil || err.Error() == "dead letter not found" {
+		t.Errorf("redrive without database got %v, want database error", err)
+	}
+}
+
+func TestLaterEventsOfKeyWaitInDeadLetters(t *testing.T) {
+	c := newTestConsumer(t)
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	failing := true
+	c.Handle("Task.Created", "v3", func(ctx context.Context, tx *gorm.DB, e *Event) error {
+		if failing && string(e.Key) == "t1" {
+			return errors.New("author not synced")
+		}
+		return saveEvent(ctx, tx, e)
+	})
+	c.Handle("Task.Completed", "v3", saveEvent)
+	ctx := context.Background()
+
+	for _, msg := range []*kafka.Message{
+		testMessage("Task.Created", "v3", "t1"),
+		testMessage("Task.Completed", "v3", "t1"), // must not overtake creation of t1
+		testMessage("Task.Created", "v3", "t2"),
+	} {
+		if err := c.processWithRetries(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := handledEvents(t, c.db); len(got) != 1 || got[0] != "Task.Created v3" {
+		t.Errorf("handled %v, want only creation of t2", got)
+	}
+	list, err := c.DeadLetters(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[1].Event != "Task.Completed" || list[1].Attempts != 0 {
+		t.Fatalf("dead letters %+v, want failed creation and parked completion of t1", list)
+	}
+
+	failing = false
+	if err = c.Redrive(ctx, list[1].ID); err == nil {
+		t.Error("later dead letter of the key is redriven first")
+	}
+	for _, dl := range list {
+		if err = c.Redrive(ctx, dl.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := handledEvents(t, c.db)
+	if len(got) != 3 || got[1] != "Task.Created v3" || got[2] != "Task.Completed v3" {
+		t.Errorf("handled %v, want events of t1 in order after redrive", got)
+	}
+}
@@ -0,0 +1,160 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"time"
+)
+
+// Kafka headers of event envelope
+const (
+	HeaderEventID         = "eventId"
+	HeaderEvent           = "event"
+	HeaderEventVersion    = "eventVersion"
+	HeaderProducer        = "producer"
+	HeaderProducerVersion = "producerVersion"
+	HeaderOccurredAt      = "occurredAt"
+	HeaderCorrelationID   = "correlationId"
+	HeaderCausationID     = "causationId"
+)
+
+// CorrelationHeader is HTTP header with identifier of the request chain
+const CorrelationHeader = "X-Correlation-ID"
+
+var producerName, producerVersion string
+
+// SetProducer sets name and version of current service, they are written to every produced event
+func SetProducer(name, version string) {
+	producerName = name
+	producerVersion = version
+}
+
+// Event is an envelope of domain event: Avro payload with its metadata, which travels in Kafka headers
+type Event struct {
+	ID              string
+	Name            string
+	Version         string
+	Producer        string
+	ProducerVersion string
+	OccurredAt      time.Time
+	CorrelationID   string // identifier of the whole chain, starting with HTTP request
+	CausationID     string // identifier of the event which caused this one
+	Key             []byte
+	Payload         []byte
+}
+
+// NewEvent creates event with given name and payload version, trace identifiers are taken from ctx
+func NewEvent(ctx context.Context, name, version string, payload []byte) *Event {
+	e := &Event{
+		ID:              uuid.NewString(),
+		Name:            name,
+		Version:         version,
+		Producer:        producerName,
+		ProducerVersion: producerVersion,
+		OccurredAt:      time.Now().UTC(),
+		CorrelationID:   CorrelationID(ctx),
+		CausationID:     CausationID(ctx),
+		Payload:         payload,
+	}
+	if e.CorrelationID == "" {
+		// event starts the new chain
+		e.CorrelationID = e.ID
+	}
+	return e
+}
+
+// Message builds Kafka message with envelope headers for topic
+func (e *Event) Message(topic string) *kafka.Message {
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            e.Key,
+		Value:          e.Payload,
+	}
+	AppendKafkaHeader(msg, HeaderEventID, e.ID)
+	AppendKafkaHeader(msg, HeaderEvent, e.Name)
+	AppendKafkaHeader(msg, HeaderEventVersion, e.Version)
+	AppendKafkaHeader(msg, HeaderProducer, e.Producer)
+	AppendKafkaHeader(msg, HeaderProducerVersion, e.ProducerVersion)
+	AppendKafkaHeader(msg, HeaderOccurredAt, e.OccurredAt.Format(time.RFC3339Nano))
+	AppendKafkaHeader(msg, HeaderCorrelationID, e.CorrelationID)
+	if e.CausationID != "" {
+		AppendKafkaHeader(msg, HeaderCausationID, e.CausationID)
+	}
+	return msg
+}
+
+// ParseEvent reads envelope from Kafka message, only event name is required
+func ParseEvent(msg *kafka.Message) (*Event, error) {
+	name, err := GetKafkaHeader(msg, HeaderEvent)
+	if err != nil || name == "" {
+		return nil, errors.New("missing event header")
+	}
+	e := &Event{
+		Name:    name,
+		Key:     msg.Key,
+		Payload: msg.Value,
+	}
+	e.ID, _ = GetKafkaHeader(msg, HeaderEventID)
+	e.Version, _ = GetKafkaHeader(msg, HeaderEventVersion)
+	e.Producer, _ = GetKafkaHeader(msg, HeaderProducer)
+	e.ProducerVersion, _ = GetKafkaHeader(msg, HeaderProducerVersion)
+	e.CorrelationID, _ = GetKafkaHeader(msg, HeaderCorrelationID)
+	e.CausationID, _ = GetKafkaHeader(msg, HeaderCausationID)
+	if v, err := GetKafkaHeader(msg, HeaderOccurredAt); err == nil {
+		e.OccurredAt, _ = time.Parse(time.RFC3339Nano, v)
+	}
+	return e, nil
+}
+
+type traceKey int
+
+const (
+	correlationKey traceKey = iota
+	causationKey
+)
+
+// WithCorrelationID returns context carrying correlation identifier
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey, id)
+}
+
+// WithCause returns context for processing of event e: events produced within it are caused by e
+func WithCause(ctx context.Context, e *Event) context.Context {
+	correlationId := e.CorrelationID
+	if correlationId == "" {
+		correlationId = e.ID
+	}
+	ctx = WithCorrelationID(ctx, correlationId)
+	return context.WithValue(ctx, causationKey, e.ID)
+}
+
+// CorrelationID returns correlation identifier from context, or empty string
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey).(string)
+	return id
+}
+
+// CausationID returns identifier of the event being processed, or empty string
+func CausationID(ctx context.Context) string {
+	id, _ := ctx.Value(causationKey).(string)
+	return id
+}
+
+// CorrelationMiddleware takes correlation identifier from request header or generates new one,
+// puts it into request context and response header
+func CorrelationMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id := c.Request().Header.Get(CorrelationHeader)
+			if id == "" {
+				id = uuid.NewString()
+			}
+			c.Response().Header().Set(CorrelationHeader, id)
+			c.SetRequest(c.Request().WithContext(WithCorrelationID(c.Request().Context(), id)))
+			return next(c)
+		}
+	}
+}
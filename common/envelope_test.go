@@ -0,0 +1,87 @@
+package common
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEventRoundTrip(t *testing.T) {
+	SetProducer("TaskManager", "1.2.0")
+	t.Cleanup(func() {
+		SetProducer("", "")
+	})
+	e := NewEvent(context.Background(), "Task.Created", "v3", []byte("payload"))
+	e.Key = []byte("t1")
+	if e.ID == "" || e.OccurredAt.IsZero() {
+		t.Fatalf("event without id or time: %+v", e)
+	}
+	if e.CorrelationID != e.ID || e.CausationID != "" {
+		t.Errorf("first event of chain has correlation %q and causation %q, want own id and none",
+			e.CorrelationID, e.CausationID)
+	}
+
+	got, err := ParseEvent(e.Message("task.lifecycle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != e.ID || got.Name != e.Name || got.Version != e.Version || got.Producer != "TaskManager" ||
+		got.ProducerVersion != "1.2.0" || !got.OccurredAt.Equal(e.OccurredAt) || got.CorrelationID != e.CorrelationID ||
+		got.CausationID != "" || string(got.Key) != "t1" || string(got.Payload) != "payload" {
+		t.Errorf("parsed event %+v, want %+v", got, e)
+	}
+}
+
+func TestEventCausation(t *testing.T) {
+	first := NewEvent(WithCorrelationID(context.Background(), "request-1"), "Task.Created", "v3", nil)
+	if first.CorrelationID != "request-1" {
+		t.Errorf("correlation of event = %q, want request-1", first.CorrelationID)
+	}
+	next := NewEvent(WithCause(context.Background(), first), "Task.Assigned", "v1", nil)
+	if next.CorrelationID != "request-1" || next.CausationID != first.ID {
+		t.Errorf("caused event has correlation %q and causation %q, want request-1 and %s",
+			next.CorrelationID, next.CausationID, first.ID)
+	}
+	got, err := ParseEvent(next.Message("task.lifecycle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CausationID != first.ID {
+		t.Errorf("parsed causation = %q, want %s", got.CausationID, first.ID)
+	}
+}
+
+func TestParseEventWithoutEnvelope(t *testing.T) {
+	if _, err := ParseEvent(testMessage("", "", "t1")); err == nil {
+		t.Error("message without event header is parsed")
+	}
+}
+
+func TestCorrelationMiddleware(t *testing.T) {
+	e := echo.New()
+	var seen string
+	h := CorrelationMiddleware()(func(c echo.Context) error {
+		seen = CorrelationID(c.Request().Context())
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(CorrelationHeader, "request-1")
+	rec := httptest.NewRecorder()
+	if err := h(e.NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "request-1" || rec.Header().Get(CorrelationHeader) != "request-1" {
+		t.Errorf("correlation %q, response header %q, want request-1", seen, rec.Header().Get(CorrelationHeader))
+	}
+
+	rec = httptest.NewRecorder()
+	if err := h(e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)); err != nil {
+		t.Fatal(err)
+	}
+	if seen == "" || rec.Header().Get(CorrelationHeader) != seen {
+		t.Errorf("generated correlation %q, response header %q", seen, rec.Header().Get(CorrelationHeader))
+	}
+}
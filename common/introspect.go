@@ -0,0 +1,88 @@
+package common
+
+import (
+	"ates/schema"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// IntrospectPath is path of token introspection endpoint of Auth service
+const IntrospectPath = "/oauth/introspect"
+
+// Introspection is answer of token introspection endpoint (RFC 7662), Role is extension of aTES
+type Introspection struct {
+	Active    bool            `json:"active"`
+	Sub       string          `json:"sub,omitempty"`
+	Username  string          `json:"username,omitempty"`
+	Role      schema.UserRole `json:"role,omitempty"`
+	Scope     string          `json:"scope,omitempty"`
+	ClientID  string          `json:"client_id,omitempty"`
+	TokenType string          `json:"token_type,omitempty"`
+	Exp       int64           `json:"exp,omitempty"`
+	Iat       int64           `json:"iat,omitempty"`
+}
+
+// IntrospectionVerifier sends token to introspection endpoint of Auth, authenticating with client credentials
+// of the service, so revoked tokens are refused and role of user is up to date. Every check is a request to Auth,
+// so services use it only where it is needed, see Authenticator.SetIntrospector.
+type IntrospectionVerifier struct {
+	url          string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+}
+
+func NewIntrospectionVerifier(authServer, clientID, clientSecret string, client *http.Client) *IntrospectionVerifier {
+	return &IntrospectionVerifier{
+		url:          EnsureServerProtocol(authServer) + IntrospectPath,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       client,
+	}
+}
+
+func (v *IntrospectionVerifier) Verify(ctx context.Context, token string) (Identity, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(v.clientID), url.QueryEscape(v.clientSecret))
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("introspection failed: %s", resp.Status)
+	}
+
+	var in Introspection
+	err = json.NewDecoder(resp.Body).Decode(&in)
+	if err != nil {
+		return Identity{}, errors.New("bad answer from auth service")
+	}
+	if !in.Active || in.TokenType == "refresh_token" {
+		return Identity{}, errors.New("token is not active")
+	}
+	id := Identity{
+		PublicId: in.Sub,
+		Login:    in.Username,
+		Role:     in.Role,
+		ClientID: in.ClientID,
+		Scope:    in.Scope,
+	}
+	if in.Exp != 0 {
+		id.ExpiresAt = time.Unix(in.Exp, 0)
+	}
+	return id, nil
+}
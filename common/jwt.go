@@ -0,0 +1,182 @@
+package common
+
+import (
+	"ates/schema"
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JWKSPath is path of JWKS endpoint of Auth service
+const JWKSPath = "/.well-known/jwks.json"
+
+// AccessClaims are claims of access token signed by Auth. Subject is uid of user, empty for service account,
+// Audience is OAuth client which got the token.
+type AccessClaims struct {
+	jwt.StandardClaims
+	Role  schema.UserRole `json:"role"`
+	Scope string          `json:"scope,omitempty"` // space-delimited
+}
+
+// JWK is public RSA key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK builds JWK for RS256 signing key
+func NewJWK(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// PublicKey restores RSA public key from JWK
+func (k JWK) PublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// JWTVerifier verifies access tokens locally with public keys of Auth, so services work while Auth is down.
+// Keys are fetched from JWKS endpoint, again when token is signed with unknown key (after rotation).
+// Revoked tokens are valid until they expire. Role in token can be outdated, so identity has no role
+// and local copy of user is authorized.
+type JWTVerifier struct {
+	jwksUrl string
+	client  *http.Client
+
+	mx        sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// minRefetchInterval limits requests to JWKS caused by tokens with unknown kid
+const minRefetchInterval = time.Minute
+
+func NewJWTVerifier(authServer string, client *http.Client) *JWTVerifier {
+	return &JWTVerifier{
+		jwksUrl: EnsureServerProtocol(authServer) + JWKSPath,
+		client:  client,
+		keys:    map[string]*rsa.PublicKey{},
+	}
+}
+
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (Identity, error) {
+	var claims AccessClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid)
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+	id := Identity{
+		PublicId: claims.Subject,
+		ClientID: claims.Audience,
+		Scope:    claims.Scope,
+	}
+	if claims.ExpiresAt != 0 {
+		id.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+	return id, nil
+}
+
+// key returns public key by kid, fetching JWKS if key is unknown
+func (v *JWTVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mx.RLock()
+	key, ok := v.keys[kid]
+	fetchedAt := v.fetchedAt
+	v.mx.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if time.Since(fetchedAt) < minRefetchInterval {
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+
+	err := v.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.mx.RLock()
+	key, ok = v.keys[kid]
+	v.mx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+	return key, nil
+}
+
+// fetch replaces known keys with keys published by Auth
+func (v *JWTVerifier) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+	var set JWKSet
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		key, err := k.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	v.mx.Lock()
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	v.mx.Unlock()
+	return nil
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/golang-jwt/jwt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func signToken(t *testing.T, kid string, key *rsa.PrivateKey, claims AccessClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJWTVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		_ = json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{NewJWK("k1", &key.PublicKey)}})
+	}))
+	defer srv.Close()
+	v := NewJWTVerifier(srv.URL, srv.Client())
+
+	exp := time.Now().Add(time.Hour).Unix()
+	id, err := v.Verify(context.Background(), signToken(t, "k1", key, AccessClaims{
+		StandardClaims: jwt.StandardClaims{Subject: "u1", Audience: "web", ExpiresAt: exp},
+		Role:           2,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.PublicId != "u1" || id.ClientID != "web" || id.Role != 0 || id.ExpiresAt.Unix() != exp {
+		t.Errorf("unexpected identity %+v", id)
+	}
+
+	id, err = v.Verify(context.Background(), signToken(t, "k1", key, AccessClaims{
+		StandardClaims: jwt.StandardClaims{Audience: "payouts", ExpiresAt: exp},
+		Scope:          "accounting:close-day",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.PublicId != "" || id.ClientID != "payouts" || id.Scope != "accounting:close-day" {
+		t.Errorf("unexpected identity of service account %+v", id)
+	}
+
+	_, err = v.Verify(context.Background(), signToken(t, "k1", key, AccessClaims{
+		StandardClaims: jwt.StandardClaims{Subject: "u1", ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+	}))
+	if err == nil {
+		t.Error("expired token is verified")
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v.Verify(context.Background(), signToken(t, "k2", other, AccessClaims{
+		StandardClaims: jwt.StandardClaims{Subject: "u1", ExpiresAt: exp},
+	}))
+	if err == nil {
+		t.Error("token signed with unknown key is verified")
+	}
+	if fetches != 1 {
+		t.Errorf("JWKS fetched %d times, want 1 as refetch is limited", fetches)
+	}
+}
@@ -0,0 +1,236 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// OutboxMessage is a Kafka message saved in the same transaction as the change it describes.
+// OutboxRelay publishes pending messages and marks them sent.
+type OutboxMessage struct {
+	gorm.Model
+	Topic    string
+	Key      []byte
+	Headers  string `gorm:"type:text"` // json-encoded []kafka.Header
+	Value    []byte
+	SentAt   *time.Time `gorm:"index"`
+	FailedAt *time.Time `gorm:"index"` // message can't be restored, it is parked and never sent
+	Error    string     `gorm:"type:text"`
+}
+
+// OutboxLease lets only one relay replica publish at a time, so messages are published in order of outbox
+type OutboxLease struct {
+	Name      string `gorm:"primaryKey;type:varchar(64)"`
+	Owner     string `gorm:"type:varchar(64)"`
+	ExpiresAt time.Time
+}
+
+// StoreInOutbox saves Kafka message to outbox table, tx must be the transaction of the business change
+func StoreInOutbox(tx *gorm.DB, msg *kafka.Message) error {
+	if msg.TopicPartition.Topic == nil {
+		return errors.New("topic of outbox message must be set")
+	}
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+	record := OutboxMessage{
+		Topic:   *msg.TopicPartition.Topic,
+		Key:     msg.Key,
+		Headers: string(headers),
+		Value:   msg.Value,
+	}
+	result := tx.Create(&record)
+	if result.RowsAffected != 1 {
+		return errors.New("failed to store message in outbox")
+	}
+	return nil
+}
+
+// toKafkaMessage restores Kafka message from outbox record
+func (m *OutboxMessage) toKafkaMessage() (*kafka.Message, error) {
+	topic := m.Topic
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            m.Key,
+		Value:          m.Value,
+		Opaque:         m.ID,
+	}
+	if m.Headers != "" {
+		err := json.Unmarshal([]byte(m.Headers), &msg.Headers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// OutboxProducer sends messages to Kafka and reports delivery to deliveryChan, as kafka.Producer does
+type OutboxProducer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+}
+
+// OutboxRelay periodically reads pending outbox messages and publishes them to Kafka,
+// giving at-least-once delivery of events
+type OutboxRelay struct {
+	db              *gorm.DB
+	producer        OutboxProducer
+	logger          *zap.SugaredLogger
+	id              string // owner of lease
+	interval        time.Duration
+	batchSize       int
+	deliveryTimeout time.Duration
+	leaseDuration   time.Duration
+}
+
+func NewOutboxRelay(db *gorm.DB, producer OutboxProducer, logger *zap.SugaredLogger) *OutboxRelay {
+	return &OutboxRelay{
+		db:              db,
+		producer:        producer,
+		logger:          logger,
+		id:              uuid.NewString(),
+		interval:        time.Second,
+		batchSize:       100,
+		deliveryTimeout: 10 * time.Second,
+		leaseDuration:   30 * time.Second,
+	}
+}
+
+// Run publishes pending messages until context is cancelled
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// drain the outbox, then wait for the next tick
+			for {
+				n, err := r.publishPending(ctx)
+				if err != nil {
+					r.logger.Errorf("Failed to publish outbox messages: %s", err.Error())
+					break
+				}
+				if n < r.batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// acquireLease takes or renews the lease of relay, returns false if other replica holds it
+func (r *OutboxRelay) acquireLease(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+	expires := now.Add(r.leaseDuration)
+	result := r.db.WithContext(ctx).Model(&OutboxLease{}).
+		Where("name = ? and (owner = ? or expires_at < ?)", "outbox", r.id, now).
+		Updates(map[string]interface{}{"owner": r.id, "expires_at": expires})
+	if result.Error != nil || result.RowsAffected == 1 {
+		return result.Error == nil, result.Error
+	}
+	result = r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&OutboxLease{Name: "outbox", Owner: r.id, ExpiresAt: expires})
+	return result.RowsAffected == 1, result.Error
+}
+
+// publishPending sends one batch of pending messages, returns number of delivered and parked messages.
+// Only the replica holding the lease publishes, and rows are not locked while delivery is awaited.
+// After a failure the following messages with the same key are not marked sent, they are sent again
+// after the failed one, so consumers end up with the latest state.
+func (r *OutboxRelay) publishPending(ctx context.Context) (int, error) {
+	ok, err := r.acquireLease(ctx)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	var pending []OutboxMessage
+	err = r.db.WithContext(ctx).
+		Where("sent_at is null and failed_at is null").
+		Order("id").
+		Limit(r.batchSize).
+		Find(&pending).Error
+	if err != nil || len(pending) == 0 {
+		return 0, err
+	}
+
+	parked := map[uint]bool{}
+	blocked := map[string]bool{} // keys with failed message in this batch
+	deliveryCh := make(chan kafka.Event, len(pending))
+	produced := 0
+	for _, m := range pending {
+		if m.Key != nil && blocked[string(m.Key)] {
+			continue
+		}
+		msg, err := m.toKafkaMessage()
+		if err != nil {
+			r.logger.Errorf("Failed to restore outbox message#%d, it is parked: %s", m.ID, err.Error())
+			err = r.db.WithContext(ctx).Model(&m).
+				Updates(map[string]interface{}{"failed_at": time.Now().UTC(), "error": err.Error()}).Error
+			if err != nil {
+				return 0, err
+			}
+			parked[m.ID] = true
+			continue
+		}
+		err = r.producer.Produce(msg, deliveryCh)
+		if err != nil {
+			r.logger.Errorf("Failed to produce outbox message#%d: %s", m.ID, err.Error())
+			if m.Key != nil {
+				blocked[string(m.Key)] = true
+			}
+			continue
+		}
+		produced++
+	}
+
+	results := map[uint]bool{} // id -> delivered
+	timeout := time.After(r.deliveryTimeout)
+wait:
+	for len(results) < produced {
+		select {
+		case e := <-deliveryCh:
+			ev, ok := e.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			id := ev.Opaque.(uint)
+			results[id] = ev.TopicPartition.Error == nil
+			if ev.TopicPartition.Error != nil {
+				r.logger.Errorf("Delivery of outbox message#%d failed: %v", id, ev.TopicPartition.Error)
+			}
+		case <-timeout:
+			r.logger.Errorf("Timeout waiting for delivery of outbox messages, %d left", produced-len(results))
+			break wait
+		}
+	}
+
+	// message is sent only if all previous messages with its key in the batch are sent
+	var delivered []uint
+	blocked = map[string]bool{}
+	for _, m := range pending {
+		if parked[m.ID] || m.Key != nil && blocked[string(m.Key)] {
+			continue
+		}
+		if results[m.ID] {
+			delivered = append(delivered, m.ID)
+		} else if m.Key != nil {
+			blocked[string(m.Key)] = true
+		}
+	}
+	if len(delivered) == 0 {
+		return len(parked), nil
+	}
+	err = r.db.WithContext(ctx).Model(&OutboxMessage{}).Where("id in ?", delivered).
+		Update("sent_at", time.Now().UTC()).Error
+	return len(delivered) + len(parked), err
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"ates/common/testutil"
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// fakeProducer reports delivery at once. Messages with values in failProduce are refused by Produce,
+// with values in failDelivery are accepted, but not delivered.
+type fakeProducer struct {
+	failProduce  map[string]bool
+	failDelivery map[string]bool
+	produced     []string // values in order of Produce
+}
+
+func (p *fakeProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	v := string(msg.Value)
+	if p.failProduce[v] {
+		return errors.New("queue is full")
+	}
+	p.produced = append(p.produced, v)
+	report := *msg
+	if p.failDelivery[v] {
+		report.TopicPartition.Error = errors.New("broker is down")
+	}
+	deliveryChan <- &report
+	return nil
+}
+
+func newTestRelay(t *testing.T, producer OutboxProducer) *OutboxRelay {
+	db := testutil.OpenDB(t, &OutboxMessage{}, &OutboxLease{})
+	r := NewOutboxRelay(db, producer, zap.NewNop().Sugar())
+	r.deliveryTimeout = time.Second
+	return r
+}
+
+// storeMessages saves messages with key and value in outbox, empty key is nil
+func storeMessages(t *testing.T, db *gorm.DB, keyValues ...string) {
+	t.Helper()
+	topic := "task.lifecycle"
+	for i := 0; i < len(keyValues); i += 2 {
+		msg := &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic},
+			Value:          []byte(keyValues[i+1]),
+		}
+		if keyValues[i] != "" {
+			msg.Key = []byte(keyValues[i])
+		}
+		if err := StoreInOutbox(db, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sentValues returns values of messages marked sent, in order of outbox
+func sentValues(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	var list []OutboxMessage
+	if err := db.Where("sent_at is not null").Order("id").Find(&list).Error; err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, m := range list {
+		values = append(values, string(m.Value))
+	}
+	return values
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOutboxRelayPartialDelivery(t *testing.T) {
+	p := &fakeProducer{failDelivery: map[string]bool{"a1": true}}
+	r := newTestRelay(t, p)
+	storeMessages(t, r.db, "a", "a1", "b", "b1", "a", "a2", "", "n1")
+
+	n, err := r.publishPending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("publishPending = %d, want 2", n)
+	}
+	// a2 is delivered, but it is not marked sent while a1 is not
+	if got := sentValues(t, r.db); !equalValues(got, []string{"b1", "n1"}) {
+		t.Errorf("sent %v, want [b1 n1]", got)
+	}
+
+	// a1 is delivered on retry, a2 follows it again, so the latest state of "a" comes last
+	p.failDelivery = nil
+	p.produced = nil
+	n, err = r.publishPending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || !equalValues(p.produced, []string{"a1", "a2"}) {
+		t.Errorf("retry published %d messages %v, want [a1 a2]", n, p.produced)
+	}
+	if got := sentValues(t, r.db); !equalValues(got, []string{"a1", "b1", "a2", "n1"}) {
+		t.Errorf("sent %v, want all", got)
+	}
+	if n, _ = r.publishPending(context.Background()); n != 0 {
+		t.Errorf("sent messages are published again")
+	}
+}
+
+func TestOutboxRelayStopsKeyOnProduceFailure(t *testing.T) {
+	p := &fakeProducer{failProduce: map[string]bool{"a1": true}}
+	r := newTestRelay(t, p)
+	storeMessages(t, r.db, "a", "a1", "a", "a2", "b", "b1")
+
+	n, err := r.publishPending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !equalValues(p.produced, []string{"b1"}) {
+		t.Errorf("published %d messages %v, want only b1", n, p.produced)
+	}
+
+	p.failProduce = nil
+	p.produced = nil
+	if _, err = r.publishPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !equalValues(p.produced, []string{"a1", "a2"}) {
+		t.Errorf("retry produced %v, want [a1 a2] in order", p.produced)
+	}
+}
+
+func TestOutboxRelayParksUndecodable(t *testing.T) {
+	p := &fakeProducer{}
+	r := newTestRelay(t, p)
+	storeMessages(t, r.db, "a", "a1", "a", "a2")
+	err := r.db.Model(&OutboxMessage{}).Where("value = ?", []byte("a1")).Update("headers", "not json").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := r.publishPending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// parked message doesn't block its key, it is never sent
+	if n != 2 || !equalValues(p.produced, []string{"a2"}) {
+		t.Errorf("published %d messages %v, want parked a1 and sent a2", n, p.produced)
+	}
+	var parked OutboxMessage
+	if err = r.db.Where("value = ?", []byte("a1")).Find(&parked).Error; err != nil {
+		t.Fatal(err)
+	}
+	if parked.FailedAt == nil || parked.SentAt != nil || parked.Error == "" {
+		t.Errorf("a1 is not parked: %+v", parked)
+	}
+
+	p.produced = nil
+	if n, _ = r.publishPending(context.Background()); n != 0 || len(p.produced) != 0 {
+		t.Errorf("parked message is published again: %v", p.produced)
+	}
+}
+
+func TestOutboxRelayLease(t *testing.T) {
+	p := &fakeProducer{}
+	r := newTestRelay(t, p)
+	storeMessages(t, r.db, "a", "a1")
+
+	other := NewOutboxRelay(r.db, p, zap.NewNop().Sugar())
+	ok, err := other.acquireLease(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("acquireLease = %v, %v", ok, err)
+	}
+	if n, _ := r.publishPending(context.Background()); n != 0 || len(p.produced) != 0 {
+		t.Errorf("relay without lease published %v", p.produced)
+	}
+}
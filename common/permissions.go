@@ -0,0 +1,90 @@
+package common
+
+import (
+	"ates/schema"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// defaultPermissions is permission matrix used when ATES_PERMISSIONS is not set
+//
+//go:embed permissions.json
+var defaultPermissions []byte
+
+// Rule allows action to users with one of roles, and to service accounts granted one of scopes
+type Rule struct {
+	Roles  []schema.UserRole
+	Scopes []string
+}
+
+// Permissions maps named actions, e.g. "task.reassign", to rules. Action missing in matrix is allowed to nobody.
+type Permissions map[string]Rule
+
+// ruleConfig is rule in config file, roles are given by name, see schema.ParseUserRole
+type ruleConfig struct {
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+}
+
+// LoadPermissions reads permission matrix from JSON file, empty path gives the default matrix
+func LoadPermissions(path string) (Permissions, error) {
+	data := defaultPermissions
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ParsePermissions(data)
+}
+
+// ParsePermissions parses permission matrix: {"action": {"roles": ["admin"], "scopes": ["accounting:close-day"]}}
+func ParsePermissions(data []byte) (Permissions, error) {
+	var config map[string]ruleConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("bad permissions: %w", err)
+	}
+
+	perms := Permissions{}
+	for action, rc := range config {
+		rule := Rule{Scopes: rc.Scopes}
+		for _, name := range rc.Roles {
+			role, ok := schema.ParseUserRole(name)
+			if !ok {
+				return nil, fmt.Errorf("bad permissions: unknown role %s of action %s", name, action)
+			}
+			rule.Roles = append(rule.Roles, role)
+		}
+		perms[action] = rule
+	}
+	return perms, nil
+}
+
+// Allows checks that user may do action. Users are checked by role, service accounts by scopes.
+func (p Permissions) Allows(action string, user AuthUser) bool {
+	rule, ok := p[action]
+	if !ok {
+		return false
+	}
+	if user.IsService() {
+		for _, scope := range rule.Scopes {
+			if user.HasScope(scope) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, role := range rule.Roles {
+		if user.Role == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"ates/schema"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParsePermissionsErrors(t *testing.T) {
+	tests := []struct {
+		name, data, err string
+	}{
+		{"unknown role", `{"task.create": {"roles": ["user", "parrot"]}}`, "unknown role parrot"},
+		{"unknown field", `{"task.create": {"roles": ["user"], "users": ["u1"]}}`, "unknown field"},
+		{"not an object", `["task.create"]`, "bad permissions"},
+	}
+	for _, tt := range tests {
+		_, err := ParsePermissions([]byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestPermissionsAllows(t *testing.T) {
+	p, err := ParsePermissions([]byte(`{
+		"task.reassign": {"roles": ["admin", "manager"], "scopes": ["tasks:reassign"]},
+		"task.list": {"roles": ["user"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		action string
+		user   AuthUser
+		want   bool
+	}{
+		{"role", "task.reassign", AuthUser{PublicId: "u1", Role: schema.RoleManager}, true},
+		{"other role", "task.reassign", AuthUser{PublicId: "u1", Role: schema.RoleUser}, false},
+		{"service with scope", "task.reassign", AuthUser{ClientID: "cron", Scopes: []string{"tasks:reassign"}}, true},
+		{"service without scope", "task.reassign", AuthUser{ClientID: "cron", Scopes: []string{"reports"}}, false},
+		{"user token with scope", "task.reassign",
+			AuthUser{PublicId: "u1", Role: schema.RoleUser, ClientID: "web", Scopes: []string{"tasks:reassign"}}, false},
+		{"action without scopes", "task.list", AuthUser{ClientID: "cron", Scopes: []string{"tasks:reassign"}}, false},
+		{"action missing in matrix", "task.delete", AuthUser{PublicId: "u1", Role: schema.RoleAdmin}, false},
+		{"no role", "task.list", AuthUser{PublicId: "u1"}, false},
+	}
+	for _, tt := range tests {
+		if got := p.Allows(tt.action, tt.user); got != tt.want {
+			t.Errorf("%s: Allows(%s) = %v, want %v", tt.name, tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestLoadPermissions(t *testing.T) {
+	p, err := LoadPermissions("")
+	if err != nil {
+		t.Fatalf("shipped permissions.json: %v", err)
+	}
+	// actions used by routes of services
+	for _, action := range []string{"task.create", "task.reassign", "task.list", "task.read", "task.complete",
+		"accounting.log.read", "accounting.balance.read", "accounting.income.read", "day.close", "analytics.read",
+		"dlq.manage", "user.update", "user.manage", "session.own", "session.manage", "client.manage"} {
+		if _, ok := p[action]; !ok {
+			t.Errorf("action %s is missing in permissions.json", action)
+		}
+	}
+	if !p.Allows("day.close", AuthUser{ClientID: "payouts", Scopes: []string{"accounting:close-day"}}) {
+		t.Error("service account with accounting:close-day can't close day")
+	}
+	if p.Allows("analytics.read", AuthUser{PublicId: "u1", Role: schema.RoleUser}) {
+		t.Error("developer can read analytics")
+	}
+
+	path := t.TempDir() + "/permissions.json"
+	err = os.WriteFile(path, []byte(`{"task.list": {"roles": ["chief"]}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = LoadPermissions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != 1 || !p.Allows("task.list", AuthUser{PublicId: "u1", Role: schema.RoleChief}) {
+		t.Errorf("permissions from file = %+v", p)
+	}
+	if _, err = LoadPermissions(path + ".missing"); err == nil {
+		t.Error("missing file is not an error")
+	}
+}
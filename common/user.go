@@ -0,0 +1,107 @@
+package common
+
+import (
+	"ates/schema"
+	"ates/schema/events"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// User is local copy of user in services, synced from User events of Auth
+type User struct {
+	gorm.Model `json:"-"`
+	PublicId   string          `json:"uid"`
+	Login      string          `json:"login"`
+	RoleID     schema.UserRole `json:"roleId"`
+	Active     bool            `gorm:"not null;default:true" json:"active"` // deleted and deactivated users are kept inactive
+}
+
+// UserFromEvent maps User event to local copy of user
+func UserFromEvent(e events.User) User {
+	return User{
+		PublicId: e.Uid,
+		Login:    e.Login,
+		RoleID:   schema.UserRole(e.RoleId),
+		Active:   e.Active,
+	}
+}
+
+// UpsertUser creates local copy of user, or overwrites attributes of existing one
+func UpsertUser(tx *gorm.DB, u *User) (created bool, err error) {
+	var existing User
+	result := tx.Where("public_id = ?", u.PublicId).Limit(1).Find(&existing)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		result = tx.Create(u)
+		if result.RowsAffected != 1 {
+			return false, fmt.Errorf("failed to create user %s", u.PublicId)
+		}
+		if !u.Active {
+			// Create skips zero value and sets default
+			return true, tx.Model(u).Update("active", false).Error
+		}
+		return true, nil
+	}
+	u.ID = existing.ID
+	err = tx.Model(&existing).Updates(map[string]interface{}{
+		"login":   u.Login,
+		"role_id": u.RoleID,
+		"active":  u.Active,
+	}).Error
+	return false, err
+}
+
+// LoadWithPublicId finds local copy of user with public identifier
+func (u *User) LoadWithPublicId(db *gorm.DB, publicId string) error {
+	result := db.Where("public_id = ?", publicId).Limit(1).Find(u)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+	return nil
+}
+
+// NewUserLookup gives UserLookup of service, which keeps copies of users in db. If User.Created hasn't arrived yet,
+// the copy is created from identity introspected by Auth, then onCreate is called in the same transaction,
+// if it is set. Identity from token has no login, ErrUserNotSynced is returned for it. Inactive users are refused,
+// as their tokens are valid until they expire.
+func NewUserLookup(db *gorm.DB, onCreate func(tx *gorm.DB, u *User) error, logger *zap.SugaredLogger) UserLookup {
+	return func(id Identity) (AuthUser, error) {
+		var u User
+		result := db.Limit(1).Find(&u, "public_id = ?", id.PublicId)
+		if result.Error != nil {
+			return AuthUser{}, result.Error
+		}
+		if result.RowsAffected == 0 {
+			if id.Login == "" {
+				return AuthUser{}, ErrUserNotSynced
+			}
+			u = User{PublicId: id.PublicId, Login: id.Login, RoleID: id.Role, Active: true}
+			err := db.Transaction(func(tx *gorm.DB) error {
+				created, err := UpsertUser(tx, &u)
+				if err != nil || !created || onCreate == nil {
+					return err
+				}
+				return onCreate(tx, &u)
+			})
+			if err != nil {
+				return AuthUser{}, err
+			}
+			logger.Infof("Created user %s from introspection", u.PublicId)
+		}
+		if !u.Active {
+			return AuthUser{}, fmt.Errorf("user %s is inactive", u.PublicId)
+		}
+		return AuthUser{
+			ID:       u.ID,
+			PublicId: u.PublicId,
+			Role:     u.RoleID,
+		}, nil
+	}
+}
@@ -1,40 +1,204 @@
 package schema
 
 import (
-	_ "embed"
+	"embed"
+	"encoding/json"
+	"fmt"
 	"github.com/hamba/avro/v2"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-//go:embed avro/user.v1.avsc
-var user []byte
+// files holds all versions of schemas, file name is <record>.v<version>.avsc
+//
+//go:embed avro/*.avsc
+var files embed.FS
 
-//go:embed avro/task.v1.avsc
-var taskV1 []byte
+var fileName = regexp.MustCompile(`^([a-z0-9_]+)\.v([0-9]+)\.avsc$`)
 
-//go:embed avro/task.v2.avsc
-var task []byte
+// versions holds parsed schemas by full record name and version
+var versions = map[string]map[int]avro.Schema{}
 
-//go:embed avro/accountlog.v1.avsc
-var accountLog []byte
+var UserSchema avro.Schema
+var TaskSchema avro.Schema
+var TaskSchemaV1 avro.Schema
+var AccountLog avro.Schema
+var UserSessionSchema avro.Schema
+var UserLockoutSchema avro.Schema
 
-var UserSchema, _ = avro.Parse(string(user))
-var TaskSchema, _ = avro.Parse(string(task))
-var TaskSchemaV1, _ = avro.Parse(string(task))
-var AccountLog, _ = avro.Parse(string(accountLog))
+var loadErr = load()
 
-func Validate() error {
-	var err error
-	UserSchema, err = avro.Parse(string(user))
-	if err != nil {
-		return err
+type schemaFile struct {
+	name    string
+	version int
+	text    string
+	header  schemaHeader
+}
+
+// schemaHeader is the part of schema file, which is read before parsing
+type schemaHeader struct {
+	Namespace  string         `json:"namespace"`
+	Name       string         `json:"name"`
+	References map[string]int `json:"references"` // pinned versions of referenced records, by full name
+}
+
+func (h schemaHeader) fullName() string {
+	if h.Namespace == "" || strings.Contains(h.Name, ".") {
+		return h.Name
 	}
-	TaskSchema, err = avro.Parse(string(task))
+	return h.Namespace + "." + h.Name
+}
+
+// load parses all embedded schemas. Reference to a record resolves to the version pinned in "references"
+// of the file, or to the latest version of the record which is not above the version of the file, so
+// adding a new version of a record doesn't change schemas of existing versions which refer to it.
+func load() error {
+	entries, err := files.ReadDir("avro")
 	if err != nil {
 		return err
 	}
-	AccountLog, err = avro.Parse(string(accountLog))
-	if err != nil {
-		return err
+	var pending []schemaFile
+	available := map[string]map[int]bool{} // versions of records present in files
+	for _, entry := range entries {
+		m := fileName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return fmt.Errorf("bad schema file name %s, expected <record>.v<version>.avsc", entry.Name())
+		}
+		v, _ := strconv.Atoi(m[2])
+		b, err := files.ReadFile(path.Join("avro", entry.Name()))
+		if err != nil {
+			return err
+		}
+		f := schemaFile{name: m[1], version: v, text: string(b)}
+		err = json.Unmarshal(b, &f.header)
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if available[f.header.fullName()] == nil {
+			available[f.header.fullName()] = map[int]bool{}
+		}
+		available[f.header.fullName()][v] = true
+		pending = append(pending, f)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].version != pending[j].version {
+			return pending[i].version < pending[j].version
+		}
+		return pending[i].name < pending[j].name
+	})
+
+	for len(pending) > 0 {
+		var failed []schemaFile
+		var lastErr error
+		for _, f := range pending {
+			// every file gets its own cache with the resolved versions only, so versions of the same record don't mix
+			cache := &avro.SchemaCache{}
+			for name, vs := range available {
+				if name == f.header.fullName() {
+					continue
+				}
+				target, pinned := f.header.References[name]
+				if pinned && !vs[target] {
+					return fmt.Errorf("%s.v%d.avsc: pinned version %d of %s is missing", f.name, f.version, target, name)
+				}
+				if !pinned {
+					for v := range vs {
+						if v <= f.version && v > target {
+							target = v
+						}
+					}
+				}
+				if s := versions[name][target]; s != nil {
+					cache.Add(name, avro.NewRefSchema(s.(avro.NamedSchema)))
+				}
+			}
+			s, err := avro.ParseWithCache(f.text, "", cache)
+			if err != nil {
+				// referenced record can be in a file which is not parsed yet
+				failed = append(failed, f)
+				lastErr = fmt.Errorf("%s.v%d.avsc: %w", f.name, f.version, err)
+				continue
+			}
+			name := Subject(s)
+			if versions[name] == nil {
+				versions[name] = map[int]avro.Schema{}
+			}
+			versions[name][f.version] = s
+		}
+		if len(failed) == len(pending) {
+			return lastErr
+		}
+		pending = failed
+	}
+
+	UserSchema, _ = Latest("ates.User")
+	TaskSchema, _ = Latest("ates.Task")
+	TaskSchemaV1 = Version("ates.Task", 1)
+	AccountLog, _ = Latest("ates.AccountLog")
+	UserSessionSchema, _ = Latest("ates.UserSession")
+	UserLockoutSchema, _ = Latest("ates.UserLockout")
+	return nil
+}
+
+// Validate returns error of parsing embedded schemas
+func Validate() error {
+	if loadErr != nil {
+		return loadErr
+	}
+	for _, s := range []avro.Schema{UserSchema, TaskSchema, TaskSchemaV1, AccountLog, UserSessionSchema, UserLockoutSchema} {
+		if s == nil {
+			return fmt.Errorf("schema is missing in schema/avro")
+		}
 	}
 	return nil
 }
+
+// Version returns schema of record with given full name and version, or nil
+func Version(name string, version int) avro.Schema {
+	return versions[name][version]
+}
+
+// Latest returns the latest version of record schema
+func Latest(name string) (avro.Schema, int) {
+	latest := 0
+	for v := range versions[name] {
+		if v > latest {
+			latest = v
+		}
+	}
+	return versions[name][latest], latest
+}
+
+// Versions returns sorted versions of record schema
+func Versions(name string) []int {
+	var list []int
+	for v := range versions[name] {
+		list = append(list, v)
+	}
+	sort.Ints(list)
+	return list
+}
+
+// Records returns full names of all records with schemas
+func Records() []string {
+	var list []string
+	for name := range versions {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// versionOf finds version of record schema with the same fingerprint as s, 0 if s is unknown
+func versionOf(name string, s avro.Schema) int {
+	fp := s.Fingerprint()
+	for v, known := range versions[name] {
+		if known.Fingerprint() == fp {
+			return v
+		}
+	}
+	return 0
+}
@@ -8,6 +8,29 @@ const (
 	RoleUser
 	RoleManager
 	RoleAccountant
+	RoleChief
+)
+
+// roleNames are names of roles in configs, User is developer
+var roleNames = map[string]UserRole{
+	"admin":      RoleAdmin,
+	"user":       RoleUser,
+	"manager":    RoleManager,
+	"accountant": RoleAccountant,
+	"chief":      RoleChief,
+}
+
+// ParseUserRole returns role by its name in configs
+func ParseUserRole(name string) (UserRole, bool) {
+	role, ok := roleNames[name]
+	return role, ok
+}
+
+// Scopes are permissions of service accounts (OAuth clients with client_credentials grant), they are granted
+// to clients by admin of Auth
+const (
+	ScopeCloseDay      = "accounting:close-day"
+	ScopeReassignTasks = "tasks:reassign"
 )
 
 // TaskStatus copies values from TaskManager.Status
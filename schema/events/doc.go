@@ -0,0 +1,5 @@
+// Package events holds Go types of events generated from schema/avro.
+// Services map them to their own models, models are not sent as is.
+package events
+
+//go:generate go run ../../schemagen -out events_gen.go
@@ -0,0 +1,172 @@
+// Code generated by schemagen from schema/avro. DO NOT EDIT.
+
+package events
+
+import "ates/schema"
+
+// AccountLogV1 is ates.AccountLog of version 1
+type AccountLogV1 struct {
+	LogId          int `avro:"logId" json:"logId"`
+	TaskId         int `avro:"taskId" json:"taskId"`
+	UserId         int `avro:"userId" json:"userId"`
+	BillingCycleId int `avro:"billingCycleId" json:"billingCycleId"`
+	OperationId    int `avro:"operationId" json:"operationId"`
+	Debit          int `avro:"debit" json:"debit"`
+	Credit         int `avro:"credit" json:"credit"`
+	Balance        int `avro:"balance" json:"balance"`
+}
+
+// Marshal encodes AccountLogV1 in Schema Registry wire format
+func (e *AccountLogV1) Marshal() ([]byte, error) {
+	return schema.Marshal(schema.Version("ates.AccountLog", 1), e)
+}
+
+// Unmarshal decodes payload of ates.AccountLog written with compatible version into version 1
+func (e *AccountLogV1) Unmarshal(b []byte) error {
+	return schema.Unmarshal(schema.Version("ates.AccountLog", 1), b, e)
+}
+
+// AccountLog is the latest version of ates.AccountLog
+type AccountLog = AccountLogV1
+
+// TaskV1 is ates.Task of version 1
+type TaskV1 struct {
+	Tid         string `avro:"tid" json:"tid"`
+	Title       string `avro:"title" json:"title"`
+	Description string `avro:"description" json:"description"`
+	StatusId    int    `avro:"statusId" json:"statusId"`
+	AssignedTo  UserV1 `avro:"assignedTo" json:"assignedTo"`
+}
+
+// Marshal encodes TaskV1 in Schema Registry wire format
+func (e *TaskV1) Marshal() ([]byte, error) {
+	return schema.Marshal(schema.Version("ates.Task", 1), e)
+}
+
+// Unmarshal decodes payload of ates.Task written with compatible version into version 1
+func (e *TaskV1) Unmarshal(b []byte) error {
+	return schema.Unmarshal(schema.Version("ates.Task", 1), b, e)
+}
+
+// TaskV2 is ates.Task of version 2
+type TaskV2 struct {
+	Tid         string `avro:"tid" json:"tid"`
+	JiraId      string `avro:"jira_id" json:"jira_id"`
+	Title       string `avro:"title" json:"title"`
+	Description string `avro:"description" json:"description"`
+	StatusId    int    `avro:"statusId" json:"statusId"`
+	AssignedTo  UserV1 `avro:"assignedTo" json:"assignedTo"`
+}
+
+// Marshal encodes TaskV2 in Schema Registry wire format
+func (e *TaskV2) Marshal() ([]byte, error) {
+	return schema.Marshal(schema.Version("ates.Task", 2), e)
+}
+
+// Unmarshal decodes payload of ates.Task written with compatible version into version 2
+func (e *TaskV2) Unmarshal(b []byte) error {
+	return schema.Unmarshal(schema.Version("ates.Task", 2), b, e)
+}
+
+// TaskV3 is ates.Task of version 3
+type TaskV3 struct {
+	Tid         string `avro:"tid" json:"tid"`
+	JiraId      string `avro:"jira_id" json:"jira_id"`
+	Title       string `avro:"title" json:"title"`
+	Description string `avro:"description" json:"description"`
+	StatusId    int    `avro:"statusId" json:"statusId"`
+	AssignedTo  UserV1 `avro:"assignedTo" json:"assignedTo"`
+}
+
+// Marshal encodes TaskV3 in Schema Registry wire format
+func (e *TaskV3) Marshal() ([]byte, error) {
+	return schema.Marshal(schema.Version("ates.Task", 3), e)
+}
+
+// Unmarshal decodes payload of ates.Task written with compatible version into version 3
+func (e *TaskV3) Unmarshal(b []byte) error {
+	return schema.Unmarshal(schema.Version("ates.Task", 3), b, e)
+}
+
+// Task is the latest version of ates.Task
+type Task = TaskV3
+
+// UserV1 is ates.User of version 1
+type UserV1 struct {
+	Uid    string `avro:"uid" json:"uid"`
+	Login  string `avro:"login" json:"login"`
+	RoleId int    `avro:"roleId" json:"roleId"`
+}
+
+// Marshal encodes UserV1 in Schema Registry wire format
+func (e *UserV1) Marshal() ([]byte, error) {
+	return schema.Marshal(schema.Version("ates.User", 1), e)
+}
+
+// Unmarshal decodes payload of ates.User written with compatible version into version 1
+func (e *UserV1) Unmarshal(b []byte) error {
+	return schema.Unmarshal(schema.Version("ates.User", 1), b, e)
+}
+
+// UserV2 is ates.User of version 2
+type UserV2 struct {
+	Uid    string `avro:"uid" json:"uid"`
+	Login  string `avro:"login" json:"login"`
+	RoleId int    `avro:"roleId" json:"roleId"`
+	Active bool   `avro:"active" json:"active"`
+}
+
+// Marshal encodes UserV2 in Schema Registry wire format
+func (e *UserV2) Marshal() ([]byte, error) {
+	return schema.Marshal(schema.Version("ates.User", 2), e)
+}
+
+// Unmarshal decodes payload of ates.User written with compatible version into version 2
+func (e *UserV2) Unmarshal(b []byte) error {
+	return schema.Unmarshal(schema.Version("ates.User", 2), b, e)
+}
+
+// User is the latest version of ates.User
+type User = UserV2
+
+// UserLockoutV1 is ates.UserLockout of version 1
+type UserLockoutV1 struct {
+	Uid         string `avro:"uid" json:"uid"`
+	Failures    int    `avro:"failures" json:"failures"`
+	LockedUntil int64  `avro:"lockedUntil" json:"lockedUntil"`
+	UnlockedBy  string `avro:"unlockedBy" json:"unlockedBy"`
+}
+
+// Marshal encodes UserLockoutV1 in Schema Registry wire format
+func (e *UserLockoutV1) Marshal() ([]byte, error) {
+	return schema.Marshal(schema.Version("ates.UserLockout", 1), e)
+}
+
+// Unmarshal decodes payload of ates.UserLockout written with compatible version into version 1
+func (e *UserLockoutV1) Unmarshal(b []byte) error {
+	return schema.Unmarshal(schema.Version("ates.UserLockout", 1), b, e)
+}
+
+// UserLockout is the latest version of ates.UserLockout
+type UserLockout = UserLockoutV1
+
+// UserSessionV1 is ates.UserSession of version 1
+type UserSessionV1 struct {
+	Uid       string `avro:"uid" json:"uid"`
+	ClientId  string `avro:"clientId" json:"clientId"`
+	SessionId string `avro:"sessionId" json:"sessionId"`
+	Reason    string `avro:"reason" json:"reason"`
+}
+
+// Marshal encodes UserSessionV1 in Schema Registry wire format
+func (e *UserSessionV1) Marshal() ([]byte, error) {
+	return schema.Marshal(schema.Version("ates.UserSession", 1), e)
+}
+
+// Unmarshal decodes payload of ates.UserSession written with compatible version into version 1
+func (e *UserSessionV1) Unmarshal(b []byte) error {
+	return schema.Unmarshal(schema.Version("ates.UserSession", 1), b, e)
+}
+
+// UserSession is the latest version of ates.UserSession
+type UserSession = UserSessionV1
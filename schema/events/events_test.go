@@ -0,0 +1,31 @@
+package events
+
+import (
+	"ates/schema"
+	"testing"
+)
+
+func TestTaskRoundTrip(t *testing.T) {
+	if err := schema.UseRegistry("mock://"); err != nil {
+		t.Fatal(err)
+	}
+	task := Task{
+		Tid:         "t1",
+		JiraId:      "POPUG-1",
+		Title:       "Feed parrots",
+		Description: "Twice a day",
+		StatusId:    int(schema.StatusOpen),
+		AssignedTo:  UserV1{Uid: "u1"},
+	}
+	b, err := task.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Task
+	if err = got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if got != task {
+		t.Errorf("decoded %+v, want %+v", got, task)
+	}
+}
@@ -0,0 +1,227 @@
+package schema
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/v2/schemaregistry"
+	"github.com/hamba/avro/v2"
+	"sync"
+)
+
+// magicByte starts payload in Confluent wire format: magic byte, 4-byte big-endian schema id, Avro binary
+const magicByte = 0
+
+// Registry registers Avro schemas in Schema Registry, subject is the full name of record (e.g. "ates.Task").
+// URL "mock://" gives in-memory stand-in for tests, every Registry has its own: schemas registered
+// with one of them are unknown to the others, even in the same process.
+type Registry struct {
+	client schemaregistry.Client
+	compat *avro.SchemaCompatibility
+
+	mx      sync.RWMutex
+	ids     map[[32]byte]int          // fingerprint of registered schema -> schema id
+	writers map[writerKey]avro.Schema // subject and schema id -> writer schema
+}
+
+// writerKey identifies writer schema. Ids of real registry are unique, but mock client of
+// confluent-kafka-go v2.3.0 gives id 1 to every schema, so schemas of different subjects are told by subject.
+type writerKey struct {
+	subject string
+	id      int
+}
+
+func NewRegistry(url string) (*Registry, error) {
+	client, err := schemaregistry.NewClient(schemaregistry.NewConfig(url))
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{
+		client:  client,
+		compat:  avro.NewSchemaCompatibility(),
+		ids:     map[[32]byte]int{},
+		writers: map[writerKey]avro.Schema{},
+	}, nil
+}
+
+// Subject returns registry subject of schema
+func Subject(s avro.Schema) string {
+	if named, ok := s.(avro.NamedSchema); ok {
+		return named.FullName()
+	}
+	return string(s.Type())
+}
+
+// Register registers schema with references to named types it uses, returns schema id
+func (r *Registry) Register(s avro.Schema) (int, error) {
+	fp := s.Fingerprint()
+	r.mx.RLock()
+	id, ok := r.ids[fp]
+	r.mx.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	info := schemaregistry.SchemaInfo{Schema: s.String()}
+	for _, ref := range references(s) {
+		_, err := r.Register(ref)
+		if err != nil {
+			return 0, err
+		}
+		refInfo := schemaregistry.SchemaInfo{Schema: ref.String()}
+		version, err := r.client.GetVersion(Subject(ref), refInfo, false)
+		if err != nil {
+			return 0, err
+		}
+		info.References = append(info.References, schemaregistry.Reference{
+			Name:    Subject(ref),
+			Subject: Subject(ref),
+			Version: version,
+		})
+	}
+
+	id, err := r.client.Register(Subject(s), info, false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register schema %s: %w", Subject(s), err)
+	}
+
+	r.mx.Lock()
+	r.ids[fp] = id
+	r.writers[writerKey{Subject(s), id}] = s
+	r.mx.Unlock()
+	return id, nil
+}
+
+// references returns named schemas, which are used in record s by reference
+func references(s avro.Schema) []avro.Schema {
+	rec, ok := s.(*avro.RecordSchema)
+	if !ok {
+		return nil
+	}
+	var refs []avro.Schema
+	for _, f := range rec.Fields() {
+		if ref, ok := f.Type().(*avro.RefSchema); ok {
+			refs = append(refs, ref.Schema())
+		}
+	}
+	return refs
+}
+
+// Marshal encodes v with schema s in Confluent wire format
+func (r *Registry) Marshal(s avro.Schema, v any) ([]byte, error) {
+	id, err := r.Register(s)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := avro.Marshal(s, v)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 5, 5+len(payload))
+	b[0] = magicByte
+	binary.BigEndian.PutUint32(b[1:5], uint32(id))
+	return append(b, payload...), nil
+}
+
+// Unmarshal decodes data in Confluent wire format into v: writer schema is resolved by id,
+// and data is read according to reader schema. Data of older known version is converted by upcasters.
+func (r *Registry) Unmarshal(reader avro.Schema, data []byte, v any) error {
+	if len(data) < 5 || data[0] != magicByte {
+		return errors.New("payload is not in schema registry wire format")
+	}
+	id := int(binary.BigEndian.Uint32(data[1:5]))
+
+	name := Subject(reader)
+	writer, err := r.writerSchema(name, id)
+	if err != nil {
+		return err
+	}
+
+	s := reader
+	if writer.Fingerprint() != reader.Fingerprint() {
+		if wv, rv := versionOf(name, writer), versionOf(name, reader); wv > 0 && wv < rv {
+			return upcast(name, wv, rv, data[5:], v)
+		}
+		s, err = r.compat.Resolve(reader, writer)
+		if err != nil {
+			return fmt.Errorf("schema %d can not be read as %s: %w", id, name, err)
+		}
+	}
+	return avro.Unmarshal(s, data[5:], v)
+}
+
+// writerSchema returns schema with given id from cache or from registry
+func (r *Registry) writerSchema(subject string, id int) (avro.Schema, error) {
+	r.mx.RLock()
+	s, ok := r.writers[writerKey{subject, id}]
+	r.mx.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	info, err := r.client.GetBySubjectAndID(subject, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema %d of %s: %w", id, subject, err)
+	}
+	s, err = r.parse(info, &avro.SchemaCache{})
+	if err != nil {
+		return nil, err
+	}
+
+	r.mx.Lock()
+	r.writers[writerKey{subject, id}] = s
+	r.mx.Unlock()
+	return s, nil
+}
+
+// parse parses schema text after all its references, in separate cache to not mix with local schemas
+func (r *Registry) parse(info schemaregistry.SchemaInfo, cache *avro.SchemaCache) (avro.Schema, error) {
+	for _, ref := range info.References {
+		meta, err := r.client.GetSchemaMetadata(ref.Subject, ref.Version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get referenced schema %s: %w", ref.Subject, err)
+		}
+		_, err = r.parse(meta.SchemaInfo, cache)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return avro.ParseWithCache(info.Schema, "", cache)
+}
+
+var defaultRegistry *Registry
+
+// UseRegistry connects to Schema Registry, which is used by Marshal and Unmarshal
+func UseRegistry(url string) error {
+	r, err := NewRegistry(url)
+	if err != nil {
+		return err
+	}
+	defaultRegistry = r
+	return nil
+}
+
+// Register registers schema in registry set by UseRegistry
+func Register(s avro.Schema) error {
+	if defaultRegistry == nil {
+		return errors.New("schema registry is not configured")
+	}
+	_, err := defaultRegistry.Register(s)
+	return err
+}
+
+// Marshal encodes v with schema s in Confluent wire format, using registry set by UseRegistry
+func Marshal(s avro.Schema, v any) ([]byte, error) {
+	if defaultRegistry == nil {
+		return nil, errors.New("schema registry is not configured")
+	}
+	return defaultRegistry.Marshal(s, v)
+}
+
+// Unmarshal decodes data in Confluent wire format with reader schema, using registry set by UseRegistry
+func Unmarshal(reader avro.Schema, data []byte, v any) error {
+	if defaultRegistry == nil {
+		return errors.New("schema registry is not configured")
+	}
+	return defaultRegistry.Unmarshal(reader, data, v)
+}
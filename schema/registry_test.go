@@ -0,0 +1,85 @@
+package schema
+
+import (
+	"github.com/hamba/avro/v2"
+	"testing"
+)
+
+type testUser struct {
+	Uid    string `avro:"uid"`
+	Login  string `avro:"login"`
+	RoleId int    `avro:"roleId"`
+}
+
+type testTask struct {
+	Tid         string   `avro:"tid"`
+	JiraId      string   `avro:"jira_id"`
+	Title       string   `avro:"title"`
+	Description string   `avro:"description"`
+	StatusId    int      `avro:"statusId"`
+	AssignedTo  testUser `avro:"assignedTo"`
+}
+
+func TestRegistryRoundTrip(t *testing.T) {
+	r, err := NewRegistry("mock://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := testTask{
+		Tid:        "3f1c6c4e-8f5e-4f57-9a52-0c5a3c8b9d10",
+		JiraId:     "[J-1]",
+		Title:      "hello",
+		StatusId:   int(StatusOpen),
+		AssignedTo: testUser{Uid: "u1", Login: "popug", RoleId: int(RoleUser)},
+	}
+	b, err := r.Marshal(TaskSchema, &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// forget registered schemas, so writer schema and its reference to User are fetched from registry
+	r.writers = map[writerKey]avro.Schema{}
+	var out testTask
+	err = r.Unmarshal(TaskSchema, b, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+
+	other, err := NewRegistry("mock://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Unmarshal(TaskSchema, b, &out) == nil {
+		t.Error("schema id is known to other mock registry")
+	}
+}
+
+func TestRegistryKeepsSchemasOfSubjects(t *testing.T) {
+	r, err := NewRegistry("mock://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := testUser{Uid: "u1", Login: "popug", RoleId: int(RoleUser)}
+	task := testTask{Tid: "t1", Title: "hello", AssignedTo: user}
+	ub, err := r.Marshal(UserSchema, &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := r.Marshal(TaskSchema, &task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// payload of the first subject is read after schema of another one is registered
+	var gotUser testUser
+	if err = r.Unmarshal(UserSchema, ub, &gotUser); err != nil || gotUser != user {
+		t.Errorf("user = %+v, %v, want %+v", gotUser, err, user)
+	}
+	var gotTask testTask
+	if err = r.Unmarshal(TaskSchema, tb, &gotTask); err != nil || gotTask != task {
+		t.Errorf("task = %+v, %v, want %+v", gotTask, err, task)
+	}
+}
@@ -0,0 +1,99 @@
+package schema
+
+import (
+	"fmt"
+	"github.com/hamba/avro/v2"
+	"strings"
+)
+
+// Upcaster converts record decoded with schema of some version into shape of the next version
+type Upcaster func(record map[string]any) (map[string]any, error)
+
+// upcasters by full record name and version they convert from
+var upcasters = map[string]map[int]Upcaster{}
+
+// RegisterUpcaster registers conversion of record from version to version+1.
+// Versions without upcaster are converted by Avro schema resolution, so new fields must have defaults.
+func RegisterUpcaster(name string, from int, u Upcaster) {
+	if upcasters[name] == nil {
+		upcasters[name] = map[int]Upcaster{}
+	}
+	upcasters[name][from] = u
+}
+
+// HasUpcaster checks if record is converted from version to version+1 by upcaster, not by Avro schema resolution
+func HasUpcaster(name string, from int) bool {
+	_, ok := upcasters[name][from]
+	return ok
+}
+
+func init() {
+	RegisterUpcaster("ates.Task", 1, taskV1toV2)
+}
+
+// SplitJiraTitle splits title "[JIRA-1] title" into jira id "[JIRA-1]" and title
+func SplitJiraTitle(t string) (jiraId string, title string) {
+	title = t
+	if strings.HasPrefix(t, "[") {
+		brPos := strings.Index(t, "]")
+		if brPos != -1 {
+			jiraId = t[0 : brPos+1]
+			title = strings.TrimPrefix(t[brPos+1:], " ")
+		}
+	}
+	return
+}
+
+// taskV1toV2 moves jira id from title to jira_id, the same way as TaskManager migrates its tasks
+func taskV1toV2(record map[string]any) (map[string]any, error) {
+	title, ok := record["title"].(string)
+	if !ok {
+		return nil, fmt.Errorf("title of Task v1 is missing")
+	}
+	record["jira_id"], record["title"] = SplitJiraTitle(title)
+	return record, nil
+}
+
+// upcast decodes data written with version writer of record and converts it step by step into version reader
+func upcast(name string, writer, reader int, data []byte, v any) error {
+	var record map[string]any
+	err := avro.Unmarshal(Version(name, writer), data, &record)
+	if err != nil {
+		return err
+	}
+
+	for ver := writer; ver < reader; ver++ {
+		if u, ok := upcasters[name][ver]; ok {
+			record, err = u(record)
+		} else {
+			record, err = resolveRecord(Version(name, ver), Version(name, ver+1), record)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to upcast %s from v%d to v%d: %w", name, ver, ver+1, err)
+		}
+	}
+
+	b, err := avro.Marshal(Version(name, reader), record)
+	if err != nil {
+		return err
+	}
+	return avro.Unmarshal(Version(name, reader), b, v)
+}
+
+// resolveRecord converts record from schema from into schema to with Avro schema resolution
+func resolveRecord(from, to avro.Schema, record map[string]any) (map[string]any, error) {
+	if from == nil || to == nil {
+		return nil, fmt.Errorf("schema version is missing")
+	}
+	b, err := avro.Marshal(from, record)
+	if err != nil {
+		return nil, err
+	}
+	s, err := avro.NewSchemaCompatibility().Resolve(to, from)
+	if err != nil {
+		return nil, err
+	}
+	var next map[string]any
+	err = avro.Unmarshal(s, b, &next)
+	return next, err
+}
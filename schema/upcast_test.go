@@ -0,0 +1,54 @@
+package schema_test
+
+import (
+	"ates/schema"
+	"ates/schema/events"
+	"testing"
+
+	"github.com/hamba/avro/v2"
+)
+
+func TestTaskReferencesUserV1(t *testing.T) {
+	userV1 := schema.Version("ates.User", 1)
+	for _, v := range []int{1, 2} {
+		rec := schema.Version("ates.Task", v).(*avro.RecordSchema)
+		for _, f := range rec.Fields() {
+			if f.Name() != "assignedTo" {
+				continue
+			}
+			if f.Type().Fingerprint() != userV1.Fingerprint() {
+				t.Errorf("Task v%d refers to other version of User than v1", v)
+			}
+		}
+	}
+}
+
+func TestUnmarshalTaskV1(t *testing.T) {
+	r, err := schema.NewRegistry("mock://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := events.TaskV1{
+		Tid:         "3f1c6c4e-8f5e-4f57-9a52-0c5a3c8b9d10",
+		Title:       "[J-1] hello",
+		Description: "description",
+		StatusId:    int(schema.StatusOpen),
+		AssignedTo:  events.UserV1{Uid: "u1", Login: "popug", RoleId: int(schema.RoleUser)},
+	}
+	b, err := r.Marshal(schema.Version("ates.Task", 1), &v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var task events.Task
+	err = r.Unmarshal(schema.TaskSchema, b, &task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.JiraId != "[J-1]" || task.Title != "hello" {
+		t.Errorf("jira id is not split from title: jira_id %q, title %q", task.JiraId, task.Title)
+	}
+	if task.Tid != v1.Tid || task.AssignedTo.Uid != "u1" {
+		t.Errorf("task is decoded wrong: %+v", task)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+// schemacheck checks compatibility between consecutive versions of every record in schema/avro.
+// BACKWARD problems of versions converted by upcaster are printed, but don't fail the check.
+// Run it before merging schema changes:
+//
+//	go run ./schemacheck -mode FULL
+
+import (
+	"ates/schema"
+	"flag"
+	"fmt"
+	"github.com/hamba/avro/v2"
+	"os"
+	"strings"
+)
+
+const (
+	Backward = "BACKWARD" // new version reads data written with previous one
+	Forward  = "FORWARD"  // previous version reads data written with new one
+	Full     = "FULL"     // both
+)
+
+func main() {
+	mode := flag.String("mode", Full, "compatibility mode: BACKWARD, FORWARD or FULL")
+	flag.Parse()
+
+	*mode = strings.ToUpper(*mode)
+	if *mode != Backward && *mode != Forward && *mode != Full {
+		fmt.Fprintf(os.Stderr, "Unknown compatibility mode %s\n", *mode)
+		os.Exit(2)
+	}
+
+	err := schema.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load schemas: %s\n", err.Error())
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, name := range schema.Records() {
+		versions := schema.Versions(name)
+		for i := 1; i < len(versions); i++ {
+			prev, next := versions[i-1], versions[i]
+			problems := check(*mode, schema.Version(name, prev), schema.Version(name, next))
+			var converted []string
+			if schema.HasUpcaster(name, prev) {
+				// consumers read data of previous version with upcaster, not with Avro schema resolution
+				converted, problems = splitBackward(problems)
+			}
+			if len(problems) == 0 {
+				fmt.Printf("OK   %s v%d -> v%d %s\n", name, prev, next, *mode)
+				for _, p := range converted {
+					fmt.Printf("     %s (converted by upcaster)\n", p)
+				}
+				continue
+			}
+			failed = true
+			fmt.Printf("FAIL %s v%d -> v%d %s\n", name, prev, next, *mode)
+			for _, p := range problems {
+				fmt.Printf("     %s\n", p)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// check returns incompatibilities between previous and next version of record in given mode
+func check(mode string, prev, next avro.Schema) []string {
+	var problems []string
+	if mode == Backward || mode == Full {
+		for _, p := range diff(next, prev) {
+			problems = append(problems, "BACKWARD: "+p)
+		}
+	}
+	if mode == Forward || mode == Full {
+		for _, p := range diff(prev, next) {
+			problems = append(problems, "FORWARD: "+p)
+		}
+	}
+	return problems
+}
+
+// splitBackward separates BACKWARD problems from others
+func splitBackward(problems []string) (backward []string, other []string) {
+	for _, p := range problems {
+		if strings.HasPrefix(p, "BACKWARD: ") {
+			backward = append(backward, p)
+		} else {
+			other = append(other, p)
+		}
+	}
+	return backward, other
+}
+
+// diff returns field-level reasons why reader can not read data written with writer
+func diff(reader, writer avro.Schema) []string {
+	compat := avro.NewSchemaCompatibility()
+	r, rok := reader.(*avro.RecordSchema)
+	w, wok := writer.(*avro.RecordSchema)
+	if !rok || !wok {
+		err := compat.Compatible(reader, writer)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		return nil
+	}
+
+	var problems []string
+	for _, rf := range r.Fields() {
+		wf := writerField(w, rf)
+		if wf == nil {
+			if !rf.HasDefault() {
+				problems = append(problems, fmt.Sprintf("field %q (%s) is missing in writer and has no default",
+					rf.Name(), schema.Subject(rf.Type())))
+			}
+			continue
+		}
+		err := compat.Compatible(rf.Type(), wf.Type())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("field %q can not be read as %s from %s: %s",
+				rf.Name(), schema.Subject(rf.Type()), schema.Subject(wf.Type()), err.Error()))
+		}
+	}
+
+	if len(problems) == 0 {
+		// record level problems, e.g. renamed record
+		err := compat.Compatible(reader, writer)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// writerField finds field of writer record matching reader field by name or alias
+func writerField(w *avro.RecordSchema, rf *avro.Field) *avro.Field {
+	for _, wf := range w.Fields() {
+		if wf.Name() == rf.Name() {
+			return wf
+		}
+		for _, alias := range rf.Aliases() {
+			if wf.Name() == alias {
+				return wf
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"ates/schema"
+	"github.com/hamba/avro/v2"
+	"strings"
+	"testing"
+)
+
+const noteV1 = `{"type": "record", "name": "Note", "namespace": "test", "fields": [
+  {"name": "id", "type": "string"}
+]}`
+
+const noteV2 = `{"type": "record", "name": "Note", "namespace": "test", "fields": [
+  {"name": "id", "type": "string"},
+  {"name": "text", "type": "string"}
+]}`
+
+const noteV2Default = `{"type": "record", "name": "Note", "namespace": "test", "fields": [
+  {"name": "id", "type": "string"},
+  {"name": "text", "type": "string", "default": ""}
+]}`
+
+func TestCheckAddedFieldWithoutDefault(t *testing.T) {
+	prev := avro.MustParse(noteV1)
+	next := avro.MustParse(noteV2)
+
+	problems := check(Full, prev, next)
+	if len(problems) != 1 {
+		t.Fatalf("got problems %v, want one", problems)
+	}
+	want := `BACKWARD: field "text" (string) is missing in writer and has no default`
+	if problems[0] != want {
+		t.Errorf("got %q, want %q", problems[0], want)
+	}
+	// previous version ignores the new field
+	if problems = check(Forward, prev, next); len(problems) != 0 {
+		t.Errorf("FORWARD problems %v, want none", problems)
+	}
+	if problems = check(Full, prev, avro.MustParse(noteV2Default)); len(problems) != 0 {
+		t.Errorf("problems of added field with default %v, want none", problems)
+	}
+	// removed field without default can't be read by previous version
+	problems = check(Full, next, prev)
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], `FORWARD: field "text"`) {
+		t.Errorf("got problems %v of removed field, want FORWARD one", problems)
+	}
+}
+
+func TestCheckTaskVersions(t *testing.T) {
+	if err := schema.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	v1, v2, v3 := schema.Version("ates.Task", 1), schema.Version("ates.Task", 2), schema.Version("ates.Task", 3)
+
+	// jira_id is added in v2 without default, the upcaster converts data of v1
+	problems := check(Full, v1, v2)
+	if len(problems) != 1 || !strings.Contains(problems[0], `field "jira_id"`) {
+		t.Errorf("Task v1 -> v2 problems %v, want missing jira_id", problems)
+	}
+	if !schema.HasUpcaster("ates.Task", 1) {
+		t.Error("Task v1 has no upcaster")
+	}
+	if problems = check(Full, v2, v3); len(problems) != 0 {
+		t.Errorf("Task v2 -> v3 problems %v, want none", problems)
+	}
+}
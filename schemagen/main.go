@@ -0,0 +1,165 @@
+package main
+
+// schemagen generates Go event types for every version of every record in schema/avro:
+//
+//	go run ./schemagen -out schema/events/events_gen.go
+//
+// Record ates.Task of version 2 gives type TaskV2, and alias Task points to the latest version.
+
+import (
+	"ates/schema"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/hamba/avro/v2"
+	"go/format"
+	"os"
+	"strings"
+	"unicode"
+)
+
+func main() {
+	out := flag.String("out", "schema/events/events_gen.go", "output file")
+	pkg := flag.String("package", "events", "package name of generated file")
+	flag.Parse()
+
+	err := schema.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load schemas: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	src, err := generate(*pkg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate event types: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	err = os.WriteFile(*out, src, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s: %s\n", *out, err.Error())
+		os.Exit(1)
+	}
+}
+
+func generate(pkg string) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by schemagen from schema/avro. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	fmt.Fprintf(&b, "import \"ates/schema\"\n\n")
+
+	for _, name := range schema.Records() {
+		versions := schema.Versions(name)
+		for _, v := range versions {
+			err := generateRecord(&b, name, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		latest := versions[len(versions)-1]
+		fmt.Fprintf(&b, "// %s is the latest version of %s\n", shortName(name), name)
+		fmt.Fprintf(&b, "type %s = %s\n\n", shortName(name), typeName(name, latest))
+	}
+
+	return format.Source(b.Bytes())
+}
+
+func generateRecord(b *bytes.Buffer, name string, version int) error {
+	rec, ok := schema.Version(name, version).(*avro.RecordSchema)
+	if !ok {
+		return fmt.Errorf("%s is not a record", name)
+	}
+	typ := typeName(name, version)
+
+	fmt.Fprintf(b, "// %s is %s of version %d\n", typ, name, version)
+	fmt.Fprintf(b, "type %s struct {\n", typ)
+	for _, f := range rec.Fields() {
+		goType, err := fieldType(f.Type())
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", name, f.Name(), err)
+		}
+		fmt.Fprintf(b, "\t%s %s `avro:\"%s\" json:\"%s\"`\n", fieldName(f.Name()), goType, f.Name(), f.Name())
+	}
+	fmt.Fprintf(b, "}\n\n")
+
+	fmt.Fprintf(b, "// Marshal encodes %s in Schema Registry wire format\n", typ)
+	fmt.Fprintf(b, "func (e *%s) Marshal() ([]byte, error) {\n", typ)
+	fmt.Fprintf(b, "\treturn schema.Marshal(schema.Version(%q, %d), e)\n}\n\n", name, version)
+
+	fmt.Fprintf(b, "// Unmarshal decodes payload of %s written with compatible version into version %d\n", name, version)
+	fmt.Fprintf(b, "func (e *%s) Unmarshal(b []byte) error {\n", typ)
+	fmt.Fprintf(b, "\treturn schema.Unmarshal(schema.Version(%q, %d), b, e)\n}\n\n", name, version)
+	return nil
+}
+
+// fieldType returns Go type for Avro type of field
+func fieldType(s avro.Schema) (string, error) {
+	switch s.Type() {
+	case avro.String:
+		return "string", nil
+	case avro.Int:
+		return "int", nil
+	case avro.Long:
+		return "int64", nil
+	case avro.Boolean:
+		return "bool", nil
+	case avro.Float:
+		return "float32", nil
+	case avro.Double:
+		return "float64", nil
+	case avro.Bytes:
+		return "[]byte", nil
+	case avro.Array:
+		t, err := fieldType(s.(*avro.ArraySchema).Items())
+		return "[]" + t, err
+	case avro.Union:
+		u := s.(*avro.UnionSchema)
+		if !u.Nullable() {
+			return "", fmt.Errorf("only unions of null and one type are supported")
+		}
+		for _, t := range u.Types() {
+			if t.Type() != avro.Null {
+				t, err := fieldType(t)
+				return "*" + t, err
+			}
+		}
+	case avro.Ref:
+		return fieldType(s.(*avro.RefSchema).Schema())
+	case avro.Record:
+		// reference to another record, find its version
+		name := schema.Subject(s)
+		for _, v := range schema.Versions(name) {
+			if schema.Version(name, v).Fingerprint() == s.Fingerprint() {
+				return typeName(name, v), nil
+			}
+		}
+		return "", fmt.Errorf("unknown version of %s", name)
+	}
+	return "", fmt.Errorf("type %s is not supported", s.Type())
+}
+
+func shortName(fullName string) string {
+	return fullName[strings.LastIndex(fullName, ".")+1:]
+}
+
+func typeName(name string, version int) string {
+	return fmt.Sprintf("%sV%d", shortName(name), version)
+}
+
+// fieldName converts Avro field name to exported Go name: jira_id -> JiraId, statusId -> StatusId
+func fieldName(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"ates/schema"
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestGeneratedTypesAreUpToDate(t *testing.T) {
+	if err := schema.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := os.ReadFile("../schema/events/events_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, committed) {
+		t.Error("schema/events/events_gen.go is stale, run go generate ./schema/events")
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	tests := []struct {
+		avro, goName string
+	}{
+		{"jira_id", "JiraId"},
+		{"statusId", "StatusId"},
+		{"uid", "Uid"},
+		{"a__b_", "AB"},
+	}
+	for _, tt := range tests {
+		if got := fieldName(tt.avro); got != tt.goName {
+			t.Errorf("fieldName(%q) = %q, want %q", tt.avro, got, tt.goName)
+		}
+	}
+}
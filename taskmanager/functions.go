@@ -1,18 +1,19 @@
 package main
 
 import (
+	"ates/common"
 	"ates/schema"
+	"ates/schema/events"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"gorm.io/gorm"
 	"io"
-	"net/http"
 )
 
-// recordTaskLog adds log record to database
-func (svc *tmSvc) recordTaskLog(task *Task, message string) error {
+// recordTaskLog adds log record to database within transaction tx
+func (svc *tmSvc) recordTaskLog(tx *gorm.DB, task *Task, message string) error {
 	record := TaskLog{
 		Model:        gorm.Model{},
 		AssignedToId: task.AssignedToID,
@@ -20,75 +21,39 @@ func (svc *tmSvc) recordTaskLog(task *Task, message string) error {
 		StatusId:     task.StatusID,
 		Message:      message,
 	}
-	result := svc.tmDb.Create(&record)
+	result := tx.Create(&record)
 	if result.RowsAffected != 1 {
 		return errors.New("failed to created TaskLog record")
 	}
 	return nil
 }
 
-// checkAuth checks if current request contain authorization header, sends request to Auth service to check token,
-// and ensures if user has one of the following roles
-func (svc *tmSvc) checkAuth(c echo.Context, availableFor []schema.UserRole) (bool, uint) {
-	var authHeader string
-	if c.Request().Header["Authorization"] != nil {
-		authHeader = c.Request().Header["Authorization"][0]
-	}
-	if authHeader == "" {
-		return false, 0
-	}
-	sub, err := svc.verifyAuth(authHeader)
+// saveUser creates User basing on Avro payload, or overwrites existing one
+func (svc *tmSvc) saveUser(tx *gorm.DB, avroPayload []byte) error {
+	var ue events.User
+	err := ue.Unmarshal(avroPayload)
 	if err != nil {
-		svc.logger.Infof("Auth failed: %s", err)
-		return false, 0
+		return fmt.Errorf("bad payload: %w", err)
 	}
-	return svc.checkUserRole(sub, availableFor)
-}
+	u := common.UserFromEvent(ue)
 
-// verifyAuth sends request to Auth service to check token, returns public identifier of authenticated user
-func (svc *tmSvc) verifyAuth(authz string) (string, error) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/verify", svc.authServer), nil)
+	created, err := common.UpsertUser(tx, &u)
 	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Authorization", authz)
-	resp, err := svc.authHttpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return "", errors.New("authentication failed")
+		return err
 	}
-	body, _ := io.ReadAll(resp.Body)
-	_ = resp.Body.Close()
-	var ver AuthVerification
-	err = json.Unmarshal(body, &ver)
-	if err != nil || ver.PublicId == "" {
-		return "", errors.New("bad answer from auth service")
+	if created {
+		svc.logger.Infof("Created user %s", u.PublicId)
+	} else {
+		svc.logger.Infof("Updated user %s", u.PublicId)
 	}
-	return ver.PublicId, nil
-}
-
-// checkUserRole checks if user with given public identifier belongs to one of the following roles
-func (svc *tmSvc) checkUserRole(publicId string, availableFor []schema.UserRole) (bool, uint) {
-	// could be cached in memory, with invalidation on notification
-	var userFromDb User
-	result := svc.tmDb.First(&userFromDb, "public_id = ?", publicId)
-	if result.RowsAffected == 1 {
-		for _, availableRoleId := range availableFor {
-			if userFromDb.RoleID == availableRoleId {
-				return true, userFromDb.ID
-			}
-		}
-	}
-	return false, 0
+	return nil
 }
 
 // getUserIds return identifiers of all users with Role=User
 func (svc *tmSvc) getUserIds() []uint {
 	// could be cached in memory, with invalidation on notification
 	var users []User
-	svc.tmDb.Where("role_id = ?", schema.RoleUser).Find(&users)
+	svc.tmDb.Where("role_id = ? and active = ?", schema.RoleUser, true).Find(&users)
 	result := make([]uint, len(users))
 	for i, u := range users {
 		result[i] = u.ID
@@ -11,16 +11,9 @@ import (
 	"net/http"
 )
 
-func forbidden(c echo.Context) error {
-	return c.JSON(http.StatusForbidden, common.FromKeysAndValues("error", "forbidden"))
-}
-
 // newTask creates new task, and assigns it to random user
 func (svc *tmSvc) newTask(c echo.Context) error {
-	userIsAllowed, userId := svc.checkAuth(c, []schema.UserRole{schema.RoleAdmin, schema.RoleUser, schema.RoleAccountant, schema.RoleManager})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
+	userId := common.CurrentUser(c).ID
 
 	task, err := getTaskFromRequest(c)
 	if err != nil {
@@ -41,16 +34,19 @@ func (svc *tmSvc) newTask(c echo.Context) error {
 	}
 
 	err = svc.tmDb.Transaction(func(tx *gorm.DB) error {
-		result := svc.tmDb.Create(&task)
+		result := tx.Create(&task)
 		if result.RowsAffected != 1 {
 			return errors.New("failed to create task on db request")
 		}
-		return svc.recordTaskLog(&task, fmt.Sprintf("created by user#%d", task.AuthorID))
+		err := svc.recordTaskLog(tx, &task, fmt.Sprintf("created by user#%d", task.AuthorID))
+		if err != nil {
+			return err
+		}
+		return svc.notify(c.Request().Context(), tx, "Task.Created", task)
 	})
 
 	if err == nil {
 		svc.logger.Infof("New task created by user#%d", userId)
-		go svc.notifyAsync("Task.Created", task)
 		return c.JSON(http.StatusOK, common.FromKeysAndValues("result", "task created"))
 	}
 
@@ -61,10 +57,7 @@ func (svc *tmSvc) newTask(c echo.Context) error {
 
 // getOpenTasks renders tasks of current user with status=Open
 func (svc *tmSvc) getOpenTasks(c echo.Context) error {
-	userIsAllowed, userId := svc.checkAuth(c, []schema.UserRole{schema.RoleUser})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
+	userId := common.CurrentUser(c).ID
 
 	var tasks []Task
 	svc.tmDb.
@@ -77,10 +70,7 @@ func (svc *tmSvc) getOpenTasks(c echo.Context) error {
 
 // getTask renders task of current user with additional information by id
 func (svc *tmSvc) getTask(c echo.Context) error {
-	userIsAllowed, userId := svc.checkAuth(c, []schema.UserRole{schema.RoleUser})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
+	userId := common.CurrentUser(c).ID
 
 	tid := c.Param("tid")
 	if !common.IsUUID(tid) {
@@ -101,10 +91,7 @@ func (svc *tmSvc) getTask(c echo.Context) error {
 
 // completeTask sets task status to Complete
 func (svc *tmSvc) completeTask(c echo.Context) error {
-	userIsAllowed, userId := svc.checkAuth(c, []schema.UserRole{schema.RoleUser})
-	if !userIsAllowed {
-		return forbidden(c)
-	}
+	userId := common.CurrentUser(c).ID
 
 	tid := c.Param("tid")
 	if !common.IsUUID(tid) {
@@ -123,16 +110,19 @@ func (svc *tmSvc) completeTask(c echo.Context) error {
 
 	err := svc.tmDb.Transaction(func(tx *gorm.DB) error {
 		task.StatusID = schema.StatusCompleted
-		result = svc.tmDb.Save(&task)
+		result = tx.Save(&task)
 		if result.RowsAffected != 1 {
 			return errors.New("failed to complete task")
 		}
-		return svc.recordTaskLog(&task, "completed")
+		err := svc.recordTaskLog(tx, &task, "completed")
+		if err != nil {
+			return err
+		}
+		return svc.notify(c.Request().Context(), tx, "Task.Completed", task)
 	})
 
 	if err == nil {
 		svc.logger.Infof("task %s is set completed", tid)
-		go svc.notifyAsync("Task.Completed", task)
 		return c.JSON(http.StatusOK, common.FromKeysAndValues("result", "task completed"))
 	}
 
@@ -143,9 +133,10 @@ func (svc *tmSvc) completeTask(c echo.Context) error {
 
 // reassignTasks reassign all tasks with status=Open to users
 func (svc *tmSvc) reassignTasks(c echo.Context) error {
-	userIsAllowed, userId := svc.checkAuth(c, []schema.UserRole{schema.RoleManager, schema.RoleAdmin})
-	if !userIsAllowed {
-		return forbidden(c)
+	me := common.CurrentUser(c)
+	by := fmt.Sprintf("user#%d", me.ID)
+	if me.IsService() {
+		by = "client " + me.ClientID
 	}
 
 	var tasks []Task
@@ -162,11 +153,15 @@ func (svc *tmSvc) reassignTasks(c echo.Context) error {
 	err := svc.tmDb.Transaction(func(tx *gorm.DB) error {
 		for _, task := range tasks {
 			task.AssignedToID = allUsers[rand.Intn(len(allUsers))] // random user
-			result := svc.tmDb.Save(&task)
+			result := tx.Save(&task)
 			if result.RowsAffected != 1 {
 				return errors.New(fmt.Sprintf("failed to reassign task %s", task.PublicId))
 			}
-			err := svc.recordTaskLog(&task, fmt.Sprintf("reassigned by user#%d", userId))
+			err := svc.recordTaskLog(tx, &task, "reassigned by "+by)
+			if err != nil {
+				return err
+			}
+			err = svc.notify(c.Request().Context(), tx, "Task.Reassigned", task)
 			if err != nil {
 				return err
 			}
@@ -176,11 +171,6 @@ func (svc *tmSvc) reassignTasks(c echo.Context) error {
 
 	if err == nil {
 		svc.logger.Infof("%d task are reassigned", len(tasks))
-		// do we need to limit number of goroutines here?
-		for _, task := range tasks {
-			go svc.notifyAsync("Task.Reassigned", task)
-		}
-
 		return c.JSON(http.StatusOK, common.FromKeysAndValues("result", "tasks reassigned"))
 	}
 
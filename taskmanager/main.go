@@ -3,28 +3,35 @@ package main
 import (
 	"ates/common"
 	"ates/schema"
+	"context"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/hamba/avro/v2"
 	"github.com/labstack/echo/v4/middleware"
 	"go.uber.org/zap"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type tmSvc struct {
-	logger         *zap.SugaredLogger
-	tmDb           *gorm.DB
-	authServer     string
-	authHttpClient *http.Client
-	kafkaProducer  *kafka.Producer
-	kafkaConsumer  *kafka.Consumer
+	logger        *zap.SugaredLogger
+	tmDb          *gorm.DB
+	kafkaProducer *kafka.Producer
+	eventConsumer *common.EventConsumer
 }
 
+// version is set on build with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	zapLogger := zap.New(common.GetZapCore(true))
 	logger := zapLogger.Sugar()
 	logger.Info("Starting aTES.TaskManager service")
+	common.SetProducer("TaskManager", version)
 
 	webAddress := os.Getenv("ATES_TM_SERVER")
 	if webAddress == "" {
@@ -46,7 +53,24 @@ func main() {
 		os.Exit(-1)
 	}
 
-	kafkaProducer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": "localhost"})
+	// service is OAuth client of Auth, it introspects access tokens when local verification is not enough
+	clientID := os.Getenv("ATES_TM_CLIENT_ID")
+	clientSecret := os.Getenv("ATES_TM_CLIENT_SECRET")
+	if clientID == "" || clientSecret == "" {
+		logger.Fatalf("Missing client credentials in ATES_TM_CLIENT_ID and ATES_TM_CLIENT_SECRET env")
+		os.Exit(-1)
+	}
+
+	schemaRegistryUrl := os.Getenv("ATES_SCHEMA_REGISTRY")
+	if schemaRegistryUrl == "" {
+		logger.Fatalf("Missing schema registry url in ATES_SCHEMA_REGISTRY env, use mock:// for in-process registry")
+		os.Exit(-1)
+	}
+
+	kafkaProducer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers":  "localhost",
+		"enable.idempotence": true, // keeps order of events with the same key on retries
+	})
 	if err != nil {
 		logger.Fatalf("Failed to initialize Kafka Producer")
 		os.Exit(-1)
@@ -66,21 +90,16 @@ func main() {
 	}()
 
 	kafkaConsumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": "localhost",
-		"group.id":          "TaskManager",
-		"auto.offset.reset": "earliest",
+		"bootstrap.servers":  "localhost",
+		"group.id":           "TaskManager",
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": false,
 	})
 	if err != nil {
 		logger.Fatalf("Failed to initialize Kafka Consumer")
 		os.Exit(-1)
 	}
 
-	err = kafkaConsumer.SubscribeTopics([]string{"user.lifecycle"}, nil)
-	if err != nil {
-		logger.Fatalf("Failed to subscribe to necessary Kafka topic")
-		os.Exit(-1)
-	}
-
 	e := common.GetNewEcho(logger)
 	e.Use(middleware.Recover())
 
@@ -91,7 +110,7 @@ func main() {
 	}
 
 	// Ensure tables and model
-	_ = db.AutoMigrate(&User{}, &Task{}, &Status{}, &TaskLog{})
+	_ = db.AutoMigrate(&User{}, &Task{}, &Status{}, &TaskLog{}, &common.OutboxMessage{}, &common.OutboxLease{}, &common.DeadLetter{}, &common.ProcessedEvent{})
 	//createDefaultStatuses(db)
 	migrateTasksV1toV2(db)
 
@@ -101,29 +120,78 @@ func main() {
 		os.Exit(-1)
 	}
 
+	err = schema.UseRegistry(schemaRegistryUrl)
+	if err != nil {
+		logger.Fatalf("Failed to connect to schema registry: %s", err.Error())
+		os.Exit(-1)
+	}
+	// producer registers its schemas at start, so incompatible change fails before any event is sent
+	for _, s := range []avro.Schema{schema.TaskSchema} {
+		err = schema.Register(s)
+		if err != nil {
+			logger.Fatalf("Failed to register avro schema: %s", err.Error())
+			os.Exit(-1)
+		}
+	}
+
 	app := tmSvc{
-		logger:     logger,
-		tmDb:       db,
-		authServer: common.EnsureServerProtocol(authServer),
-		authHttpClient: &http.Client{
-			Transport: &http.Transport{
-				//TLSClientConfig: tlsConfig,
-			},
-		},
+		logger:        logger,
+		tmDb:          db,
 		kafkaProducer: kafkaProducer,
-		kafkaConsumer: kafkaConsumer,
+		eventConsumer: common.NewEventConsumer("TaskManager", kafkaConsumer, db, logger),
 	}
+	app.registerEventHandlers(app.eventConsumer)
 
-	e.POST("/tasks/new", app.newTask)
-	e.POST("/tasks/reassign", app.reassignTasks)
-	e.GET("/tasks/list", app.getOpenTasks)
-	e.GET("/tasks/:tid", app.getTask)                // tid is UUID
-	e.POST("/tasks/:tid/complete", app.completeTask) // tid is UUID
+	retryPolicy, err := common.RetryPolicyFromEnv("ATES_TM")
+	if err != nil {
+		logger.Fatalf("Failed to read retry policy: %s", err.Error())
+		os.Exit(-1)
+	}
+	app.eventConsumer.SetRetryPolicy(retryPolicy)
 
-	abortReadCh := make(chan bool)
-	go app.startReadingNotification(abortReadCh)
+	err = app.eventConsumer.Subscribe([]string{"user.lifecycle"})
+	if err != nil {
+		logger.Fatalf("Failed to subscribe to necessary Kafka topic")
+		os.Exit(-1)
+	}
 
-	e.Logger.Fatal(e.Start(webAddress))
+	// permission matrix maps actions to roles and scopes, ATES_PERMISSIONS is path of JSON file
+	permissions, err := common.LoadPermissions(os.Getenv("ATES_PERMISSIONS"))
+	if err != nil {
+		logger.Fatalf("Failed to load permissions: %s", err.Error())
+		os.Exit(-1)
+	}
+
+	// access tokens are verified locally with keys of Auth, so requests are served while Auth is down;
+	// verified tokens are cached for TTL. Auth introspects tokens of users not synced yet and of AllowFresh routes.
+	authClient := &http.Client{
+		Transport: &http.Transport{
+			//TLSClientConfig: tlsConfig,
+		},
+	}
+	auth := common.NewAuthenticator(common.NewJWTVerifier(authServer, authClient),
+		common.NewUserLookup(db, nil, logger), permissions, 30*time.Second, logger)
+	auth.SetIntrospector(common.NewIntrospectionVerifier(authServer, clientID, clientSecret, authClient))
+
+	e.POST("/tasks/new", app.newTask, auth.Allow("task.create"))
+	e.POST("/tasks/reassign", app.reassignTasks, auth.Allow("task.reassign"))
+	e.GET("/tasks/list", app.getOpenTasks, auth.Allow("task.list"))
+	e.GET("/tasks/:tid", app.getTask, auth.Allow("task.read"))                    // tid is UUID
+	e.POST("/tasks/:tid/complete", app.completeTask, auth.Allow("task.complete")) // tid is UUID
+
+	e.GET("/admin/dlq", app.eventConsumer.ListDeadLettersHandler(), auth.Allow("dlq.manage"))
+	e.POST("/admin/dlq/:id/redrive", app.eventConsumer.RedriveDeadLetterHandler(), auth.AllowFresh("dlq.manage"))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go common.NewOutboxRelay(db, kafkaProducer, logger).Run(ctx)
+
+	consumerDone := make(chan struct{})
+	go func() {
+		app.eventConsumer.Run(ctx)
+		close(consumerDone)
+	}()
 
-	abortReadCh <- true
+	common.StartEcho(ctx, e, webAddress, logger)
+	<-consumerDone
 }
@@ -1,37 +1,29 @@
 package main
 
 import (
+	"ates/common"
 	"ates/schema"
+	"ates/schema/events"
 	"errors"
-	"github.com/hamba/avro/v2"
 	"gorm.io/gorm"
 	"strings"
 )
 
-type AuthVerification struct {
-	PublicId string `json:"sub"`
-}
-
 // User is synced, source is "auth"
-type User struct {
-	gorm.Model `json:"-"`
-	PublicId   string          `json:"uid" avro:"uid"`
-	Login      string          `json:"login" avro:"login"`
-	RoleID     schema.UserRole `json:"roleId" avro:"roleId"`
-}
+type User = common.User
 
 type Task struct {
 	gorm.Model   `json:"-"`
-	PublicId     string            `gorm:"default:(uuid());unique" json:"tid" avro:"tid"`
-	JiraId       string            `json:"jira_id" avro:"jira_id"`
-	Title        string            `json:"title" avro:"title"`
-	Description  string            `json:"description" avro:"description"`
-	StatusID     schema.TaskStatus `json:"statusId" avro:"statusId"`
+	PublicId     string            `gorm:"default:(uuid());unique" json:"tid"`
+	JiraId       string            `json:"jira_id"`
+	Title        string            `json:"title"`
+	Description  string            `json:"description"`
+	StatusID     schema.TaskStatus `json:"statusId"`
 	Status       Status            `json:"-"`
 	AuthorID     uint              `json:"-"`
 	Author       User              `json:"-"`
 	AssignedToID uint              `json:"-"`
-	AssignedTo   User              `json:"assignedTo" avro:"assignedTo"`
+	AssignedTo   User              `json:"assignedTo"`
 }
 
 func (t *Task) validate() error {
@@ -56,16 +48,22 @@ func (t *Task) validate() error {
 	return nil
 }
 
-func (t *Task) marshal() ([]byte, error) {
-	return avro.Marshal(schema.TaskSchema, t)
-}
-
-func (t *Task) unmarshal(b []byte) error {
-	return avro.Unmarshal(schema.TaskSchema, b, t)
+// toEvent maps Task to event with public attributes, assignee is sent by public identifier
+func (t *Task) toEvent() events.Task {
+	return events.Task{
+		Tid:         t.PublicId,
+		JiraId:      t.JiraId,
+		Title:       t.Title,
+		Description: t.Description,
+		StatusId:    int(t.StatusID),
+		AssignedTo: events.UserV1{
+			Uid: t.AssignedTo.PublicId,
+		},
+	}
 }
 
-func (t *Task) load(svc *tmSvc) {
-	svc.tmDb.
+func (t *Task) load(db *gorm.DB) {
+	db.
 		Preload("AssignedTo").
 		Where("id = ?", t.ID).
 		Find(&t)
@@ -2,132 +2,55 @@ package main
 
 import (
 	"ates/common"
-	"ates/schema"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"github.com/hamba/avro/v2"
-	"sync"
-	"time"
+	"context"
+	"fmt"
+	"gorm.io/gorm"
 )
 
-// getTaskForNotification returns new Task with public attributes, ready to be sent as notification
-func getTaskForNotification(task *Task) Task {
-	return Task{
-		PublicId:    task.PublicId,
-		JiraId:      task.JiraId,
-		Title:       task.Title,
-		Description: task.Description,
-		StatusID:    task.StatusID,
-		AssignedTo: User{
-			PublicId: task.AssignedTo.PublicId,
-		},
-	}
-}
-
-// notifyAsync sends notification to Kafka
-func (svc *tmSvc) notifyAsync(eventType string, e interface{}) {
+// notify stores notification in outbox within transaction tx, it is sent to Kafka by OutboxRelay
+func (svc *tmSvc) notify(ctx context.Context, tx *gorm.DB, eventType string, e interface{}) error {
 
 	// Important: right now we are sending all events in a single topic,
 	// not separating CUD (create-update-delete) and BE (business events).
 	// That will be a part of future refactoring (maybe)
 
 	// Also, library confluent-kafka-go has no publicly exposed batch methods.
-	// In the contrast, segmentio/kafka-go does have, but we use Confluent to work with SchemaRegistry.
+	// In the contrast, segmentio/kafka-go does have, but we use Confluent to work with SchemaRegistry (see schema.Registry).
 
 	topic := "task.lifecycle"
 
-	msg := kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-		Key:            []byte(common.GenerateRandomString(10)),
-		Value:          nil,
-	}
-
-	common.AppendKafkaHeader(&msg, "event", eventType)
-	common.AppendKafkaHeader(&msg, "producer", "TaskManager")
+	var event *common.Event
 
 	switch e.(type) {
 	case Task:
 
 		switch eventType {
 		case "Task.Created", "Task.Completed", "Task.Reassigned":
-			common.AppendKafkaHeader(&msg, "eventVersion", "v2")
-
 			t := e.(Task)
-			t.load(svc)
-			taskForNotification := getTaskForNotification(&t)
-			b, err := taskForNotification.marshal()
+			t.load(tx)
+			te := t.toEvent()
+			b, err := te.Marshal()
 			if err != nil {
-				svc.logger.Errorf("failed to marshal Task %s to avro: %s", t.PublicId, err.Error())
-				return
+				return fmt.Errorf("failed to marshal Task %s to avro: %w", t.PublicId, err)
 			}
-			msg.Value = b
-
+			event = common.NewEvent(ctx, eventType, "v3", b)
+			// all events of the task go to the same partition, so they are consumed in order
+			event.Key = []byte(t.PublicId)
 		}
 	}
 
-	if msg.Value != nil {
-		err := svc.kafkaProducer.Produce(&msg, nil)
-		if err != nil {
-			svc.logger.Errorf("Failed to send event notification on %s", eventType)
-			svc.logger.Error(err)
-		}
+	if event == nil {
+		return fmt.Errorf("no notification for %s", eventType)
 	}
+	return common.StoreInOutbox(tx, event.Message(topic))
 }
 
-// startReadingNotification reads topics from Kafka, constructs Notification and sends to notification channel
-func (svc *tmSvc) startReadingNotification(abortCh <-chan bool) {
-	defer func() {
-		_ = svc.kafkaConsumer.Close()
-	}()
-
-	run := true
-	runMx := &sync.Mutex{}
-
-	go func() {
-		for run {
-			msg, err := svc.kafkaConsumer.ReadMessage(time.Second)
-			if err != nil {
-				if err.(kafka.Error).IsTimeout() {
-					continue
-				}
-				svc.logger.Error(err)
-				continue
-				//return
-			}
-
-			eventType, err := common.GetKafkaHeader(msg, "event")
-			if err != nil {
-				svc.logger.Infof("missing event header in the message %s, skipping", msg.Key)
-				continue
-			}
-
-			switch eventType {
-			case "User.Created":
-				var u User
-				err := avro.Unmarshal(schema.UserSchema, msg.Value, &u)
-				if err != nil {
-					svc.logger.Errorf("Failed to process notification on %s: bad payload", eventType)
-					continue
-				}
-
-				result := svc.tmDb.Create(&u)
-				if result.RowsAffected == 1 {
-					svc.logger.Infof("Created user %s based on notification %s", u.PublicId, eventType)
-				} else {
-					svc.logger.Errorf("Failed to create user %s based on notification %s", u.PublicId, eventType)
-				}
-
-			}
-		}
-	}()
-
-	for {
-		select {
-		case _ = <-abortCh:
-			runMx.Lock()
-			run = false
-			runMx.Unlock()
-			return
-		}
+// registerEventHandlers binds consumed events to service functions
+func (svc *tmSvc) registerEventHandlers(c *common.EventConsumer) {
+	// every User event carries the whole user, older versions are upcasted to the latest one
+	for _, name := range []string{"User.Created", "User.Updated", "User.Deleted"} {
+		c.Handle(name, "", func(_ context.Context, tx *gorm.DB, e *common.Event) error {
+			return svc.saveUser(tx, e.Payload)
+		})
 	}
-
 }
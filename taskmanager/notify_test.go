@@ -0,0 +1,59 @@
+package main
+
+import (
+	"ates/common"
+	"ates/common/testutil"
+	"ates/schema"
+	"context"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestNotifyKeysTaskEventsByTask(t *testing.T) {
+	if err := schema.UseRegistry("mock://"); err != nil {
+		t.Fatal(err)
+	}
+	db := testutil.OpenDB(t, &User{}, &Task{}, &common.OutboxMessage{})
+	svc := &tmSvc{logger: zap.NewNop().Sugar(), tmDb: db}
+
+	popug := User{PublicId: "u1", Login: "popug", Active: true}
+	if err := db.Create(&popug).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, tid := range []string{"t1", "t2"} {
+		task := Task{PublicId: tid, Title: "Task " + tid, Description: "Do it", StatusID: schema.StatusOpen,
+			AuthorID: popug.ID, AssignedToID: popug.ID}
+		if err := db.Create(&task).Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range []string{"Task.Created", "Task.Completed"} {
+			if err := svc.notify(context.Background(), db, event, task); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var messages []common.OutboxMessage
+	if err := db.Order("id").Find(&messages).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"t1", "t1", "t2", "t2"}
+	if len(messages) != len(want) {
+		t.Fatalf("%d messages in outbox, want %d", len(messages), len(want))
+	}
+	for i, m := range messages {
+		if string(m.Key) != want[i] {
+			t.Errorf("message %d has key %q, want public id of task %s", i, m.Key, want[i])
+		}
+	}
+}
+
+func TestTaskToEvent(t *testing.T) {
+	task := Task{PublicId: "t1", JiraId: "POPUG-1", Title: "Feed parrots", Description: "Twice a day",
+		StatusID: schema.StatusCompleted, AssignedTo: User{PublicId: "u1", Login: "popug"}}
+	e := task.toEvent()
+	if e.Tid != "t1" || e.JiraId != "POPUG-1" || e.Title != task.Title || e.Description != task.Description ||
+		e.StatusId != int(schema.StatusCompleted) || e.AssignedTo.Uid != "u1" {
+		t.Errorf("event of task = %+v", e)
+	}
+}